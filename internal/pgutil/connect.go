@@ -0,0 +1,77 @@
+// Package pgutil holds helpers shared by the writer, replicator and pubsub
+// binaries.
+package pgutil
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Options controls ConnectWithRetry.
+type Options struct {
+	// Timeout bounds the total time spent retrying. Zero means a single
+	// attempt.
+	Timeout time.Duration
+
+	// ApplicationName, if set, overrides the DSN's application_name so the
+	// connections can be told apart in pg_stat_activity.
+	ApplicationName string
+
+	// Configure, if set, is called with the parsed pool config before the
+	// pool is created, e.g. to install connection hooks.
+	Configure func(*pgxpool.Config)
+}
+
+// ConnectWithRetry creates a pool for dsn and pings it, retrying with
+// exponential backoff until it succeeds or opts.Timeout passes. This lets the
+// binaries start before the databases are ready, e.g. under docker compose.
+func ConnectWithRetry(ctx context.Context, dsn string, opts Options) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ApplicationName != "" {
+		poolConfig.ConnConfig.RuntimeParams["application_name"] = opts.ApplicationName
+	}
+	if opts.Configure != nil {
+		opts.Configure(poolConfig)
+	}
+
+	deadline := time.Now().Add(opts.Timeout)
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+		if err == nil {
+			if err = pool.Ping(ctx); err == nil {
+				return pool, nil
+			}
+			pool.Close()
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		log.Printf("Database %s:%d not ready (%v), retrying in %v", poolConfig.ConnConfig.Host, poolConfig.ConnConfig.Port, err, backoff)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 5*time.Second)
+	}
+}
+
+// ApplicationName returns parts joined by "/" followed by the local hostname,
+// e.g. "cdc-replicator/migration_slot/host1".
+func ApplicationName(parts ...string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return strings.Join(append(parts, hostname), "/")
+}
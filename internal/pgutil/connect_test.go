@@ -0,0 +1,49 @@
+package pgutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestApplicationName(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	if got, want := ApplicationName("cdc-replicator", "migration_slot"), "cdc-replicator/migration_slot/"+hostname; got != want {
+		t.Errorf("ApplicationName = %q, want %q", got, want)
+	}
+}
+
+func TestConnectWithRetrySetsApplicationName(t *testing.T) {
+	tests := []struct {
+		dsn, name, want string
+	}{
+		{"host=localhost", "cdc-replicator/s/h", "cdc-replicator/s/h"},
+		{"host=localhost application_name=from-dsn", "cdc-replicator/s/h", "cdc-replicator/s/h"},
+		{"host=localhost application_name=from-dsn", "", "from-dsn"},
+	}
+	for _, tt := range tests {
+		var got string
+		_, err := ConnectWithRetry(context.Background(), tt.dsn, Options{
+			ApplicationName: tt.name,
+			Configure: func(poolConfig *pgxpool.Config) {
+				got = poolConfig.ConnConfig.RuntimeParams["application_name"]
+				poolConfig.ConnConfig.DialFunc = func(context.Context, string, string) (net.Conn, error) {
+					return nil, errors.New("no database")
+				}
+			},
+		})
+		if err == nil {
+			t.Fatal("connected without a database")
+		}
+		if got != tt.want {
+			t.Errorf("%q with %q: application_name %q, want %q", tt.dsn, tt.name, got, tt.want)
+		}
+	}
+}
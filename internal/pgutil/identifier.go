@@ -0,0 +1,33 @@
+package pgutil
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var identifierRE = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// CheckIdentifier checks that name is valid both as an unquoted Postgres
+// identifier and as a replication slot name: lower case letters, digits and
+// underscores, not starting with a digit, and at most 63 bytes. kind names
+// the object in the error, e.g. "slot name".
+func CheckIdentifier(kind, name string) error {
+	if len(name) > 63 {
+		return fmt.Errorf("%s %q is longer than 63 bytes", kind, name)
+	}
+	if !identifierRE.MatchString(name) {
+		return fmt.Errorf("%s %q must be lower case letters, digits and underscores, not starting with a digit", kind, name)
+	}
+	return nil
+}
+
+// Prefix returns name with prefix and an underscore in front, e.g.
+// "tenant_a_migration_slot", or name itself if prefix is empty. Check the
+// result with CheckIdentifier: Postgres would silently truncate a name longer
+// than 63 bytes, and two names differing only past that point would collide.
+func Prefix(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "_" + name
+}
@@ -0,0 +1,28 @@
+package pgutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckIdentifier(t *testing.T) {
+	for _, name := range []string{"migration_slot", "_slot", "slot_2", strings.Repeat("s", 63)} {
+		if err := CheckIdentifier("slot name", name); err != nil {
+			t.Errorf("CheckIdentifier(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{"", "Slot", "2_slot", "orders-slot", "orders slot", "slot;drop", strings.Repeat("s", 64)} {
+		if err := CheckIdentifier("slot name", name); err == nil {
+			t.Errorf("CheckIdentifier(%q): no error", name)
+		}
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	if got := Prefix("", "migration_slot"); got != "migration_slot" {
+		t.Errorf("Prefix without a prefix = %q", got)
+	}
+	if got := Prefix("tenant_a", "migration_slot"); got != "tenant_a_migration_slot" {
+		t.Errorf("Prefix = %q, want tenant_a_migration_slot", got)
+	}
+}
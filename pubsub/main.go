@@ -2,15 +2,44 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/juliaogris/postgres-cdc-example/internal/pgutil"
 )
 
 func main() {
+	resume := flag.Bool("resume", false, "keep an existing subscription and its progress instead of recreating it")
+	connectTimeout := flag.Duration("connect-timeout", time.Minute, "keep retrying to connect to each database for this long")
+	publication := flag.String("publication", "person_publication", "name of the publication created on the source")
+	subscription := flag.String("subscription", "person_subscription", "name of the subscription created on the target, and of its slot on the source")
+	namePrefix := flag.String("name-prefix", "", "prefix the publication and subscription names with this and an underscore, e.g. tenant_a, to keep the pipelines of several tenants apart")
+	binary := flag.Bool("binary", false, "create the subscription with binary = true, transferring rows in binary format")
+	copyData := flag.Bool("copy-data", true, "have the subscription copy existing rows; use -copy-data=false if the target was already seeded, e.g. by a replicator -snapshot-only run")
+	forceBinary := flag.Bool("force-binary", false, "allow -binary even if the source and target major versions differ")
+	appName := flag.String("application-name", "", "application_name reported to the servers (default cdc-pubsub/<subscription>/<hostname>)")
+	flag.Parse()
+	if *namePrefix != "" {
+		if err := pgutil.CheckIdentifier("name prefix", *namePrefix); err != nil {
+			log.Fatal(err)
+		}
+		*publication = pgutil.Prefix(*namePrefix, *publication)
+		*subscription = pgutil.Prefix(*namePrefix, *subscription)
+	}
+	if err := pgutil.CheckIdentifier("publication", *publication); err != nil {
+		log.Fatal(err)
+	}
+	if err := pgutil.CheckIdentifier("subscription", *subscription); err != nil {
+		log.Fatal(err)
+	}
+	if *appName == "" {
+		*appName = pgutil.ApplicationName("cdc-pubsub", *subscription)
+	}
+
 	ctx := context.Background()
 
 	// Connection strings
@@ -18,27 +47,38 @@ func main() {
 	targetConnStr := "host=localhost port=5431 user=postgres password=postgres dbname=testdb sslmode=disable"
 
 	// Connect to source database
-	sourcePool, err := pgxpool.New(ctx, sourceConnStr)
+	sourcePool, err := pgutil.ConnectWithRetry(ctx, sourceConnStr, pgutil.Options{Timeout: *connectTimeout, ApplicationName: *appName})
 	if err != nil {
 		log.Fatal("Failed to connect to source database:", err)
 	}
 	defer sourcePool.Close()
 
 	// Connect to target database  
-	targetPool, err := pgxpool.New(ctx, targetConnStr)
+	targetPool, err := pgutil.ConnectWithRetry(ctx, targetConnStr, pgutil.Options{Timeout: *connectTimeout, ApplicationName: *appName})
 	if err != nil {
 		log.Fatal("Failed to connect to target database:", err)
 	}
 	defer targetPool.Close()
 
-	// Test connections
-	if err := sourcePool.Ping(ctx); err != nil {
-		log.Fatal("Failed to ping source database:", err)
+	fmt.Println("Successfully connected to both databases!")
+
+	// Check that the server versions can replicate to each other
+	sourceVersion, err := serverVersion(ctx, sourcePool)
+	if err != nil {
+		log.Fatal("Failed to read source server version:", err)
+	}
+	targetVersion, err := serverVersion(ctx, targetPool)
+	if err != nil {
+		log.Fatal("Failed to read target server version:", err)
 	}
-	if err := targetPool.Ping(ctx); err != nil {
-		log.Fatal("Failed to ping target database:", err)
+	fmt.Printf("Source is PostgreSQL %s, target is PostgreSQL %s\n", formatVersion(sourceVersion), formatVersion(targetVersion))
+	warnings, err := checkVersions(sourceVersion, targetVersion, *binary, *forceBinary)
+	for _, warning := range warnings {
+		log.Printf("Warning: %s", warning)
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
-	fmt.Println("Successfully connected to both databases!")
 
 	// Step 1: Create table on target if it doesn't exist
 	fmt.Println("\nEnsuring target table exists...")
@@ -57,68 +97,20 @@ func main() {
 	}
 	fmt.Println("Target table 'person' is ready")
 
-	// Step 2: Drop existing publication and subscription if they exist
-	fmt.Println("\nCleaning up existing replication objects...")
-	
-	// Drop subscription on target (must be done before dropping publication)
-	dropSubSQL := `DROP SUBSCRIPTION IF EXISTS person_subscription`
-	_, err = targetPool.Exec(ctx, dropSubSQL)
-	if err != nil {
-		log.Printf("Warning: Could not drop subscription: %v", err)
-	}
-
-	// Drop publication on source
-	dropPubSQL := `DROP PUBLICATION IF EXISTS person_publication`
-	_, err = sourcePool.Exec(ctx, dropPubSQL)
-	if err != nil {
-		log.Printf("Warning: Could not drop publication: %v", err)
-	}
-
-	// Step 3: Create publication on source database with WHERE clause for even scores
-	fmt.Println("\nCreating publication on source database (only even scores)...")
-	createPubSQL := `CREATE PUBLICATION person_publication FOR TABLE person WHERE (score % 2 = 0)`
-	_, err = sourcePool.Exec(ctx, createPubSQL)
-	if err != nil {
-		log.Fatal("Failed to create publication:", err)
-	}
-	fmt.Println("Publication 'person_publication' created with filter: score % 2 = 0")
-
-	// Step 4: Truncate target table before subscription
-	fmt.Println("\nPreparing target table for replication...")
-	_, err = targetPool.Exec(ctx, "TRUNCATE TABLE person RESTART IDENTITY")
-	if err != nil {
-		log.Fatal("Failed to truncate target table:", err)
-	}
-	fmt.Println("Target table truncated, ready for subscription")
-
-	// Step 5: Create subscription on target database
-	fmt.Println("\nCreating subscription on target database...")
-	fmt.Println("This will automatically copy existing data with even scores from source...")
-	
-	// Create subscription with copy_data = true (default) to automatically sync initial data
-	createSubSQL := `
-		CREATE SUBSCRIPTION person_subscription 
-		CONNECTION 'host=host.docker.internal port=5429 user=postgres password=postgres dbname=testdb' 
-		PUBLICATION person_publication
-		WITH (synchronous_commit = 'off')`
-	// copy_data defaults to true, so PostgreSQL will automatically copy existing data
-	
-	_, err = targetPool.Exec(ctx, createSubSQL)
-	if err != nil {
-		// Try with container name if host.docker.internal doesn't work
-		createSubSQL = `
-			CREATE SUBSCRIPTION person_subscription 
-			CONNECTION 'host=postgres-source port=5432 user=postgres password=postgres dbname=testdb' 
-			PUBLICATION person_publication
-			WITH (synchronous_commit = 'off')`
-		
-		_, err = targetPool.Exec(ctx, createSubSQL)
+	// Steps 2-5: Set up publication and subscription, unless resuming an
+	// existing subscription
+	resumed := false
+	if *resume {
+		err = targetPool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_subscription WHERE subname = $1)`, *subscription).Scan(&resumed)
 		if err != nil {
-			log.Fatal("Failed to create subscription:", err)
+			log.Fatal("Failed to check for existing subscription:", err)
 		}
 	}
-	fmt.Println("Subscription 'person_subscription' created")
-	fmt.Println("PostgreSQL is now copying initial data and will continue replicating changes...")
+	if resumed {
+		fmt.Printf("\nResuming existing subscription '%s'\n", *subscription)
+	} else {
+		setupReplication(ctx, sourcePool, targetPool, *publication, *subscription, subscriptionOptions{binary: *binary, copyData: *copyData})
+	}
 
 	// Step 6: Monitor replication status
 	fmt.Println("\n✅ Logical replication is now active!")
@@ -136,13 +128,13 @@ func main() {
 			SELECT subname, subenabled, 
 			       subconninfo
 			FROM pg_subscription 
-			WHERE subname = 'person_subscription'
+			WHERE subname = $1
 			LIMIT 1`
 		
 		var enabled bool
 		var connInfo string
 		
-		err := targetPool.QueryRow(ctx, statusSQL).Scan(
+		err := targetPool.QueryRow(ctx, statusSQL, *subscription).Scan(
 			&subName, &enabled, &connInfo)
 		
 		if err != nil {
@@ -197,6 +189,9 @@ func main() {
 			fmt.Println()
 		}
 
+		// Report per-table sync state to tell the initial COPY from streaming
+		reportTableSync(ctx, targetPool, *subscription)
+
 		// Also check for replication lag
 		var lag interface{}
 		lagSQL := `
@@ -208,4 +203,164 @@ func main() {
 			fmt.Printf("                Replication lag: %v seconds\n", lag)
 		}
 	}
-}
\ No newline at end of file
+}
+
+// setupReplication recreates the publication on the source and the
+// subscription on the target, starting replication from scratch.
+func setupReplication(ctx context.Context, sourcePool, targetPool *pgxpool.Pool, publication, subscription string, opts subscriptionOptions) {
+	var err error
+	options := opts.String()
+
+	// Step 2: Drop existing publication and subscription if they exist
+	fmt.Println("\nCleaning up existing replication objects...")
+	
+	// Drop subscription on target (must be done before dropping publication)
+	dropSubSQL := `DROP SUBSCRIPTION IF EXISTS ` + subscription
+	_, err = targetPool.Exec(ctx, dropSubSQL)
+	if err != nil {
+		log.Printf("Warning: Could not drop subscription: %v", err)
+	}
+
+	// Drop publication on source
+	dropPubSQL := `DROP PUBLICATION IF EXISTS ` + publication
+	_, err = sourcePool.Exec(ctx, dropPubSQL)
+	if err != nil {
+		log.Printf("Warning: Could not drop publication: %v", err)
+	}
+
+	// Step 3: Create publication on source database with WHERE clause for even scores
+	fmt.Println("\nCreating publication on source database (only even scores)...")
+	createPubSQL := `CREATE PUBLICATION ` + publication + ` FOR TABLE person WHERE (score % 2 = 0)`
+	_, err = sourcePool.Exec(ctx, createPubSQL)
+	if err != nil {
+		log.Fatal("Failed to create publication:", err)
+	}
+	fmt.Printf("Publication '%s' created with filter: score %% 2 = 0\n", publication)
+
+	// Step 4: Truncate target table before subscription, unless it was
+	// seeded beforehand and the subscription will not copy the data
+	fmt.Println("\nPreparing target table for replication...")
+	if opts.copyData {
+		_, err = targetPool.Exec(ctx, "TRUNCATE TABLE person RESTART IDENTITY")
+		if err != nil {
+			log.Fatal("Failed to truncate target table:", err)
+		}
+		fmt.Println("Target table truncated, ready for subscription")
+	} else {
+		fmt.Println("Keeping the pre-seeded target table, copy_data = false")
+	}
+
+	// Step 5: Create subscription on target database
+	fmt.Println("\nCreating subscription on target database...")
+	if opts.copyData {
+		fmt.Println("This will automatically copy existing data with even scores from source...")
+	} else {
+		fmt.Println("This will only stream changes committed from now on...")
+	}
+	
+	// Create subscription with copy_data = true (default) to automatically sync
+	// initial data, or false to start from the publication's current position
+	createSubSQL := `
+		CREATE SUBSCRIPTION ` + subscription + ` 
+		CONNECTION 'host=host.docker.internal port=5429 user=postgres password=postgres dbname=testdb' 
+		PUBLICATION ` + publication + `
+		WITH (` + options + `)`
+	// copy_data defaults to true, so PostgreSQL will automatically copy existing data
+	
+	_, err = targetPool.Exec(ctx, createSubSQL)
+	if err != nil {
+		// Try with container name if host.docker.internal doesn't work
+		createSubSQL = `
+			CREATE SUBSCRIPTION ` + subscription + ` 
+			CONNECTION 'host=postgres-source port=5432 user=postgres password=postgres dbname=testdb' 
+			PUBLICATION ` + publication + `
+			WITH (` + options + `)`
+		
+		_, err = targetPool.Exec(ctx, createSubSQL)
+		if err != nil {
+			log.Fatal("Failed to create subscription:", err)
+		}
+	}
+	fmt.Printf("Subscription '%s' created\n", subscription)
+	if opts.copyData {
+		fmt.Println("PostgreSQL is now copying initial data and will continue replicating changes...")
+	} else {
+		fmt.Println("PostgreSQL is now replicating changes...")
+	}
+}
+
+// subscriptionOptions are the CREATE SUBSCRIPTION options set by flags.
+type subscriptionOptions struct {
+	binary   bool
+	copyData bool
+}
+
+// String returns the options for the WITH clause of CREATE SUBSCRIPTION.
+func (o subscriptionOptions) String() string {
+	s := "synchronous_commit = 'off'"
+	if o.binary {
+		s += ", binary = true"
+	}
+	if !o.copyData {
+		s += ", copy_data = false"
+	}
+	return s
+}
+
+// tableSyncStates describes the srsubstate codes of pg_subscription_rel.
+var tableSyncStates = map[string]string{
+	"i": "initializing",
+	"d": "initial COPY in progress",
+	"f": "initial COPY finished",
+	"s": "synchronizing",
+	"r": "ready (streaming)",
+}
+
+// reportTableSync prints the sync state of each table in the subscription and
+// whether the subscription as a whole is still copying or caught up.
+func reportTableSync(ctx context.Context, targetPool *pgxpool.Pool, subscription string) {
+	rows, err := targetPool.Query(ctx, `
+		SELECT c.relname, sr.srsubstate
+		FROM pg_subscription_rel sr
+		JOIN pg_subscription s ON s.oid = sr.srsubid
+		JOIN pg_class c ON c.oid = sr.srrelid
+		WHERE s.subname = $1
+		ORDER BY c.relname`, subscription)
+	if err != nil {
+		log.Printf("Failed to check table sync state: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	allReady := true
+	tables := 0
+	for rows.Next() {
+		var table, state string
+		if err := rows.Scan(&table, &state); err != nil {
+			log.Printf("Failed to scan table sync state: %v", err)
+			return
+		}
+		tables++
+		if state != "r" {
+			allReady = false
+		}
+		desc, ok := tableSyncStates[state]
+		if !ok {
+			desc = "unknown state " + state
+		}
+		fmt.Printf("                Table %s: %s\n", table, desc)
+	}
+	if rows.Err() != nil {
+		log.Printf("Failed to read table sync state: %v", rows.Err())
+		return
+	}
+
+	switch {
+	case tables == 0:
+		fmt.Println("                Phase: waiting for tables to be added to the subscription")
+	case allReady:
+		fmt.Println("                Phase: initial copy complete, caught up and streaming")
+	default:
+		fmt.Println("                Phase: initial copy still in progress")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// serverVersion returns the server_version_num of the server behind pool,
+// e.g. 160002 for 16.2.
+func serverVersion(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	var version int
+	err := pool.QueryRow(ctx, `SELECT current_setting('server_version_num')::int`).Scan(&version)
+	return version, err
+}
+
+// checkVersions returns warnings about known logical replication
+// incompatibilities between a source (publisher) and target (subscriber) of
+// the given server_version_num, and an error for combinations that would make
+// CREATE SUBSCRIPTION or the initial copy fail. Binary transfer across
+// different major versions is refused unless forced, because the binary
+// format of a type may change between them.
+func checkVersions(source, target int, binary, forceBinary bool) (warnings []string, err error) {
+	sourceMajor, targetMajor := source/10000, target/10000
+	if sourceMajor < 15 {
+		return nil, fmt.Errorf("source is Postgres %d, publication row filters need 15 or later", sourceMajor)
+	}
+	if targetMajor < 15 {
+		warnings = append(warnings, fmt.Sprintf("target is Postgres %d, which ignores the publication row filter during the initial copy, so odd scores are copied too", targetMajor))
+	}
+	if sourceMajor != targetMajor {
+		warnings = append(warnings, fmt.Sprintf("source is Postgres %d and target is Postgres %d; logical replication works across major versions, but test the pair before relying on it", sourceMajor, targetMajor))
+	}
+	if binary {
+		switch {
+		case targetMajor < 14:
+			return warnings, fmt.Errorf("target is Postgres %d, the binary subscription option needs 14 or later", targetMajor)
+		case sourceMajor != targetMajor && !forceBinary:
+			return warnings, fmt.Errorf("binary transfer between Postgres %d and %d may fail on types whose binary format changed; use -force-binary to try anyway", sourceMajor, targetMajor)
+		case sourceMajor != targetMajor:
+			warnings = append(warnings, "binary transfer across major versions is forced with -force-binary")
+		}
+	}
+	return warnings, nil
+}
+
+// formatVersion renders a server_version_num as Postgres prints it, e.g.
+// 160002 as 16.2.
+func formatVersion(version int) string {
+	return fmt.Sprintf("%d.%d", version/10000, version%10000)
+}
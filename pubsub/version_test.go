@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestCheckVersions(t *testing.T) {
+	tests := []struct {
+		name           string
+		source, target int
+		binary, force  bool
+		warnings       int
+		wantErr        bool
+	}{
+		{"same major", 160002, 160004, false, false, 0, false},
+		{"source without row filters", 140010, 160002, false, false, 0, true},
+		{"target ignores row filter in copy", 160002, 140010, false, false, 2, false},
+		{"across majors", 160002, 170000, false, false, 1, false},
+		{"binary same major", 160002, 160002, true, false, 0, false},
+		{"binary target too old", 150005, 130012, true, true, 2, true},
+		{"binary across majors", 160002, 170000, true, false, 1, true},
+		{"binary across majors forced", 160002, 170000, true, true, 2, false},
+	}
+	for _, tt := range tests {
+		warnings, err := checkVersions(tt.source, tt.target, tt.binary, tt.force)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if len(warnings) != tt.warnings {
+			t.Errorf("%s: warnings %q, want %d", tt.name, warnings, tt.warnings)
+		}
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	for version, want := range map[int]string{160002: "16.2", 150000: "15.0", 170010: "17.10"} {
+		if got := formatVersion(version); got != want {
+			t.Errorf("formatVersion(%d) = %q, want %q", version, got, want)
+		}
+	}
+}
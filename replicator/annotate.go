@@ -0,0 +1,42 @@
+package main
+
+// With -annotate every row on the target records the source change that last
+// wrote it: the LSN and the commit time wal2json reports. Rows copied by the
+// snapshot have no change behind them and keep both columns NULL until their
+// first update.
+var annotationColumns = []string{"_src_lsn", "_src_committed_at"}
+
+// annotateTableSQL adds the annotation columns, also to an existing target
+// table.
+const annotateTableSQL = `
+	ALTER TABLE person
+		ADD COLUMN IF NOT EXISTS _src_lsn PG_LSN,
+		ADD COLUMN IF NOT EXISTS _src_committed_at TIMESTAMPTZ;`
+
+// annotate appends the annotation parameters of change to args if -annotate
+// is set.
+func (r *replicator) annotate(change WAL2JSONChange, args []any) []any {
+	if !r.cfg.Annotate {
+		return args
+	}
+	return append(args, change.LSN, commitTime(change))
+}
+
+// commitTime returns the commit time wal2json reports for change, or nil if
+// it cannot be parsed.
+func commitTime(change WAL2JSONChange) any {
+	t, err := parseTimestamp(change.Timestamp)
+	if err != nil {
+		return nil
+	}
+	return t
+}
+
+// deleteArgs returns the parameters of the delete statements for change,
+// which with -soft-delete include its commit time.
+func (r *replicator) deleteArgs(change WAL2JSONChange, id any) []any {
+	if r.cfg.SoftDelete == "" {
+		return r.args(id)
+	}
+	return r.args(id, commitTime(change))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnnotate(t *testing.T) {
+	change := WAL2JSONChange{LSN: "0/16B3748", Timestamp: "2024-03-05 14:30:15.123456+01"}
+	r := &replicator{cfg: config{Annotate: true}}
+	args := r.annotate(change, []any{1, "a"})
+	if len(args) != 4 || args[0] != 1 || args[1] != "a" || args[2] != "0/16B3748" {
+		t.Fatalf("annotate args %v, want the change's args, LSN and commit time", args)
+	}
+	if committed, ok := args[3].(time.Time); !ok || !committed.Equal(time.Date(2024, 3, 5, 13, 30, 15, 123456000, time.UTC)) {
+		t.Errorf("commit time %#v, want 2024-03-05 13:30:15.123456 UTC", args[3])
+	}
+
+	change.Timestamp = ""
+	if args := r.annotate(change, nil); len(args) != 2 || args[1] != nil {
+		t.Errorf("annotate args %v without a commit time, want it NULL", args)
+	}
+	r.cfg.Annotate = false
+	if args := r.annotate(change, []any{1}); len(args) != 1 {
+		t.Errorf("annotate args %v without -annotate, want them unchanged", args)
+	}
+}
+
+func TestDeleteArgs(t *testing.T) {
+	change := WAL2JSONChange{Action: "D", Timestamp: "2024-03-05 14:30:15+00"}
+	if args := (&replicator{}).deleteArgs(change, 1.0); len(args) != 1 || args[0] != 1.0 {
+		t.Errorf("delete args %v, want the id", args)
+	}
+	args := (&replicator{cfg: config{SoftDelete: "deleted_at"}}).deleteArgs(change, 1.0)
+	if len(args) != 2 || args[0] != 1.0 || !args[1].(time.Time).Equal(time.Date(2024, 3, 5, 14, 30, 15, 0, time.UTC)) {
+		t.Errorf("-soft-delete delete args %v, want the id and commit time", args)
+	}
+}
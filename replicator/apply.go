@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// exec runs a CDC statement on the target, retrying transient failures up to
+// -apply-retries times. With -apply-timeout set, each attempt is cancelled
+// once the timeout passes and counts as transient, so a single blocked row
+// cannot stall the pipeline. With -apply-isolation set, each attempt runs in
+// its own transaction at that level, and serialization failures are retried.
+func (r *replicator) exec(ctx context.Context, sql string, args ...any) error {
+	var err error
+	for attempt := 0; attempt <= r.cfg.ApplyRetries; attempt++ {
+		err = r.execOnce(ctx, sql, args...)
+		if err == nil || !isTransient(err) || ctx.Err() != nil {
+			break
+		}
+		log.Printf("%sTransient apply failure (attempt %d of %d): %v", r.prefix, attempt+1, r.cfg.ApplyRetries+1, err)
+	}
+	switch {
+	case err == nil:
+		r.breaker.success()
+	case ctx.Err() == nil && !isDataError(err):
+		r.breaker.failure(time.Now())
+	}
+	return err
+}
+
+func (r *replicator) execOnce(ctx context.Context, sql string, args ...any) error {
+	if r.cfg.ApplyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.cfg.ApplyTimeout)
+		defer cancel()
+	}
+	r.tracef("SQL: %s %v\n", strings.Join(strings.Fields(sql), " "), args)
+	if err := r.chaos.inject(ctx, r.target); err != nil {
+		return err
+	}
+	if r.cfg.ApplyIsolation == "" {
+		_, err := r.target.Exec(ctx, sql, args...)
+		return err
+	}
+	return pgx.BeginTxFunc(ctx, r.target, pgx.TxOptions{IsoLevel: isolationLevels[r.cfg.ApplyIsolation]}, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, sql, args...)
+		return err
+	})
+}
+
+// isolationLevels maps -apply-isolation values to transaction isolation
+// levels.
+var isolationLevels = map[string]pgx.TxIsoLevel{
+	"read-committed":  pgx.ReadCommitted,
+	"repeatable-read": pgx.RepeatableRead,
+	"serializable":    pgx.Serializable,
+}
+
+// isTransient reports whether a failed statement is worth retrying.
+func isTransient(err error) bool {
+	return isTimeout(err) || isConflict(err) || errors.Is(err, errChaos)
+}
+
+// isConflict reports whether a statement failed because it conflicted with a
+// concurrent transaction, which under repeatable read or serializable
+// isolation is expected and resolved by running it again.
+func isConflict(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "40P01" // serialization_failure, deadlock_detected
+	}
+	return false
+}
+
+// isDataError reports whether a statement failed because of the change it
+// applied rather than the state of the target, e.g. an invalid value or a
+// constraint violation. These do not count towards the circuit breaker.
+func isDataError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23") // data_exception, integrity_constraint_violation
+	}
+	return false
+}
+
+// isTimeout reports whether err was caused by a statement being cancelled
+// because its deadline passed, either client side, by the server acting on
+// the cancel request, or by the server's statement_timeout or lock_timeout.
+func isTimeout(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "57014" || pgErr.Code == "55P03" // query_canceled, lock_not_available
+	}
+	return pgconn.Timeout(err) || errors.Is(err, context.DeadlineExceeded)
+}
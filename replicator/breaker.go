@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breaker is a circuit breaker around applying changes to the target. After
+// -breaker-failures consecutive failed statements within -breaker-window it
+// opens, and no source polls its slot or applies another change of the poll
+// it is in, so nothing more is consumed, until -breaker-cooldown has passed.
+// It then half-opens: the next poll is let through, and its first statement
+// closes the breaker if it succeeds or opens it again if it fails. It is
+// shared by all sources, as they share the target, and a nil breaker always
+// lets changes through.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	state     breakerState
+	failures  []time.Time // consecutive failures within window
+	openedAt  time.Time
+}
+
+// allow reports whether changes may be read and applied at now.
+func (b *breaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen {
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		log.Print("Circuit breaker half-open, testing the target")
+	}
+	return true
+}
+
+// success records a statement that succeeded.
+func (b *breaker) success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		log.Print("Circuit breaker closed, the target recovered")
+	}
+	b.state = breakerClosed
+	b.failures = b.failures[:0]
+}
+
+// failure records a statement that failed at now, after its retries.
+func (b *breaker) failure(now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.open(now)
+		return
+	}
+	b.failures = append(b.failures, now)
+	for len(b.failures) > 0 && now.Sub(b.failures[0]) > b.window {
+		b.failures = b.failures[1:]
+	}
+	if b.state == breakerClosed && len(b.failures) >= b.threshold {
+		b.open(now)
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+	b.failures = b.failures[:0]
+	log.Printf("Circuit breaker open: the target keeps failing, pausing for %v", b.cooldown)
+}
+
+// current returns the state of the breaker.
+func (b *breaker) current() breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
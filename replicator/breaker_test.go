@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAfterFailures(t *testing.T) {
+	b := &breaker{threshold: 3, window: time.Minute, cooldown: 30 * time.Second}
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		b.failure(start)
+	}
+	if !b.allow(start) || b.current() != breakerClosed {
+		t.Fatalf("after 2 of 3 failures: state %v, want closed", b.current())
+	}
+	b.failure(start)
+	if b.allow(start.Add(29*time.Second)) || b.current() != breakerOpen {
+		t.Fatalf("after 3 failures, within the cooldown: state %v, want open", b.current())
+	}
+	if !b.allow(start.Add(30*time.Second)) || b.current() != breakerHalfOpen {
+		t.Fatalf("after the cooldown: state %v, want half-open", b.current())
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	start := time.Now()
+	b := &breaker{threshold: 1, window: time.Minute, cooldown: time.Second}
+	b.failure(start)
+	b.allow(start.Add(time.Second))
+	b.failure(start.Add(time.Second))
+	if b.current() != breakerOpen || b.allow(start.Add(1500*time.Millisecond)) {
+		t.Fatalf("failure while half-open: state %v, want open again", b.current())
+	}
+	b.allow(start.Add(2 * time.Second))
+	b.success()
+	if b.current() != breakerClosed {
+		t.Fatalf("success while half-open: state %v, want closed", b.current())
+	}
+}
+
+func TestBreakerForgetsOldFailures(t *testing.T) {
+	start := time.Now()
+	b := &breaker{threshold: 2, window: time.Minute, cooldown: time.Second}
+	b.failure(start)
+	b.failure(start.Add(2 * time.Minute))
+	if b.current() != breakerClosed {
+		t.Errorf("failures further apart than the window: state %v, want closed", b.current())
+	}
+	b.success()
+	b.failure(start.Add(2*time.Minute + time.Second))
+	if b.current() != breakerClosed {
+		t.Errorf("failures split by a success: state %v, want closed", b.current())
+	}
+}
+
+func TestNilBreaker(t *testing.T) {
+	var b *breaker
+	b.failure(time.Now())
+	b.success()
+	if !b.allow(time.Now()) || b.current() != breakerClosed {
+		t.Error("nil breaker does not let changes through")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// errChaos is the error injected by -chaos. It is treated as transient.
+var errChaos = errors.New("chaos: injected apply failure")
+
+// chaos injects failures into the apply path for resilience testing. It is
+// enabled by the hidden -chaos flag and must never be on by default.
+type chaos struct {
+	probability float64
+}
+
+// inject randomly, with the configured probability, fails the statement,
+// drops a target connection or delays the statement. A nil chaos does
+// nothing.
+func (c *chaos) inject(ctx context.Context, pool *pgxpool.Pool) error {
+	if c == nil || rand.Float64() >= c.probability {
+		return nil
+	}
+	switch rand.Intn(3) {
+	case 0:
+		return errChaos
+	case 1:
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		log.Println("CHAOS: dropping a target connection")
+		conn.Conn().Close(ctx)
+		conn.Release()
+	case 2:
+		delay := time.Duration(rand.Int63n(int64(2 * time.Second)))
+		log.Printf("CHAOS: delaying statement by %v", delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	return nil
+}
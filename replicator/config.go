@@ -0,0 +1,713 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juliaogris/postgres-cdc-example/internal/pgutil"
+)
+
+type config struct {
+	SourceDSNs      []string
+	SourceIDs       []int // of each source with fan-in, from its -source-dsn
+	TargetDSN       string
+	ShardDSNs       []string // -target-dsn after the first, for fan-out
+	TargetReadDSN   string
+	SlotName        string
+	NamePrefix      string
+	TemporarySlot   bool
+	DropSlotOnExit  bool
+	PasswordFile    string
+	PasswordCommand string
+	SecretsFile     string
+	ConnectTimeout  time.Duration
+	TCPKeepAlive    time.Duration
+	PoolHealthCheck time.Duration
+	DrainTimeout    time.Duration
+	ApplicationName string
+	ApplyTimeout    time.Duration
+	SlowApply       time.Duration
+	ApplyRetries    int
+	ApplyMode       string
+	ApplyOrdering   string
+	ApplyWorkers    int
+	ApplyIsolation  string
+	InsertConflict  string
+	CreatedAt       string
+	TargetKey       string
+	NoUpdateColumns []string
+	Annotate        bool
+	SoftDelete      string
+	Sink            string
+	NATSURL         string
+	NATSSubject     string
+	SinkTxnMarkers  bool
+	Capture         string
+	DeadLetterFile  string
+	Strict          bool
+	Envelope        string
+	RowAsJSONB      bool
+	AppendOnly      bool
+	AppendUpdates   string
+	Reconcile       bool
+	SnapshotOnly    bool
+	CDCOnly         bool
+	AttachSlot      bool
+	NoSnapshot      bool
+	ResyncTable     string
+	TargetNone      bool
+	Peek            bool
+	ReportInterval  time.Duration
+	OutputFormat    string
+	IdleLogInterval time.Duration
+	ValidateOnly    bool
+	DumpConfig      bool
+	PrintDDL        bool
+	Verbosity       int
+	Chaos           float64
+	Masks           []string
+	EnumMaps        []string
+	MaskKey         string
+	TargetSettings  []string
+
+	MaxSnapshotRows       int64
+	SnapshotOverLimit     string
+	SnapshotSamplePercent float64
+	SnapshotWhere         string
+	SnapshotWorkers       int
+	CursorFetchSize       int
+
+	PollLimit     int
+	FormatVersion int
+	MaxTxnChanges int
+	MinPoll       time.Duration
+	MaxPoll       time.Duration
+
+	SinkBatchSize     int
+	SinkFlushInterval time.Duration
+	DedupeWindow      int
+	DedupeWindowFile  string
+
+	HealthAddr            string
+	HealthRequireCaughtUp bool
+	HealthMaxLagBytes     int64
+	HealthCaughtUpFor     time.Duration
+
+	MetricsPushgateway  string
+	MetricsPushInterval time.Duration
+
+	MaxLagExit     string
+	MaxLagDuration time.Duration
+
+	CheckColumnTypes      bool
+	OnUnsupportedType     string
+	ReplicaIdentityCheck  string
+	SchemaRefreshInterval time.Duration
+
+	TargetReadonlyGuard string
+	PartitionParents    map[string]string
+
+	BootstrapDump string
+	BootstrapLSN  string
+
+	WatchColumns     []string
+	UnwatchedUpdates string
+
+	AllowedTargetHosts []string
+	ProductionTarget   string
+	IKnowProduction    bool
+
+	ShardByColumn string
+	ShardMapping  string
+	ShardRanges   []int64 // with range mapping, upper bounds of every shard but the last
+
+	PreSnapshotSQL  string
+	PostSnapshotSQL string
+
+	SeenChanges     int
+	SeenChangesFile string
+
+	SelfTest     bool
+	SelfTestRows int
+
+	Verify            bool
+	CompareSchemas    bool
+	ChecksumAlgorithm string
+
+	BreakerFailures int
+	BreakerWindow   time.Duration
+	BreakerCooldown time.Duration
+
+	Manifest string
+
+	SetFlags []string // given on the command line or in the environment
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeated flag.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ", ") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// parseConfig defines the replicator's flags on fs, parses args and returns
+// the checked config. Flag errors are handled as fs's error handling says.
+func parseConfig(fs *flag.FlagSet, args []string) (config, error) {
+	var cfg config
+	var sourceDSNs, targetDSNs, masks, targetSettings, enumMaps, partitionParents stringList
+	var searchPath, replicationRole string
+	var statementTimeout, lockTimeout time.Duration
+	var attachSlot string
+	var quietFlag, verboseFlag, vvFlag bool
+	fs.Var(&sourceDSNs, "source-dsn", "source database connection string; repeat to merge several sources into one target (fan-in), each prefixed by its source id, as in 1=host=...")
+	fs.Var(&targetDSNs, "target-dsn", "target database connection string, used for all writes; repeat with -shard-by-column to split the source over several targets (fan-out)")
+	fs.Var(&targetDSNs, "target-write-dsn", "alias for -target-dsn")
+	fs.StringVar(&cfg.ShardByColumn, "shard-by-column", "", "with several -target-dsn, the person column whose value decides the target of each row")
+	fs.StringVar(&cfg.ShardMapping, "shard-mapping", "modulo", "how -shard-by-column values map to targets: modulo, by the value modulo the number of targets, or range, by -shard-ranges")
+	shardRanges := fs.String("shard-ranges", "", "with -shard-mapping range, comma-separated ascending upper bounds, exclusive, of every target's values but the last")
+	fs.StringVar(&cfg.TargetReadDSN, "target-read-dsn", "", "target connection string for schema checks and verification reads, e.g. a replica (defaults to -target-dsn)")
+	allowedTargetHosts := fs.String("allowed-target-hosts", "", "comma-separated hosts the target DSNs may point at; refuse to start with any other (default any host)")
+	fs.StringVar(&cfg.ProductionTarget, "production-target-pattern", "", "regular expression matching production target hosts, which are refused without -i-know-this-is-production")
+	fs.BoolVar(&cfg.IKnowProduction, "i-know-this-is-production", false, "allow a target host matching -production-target-pattern")
+	fs.StringVar(&cfg.PasswordFile, "password-file", "", "read the database password from this file for each new connection")
+	fs.StringVar(&cfg.PasswordCommand, "password-command", "", "run this shell command for each new connection and use its output as the database password")
+	fs.StringVar(&cfg.SecretsFile, "secrets-file", "", "read source-dsn, target-dsn and target-read-dsn from this file of name=value lines, for those not given as flags or in the environment; target DSN changes are applied while running, source-dsn changes are only logged and take a restart")
+	fs.DurationVar(&cfg.ConnectTimeout, "connect-timeout", time.Minute, "keep retrying to connect to each database for this long")
+	fs.DurationVar(&cfg.TCPKeepAlive, "tcp-keepalive", 5*time.Minute, "interval of TCP keepalive probes on database connections, to detect connections dropped by NAT or load balancers (0 disables)")
+	fs.DurationVar(&cfg.PoolHealthCheck, "pool-health-check", time.Minute, "how often idle pooled connections are pinged and dead ones replaced")
+	fs.StringVar(&cfg.SlotName, "slot-name", "migration_slot", "name of the replication slot on each source; use different names to run independent replications from one source")
+	fs.StringVar(&cfg.NamePrefix, "name-prefix", "", "prefix the slot and progress table names with this and an underscore, e.g. tenant_a, to keep the pipelines of several tenants apart")
+	fs.BoolVar(&cfg.TemporarySlot, "temporary-slot", false, "use a temporary slot that Postgres drops when the replicator exits; a restart cannot resume from it")
+	fs.BoolVar(&cfg.DropSlotOnExit, "drop-slot-on-clean-exit", false, "drop the slot after a graceful shutdown with every change applied, keeping it to resume from after an error")
+	fs.StringVar(&cfg.ApplicationName, "application-name", "", "application_name reported to the servers (default cdc-replicator/<slot-name>/<hostname>)")
+	fs.DurationVar(&cfg.DrainTimeout, "drain-timeout", 30*time.Second, "on SIGINT or SIGTERM, how long to finish applying changes already read from the slot before cancelling them")
+	fs.DurationVar(&cfg.ApplyTimeout, "apply-timeout", 0, "cancel a CDC statement on the target if it runs longer than this (0 means no timeout)")
+	fs.DurationVar(&cfg.SlowApply, "slow-apply-threshold", 0, "log a warning with the table, action, key and duration of every CDC change that takes longer than this to apply, at any verbosity (0 disables)")
+	fs.IntVar(&cfg.ApplyRetries, "apply-retries", 3, "retry a CDC statement that timed out or failed transiently this many times before skipping the change")
+	fs.StringVar(&cfg.ApplyMode, "apply-mode", "upsert", "how CDC changes are applied: upsert, or merge to use MERGE on Postgres 15+ targets")
+	fs.StringVar(&cfg.ApplyOrdering, "apply-ordering", "strict", "strict applies CDC changes one by one in source order; relaxed applies each poll's changes in parallel, each row's in source order but different rows' in any order")
+	fs.IntVar(&cfg.ApplyWorkers, "apply-workers", 4, "number of rows -apply-ordering relaxed applies changes to at once")
+	fs.StringVar(&cfg.ReplicaIdentityCheck, "replica-identity-check", "warn", "on start, check that the source's replica identity makes updates and deletes carry the id: warn, error to exit, or off")
+	fs.StringVar(&cfg.CreatedAt, "created-at", "source", "created_at written by snapshot and CDC inserts: source copies the source's, target-now leaves it to the target column's default, e.g. the time the row landed")
+	fs.StringVar(&cfg.InsertConflict, "insert-conflict", "", "what snapshot and CDC inserts both do with a row whose key already exists on the target: do-update overwrites it, do-nothing keeps it (default: the snapshot keeps it, CDC inserts overwrite it)")
+	fs.StringVar(&cfg.ApplyIsolation, "apply-isolation", "", "run each CDC statement in a transaction at this isolation level: read-committed, repeatable-read or serializable (default the target's default_transaction_isolation, without an explicit transaction)")
+	fs.IntVar(&cfg.BreakerFailures, "breaker-failures", 0, "open the circuit breaker, pausing polls, after this many consecutive failed CDC statements within -breaker-window (0 disables)")
+	fs.DurationVar(&cfg.BreakerWindow, "breaker-window", time.Minute, "window in which -breaker-failures must occur")
+	fs.DurationVar(&cfg.BreakerCooldown, "breaker-cooldown", 30*time.Second, "how long an open circuit breaker pauses polls before testing the target again")
+	fs.StringVar(&cfg.TargetKey, "target-key", "id", "target column that inserts and updates are matched on; needs a unique constraint on the target and, unless id, REPLICA IDENTITY FULL on the source")
+	watchColumns := fs.String("watch-columns", "", "comma-separated columns whose changes matter: updates that change none of them are handled per -unwatched-updates; needs REPLICA IDENTITY FULL on the source to compare")
+	fs.StringVar(&cfg.UnwatchedUpdates, "unwatched-updates", "skip", "what to do with updates that change no -watch-columns: skip them, or apply them to the target without emitting them to the sink")
+	noUpdateColumns := fs.String("no-update-columns", "", "comma-separated columns that are set on insert but never overwritten by an update, e.g. uid,score")
+	fs.BoolVar(&cfg.Annotate, "annotate", false, "add _src_lsn and _src_committed_at columns to the target, set from the change that last wrote each row")
+	fs.StringVar(&cfg.SoftDelete, "soft-delete", "", "keep deleted rows on the target, setting this timestamptz column to the delete's commit time; inserts and updates clear it")
+	fs.BoolVar(&cfg.RowAsJSONB, "row-as-jsonb", false, "store each row on the target as (id, data jsonb) instead of mirroring its columns")
+	fs.BoolVar(&cfg.AppendOnly, "append-only", false, "append every change to the target under a surrogate key instead of upserting by id")
+	fs.StringVar(&cfg.AppendUpdates, "append-updates", "ignore", "what -append-only does with updates and deletes: ignore, error or tombstone")
+	fs.StringVar(&cfg.PreSnapshotSQL, "pre-snapshot-sql", "", "SQL run on the target in a transaction before the snapshot, or @file to read it from a file")
+	fs.StringVar(&cfg.PostSnapshotSQL, "post-snapshot-sql", "", "SQL run on the target in a transaction after the snapshot, before streaming, or @file to read it from a file")
+	fs.BoolVar(&cfg.SnapshotOnly, "snapshot-only", false, "create the slot, copy existing rows and exit, keeping the slot for a later -cdc-only run")
+	fs.BoolVar(&cfg.CDCOnly, "cdc-only", false, "skip the snapshot and stream from the existing slot, e.g. one left by -snapshot-only")
+	fs.StringVar(&attachSlot, "attach-slot", "", "use this existing wal2json slot, provisioned elsewhere, instead of -slot-name; it is never created or dropped, and snapshotted only if the target has no progress for it")
+	fs.StringVar(&cfg.BootstrapDump, "bootstrap-dump", "", "instead of a snapshot, load person rows from this COPY data file (CSV with a header if it ends in .csv), then stream from the existing slot from -bootstrap-lsn")
+	fs.StringVar(&cfg.BootstrapLSN, "bootstrap-lsn", "", "LSN of the slot's position when the -bootstrap-dump was taken, at or before the dump")
+	fs.StringVar(&cfg.ResyncTable, "resync-table", "", "empty this target table and snapshot it again, then stream on from the existing slot, keeping its position and recorded progress; only person is replicated")
+	fs.BoolVar(&cfg.NoSnapshot, "no-snapshot", false, "create a fresh slot and stream changes from its creation, without copying existing rows, for a target seeded by other means")
+	fs.BoolVar(&cfg.Reconcile, "reconcile", false, "once CDC has started, backfill rows within the snapshot's key range that are missing on the target")
+	fs.BoolVar(&cfg.TargetNone, "target-none", false, "analysis mode: only report statistics about the changes in the slot, with no target")
+	fs.BoolVar(&cfg.Peek, "peek", false, "with -target-none, read changes without consuming them from the slot")
+	fs.StringVar(&cfg.OutputFormat, "output-format", "table", "format of the -target-none statistics: table, json (one object per report) or csv")
+	fs.DurationVar(&cfg.ReportInterval, "report-interval", 10*time.Second, "how often -target-none prints its statistics")
+	fs.DurationVar(&cfg.IdleLogInterval, "idle-log-interval", time.Minute, "while no changes arrive, log that the replicator is alive and caught up this often (0 disables)")
+	fs.StringVar(&cfg.HealthAddr, "health-addr", "", "serve /healthz, /readyz and /metrics on this address, e.g. :8080")
+	fs.BoolVar(&cfg.HealthRequireCaughtUp, "health-require-caught-up", false, "only report ready while every slot's lag stays under -health-max-lag-bytes")
+	fs.Int64Var(&cfg.HealthMaxLagBytes, "health-max-lag-bytes", 1<<20, "slot lag in bytes at or below which a source counts as caught up")
+	fs.DurationVar(&cfg.HealthCaughtUpFor, "health-caught-up-for", 30*time.Second, "how long a source must stay caught up before reporting ready")
+	fs.StringVar(&cfg.MetricsPushgateway, "metrics-pushgateway", "", "push the metrics to this Prometheus Pushgateway, e.g. http://pushgateway:9091, every -metrics-push-interval and on exit")
+	fs.DurationVar(&cfg.MetricsPushInterval, "metrics-push-interval", time.Minute, "how often to push to -metrics-pushgateway while running (0 only pushes on exit)")
+	fs.StringVar(&cfg.MaxLagExit, "max-lag-exit", "", "exit non-zero if a source's lag stays over this for -max-lag-duration: slot lag in bytes, e.g. 1073741824, or the age of the last applied change while behind, e.g. 5m")
+	fs.DurationVar(&cfg.MaxLagDuration, "max-lag-duration", 10*time.Minute, "how long lag must stay over -max-lag-exit before exiting")
+	fs.StringVar(&cfg.Capture, "capture", "", "append every raw wal2json payload read from the slot, with its LSN and xid, to this JSON lines file")
+	fs.BoolVar(&cfg.CheckColumnTypes, "check-column-types", false, "skip changes whose wal2json column types do not match the target schema")
+	fs.StringVar(&cfg.OnUnsupportedType, "on-unsupported-type", "raw-text", "what to do with columns of composite types, which have no decoder: raw-text binds their text, skip-column leaves them out, fail skips the change like a failed apply")
+	fs.DurationVar(&cfg.SchemaRefreshInterval, "schema-refresh-interval", time.Minute, "how often -check-column-types re-reads the target schema")
+	fs.Var(&partitionParents, "partition-parent", "apply changes on a table to another as partition=parent, in addition to the partitions of person found on the source (repeatable)")
+	fs.IntVar(&cfg.SeenChanges, "seen-changes", 0, "remember this many recently read changes by LSN and skip any read again, e.g. when replaying after a crash (0 disables)")
+	fs.StringVar(&cfg.SeenChangesFile, "seen-changes-file", "", "persist the -seen-changes set to this file after every poll, and load it on start")
+	fs.StringVar(&cfg.TargetReadonlyGuard, "target-readonly-guard", "", "record writes to the target person table by other clients with a trigger, and warn or halt when one is seen")
+	fs.StringVar(&cfg.Manifest, "manifest", "", "keep this JSON file up to date with the slot, snapshot completion and applied LSN of each source, for external orchestration")
+	fs.StringVar(&cfg.DeadLetterFile, "dead-letter-file", "", "append changes skipped by -check-column-types, or failing to apply with -strict, to this JSON lines file")
+	fs.BoolVar(&cfg.Strict, "strict", false, "stop at the first change that fails to apply, leaving it in the slot, or append it to -dead-letter-file if set")
+	fs.StringVar(&cfg.Sink, "sink", "", "also emit every change as JSON lines to \"stdout\" or \"file:PATH\", or publish it to NATS JetStream with \"nats\"")
+	fs.StringVar(&cfg.NATSURL, "nats-url", "nats://localhost:4222", "NATS server for -sink nats, as nats://[user:password@]host[:port]")
+	fs.StringVar(&cfg.NATSSubject, "nats-subject", "cdc", "subject prefix for -sink nats; each change is published on <prefix>.<table>.<id>")
+	fs.IntVar(&cfg.SinkBatchSize, "sink-batch-size", 0, "hand sink events over in batches of this many (0 means no size limit)")
+	fs.DurationVar(&cfg.SinkFlushInterval, "sink-flush-interval", 0, "also flush batched sink events this often (0 means only at the end of each poll)")
+	fs.IntVar(&cfg.DedupeWindow, "dedupe-window", 0, "remember the keys of this many recently emitted sink events and drop any emitted again, e.g. after a crash (0 disables)")
+	fs.StringVar(&cfg.DedupeWindowFile, "dedupe-window-file", "", "persist the -dedupe-window keys to this file after every sink flush, and load it on start")
+	fs.StringVar(&cfg.Envelope, "envelope", "plain", "shape of sink documents: plain or debezium")
+	fs.BoolVar(&cfg.SinkTxnMarkers, "sink-txn-markers", false, "emit a begin and a commit marker around the sink events of each source transaction")
+	fs.Var(&enumMaps, "enum-map", "rename an enum label on its way to the target, as column=from:to; repeatable")
+	fs.Var(&masks, "mask", "mask a column before it reaches the sink, as column=hash|redact|encrypt; repeatable")
+	fs.StringVar(&cfg.MaskKey, "mask-key", "", "hex encoded key: the HMAC-SHA256 key of -mask column=hash and the AES key of column=encrypt")
+	fs.Var(&targetSettings, "target-session", "session setting applied to every target connection, as name=value; repeatable")
+	fs.StringVar(&searchPath, "search-path", "", "search_path for target connections")
+	fs.StringVar(&replicationRole, "session-replication-role", "", "session_replication_role for target connections; replica skips target triggers and FK checks")
+	fs.DurationVar(&statementTimeout, "target-statement-timeout", 0, "statement_timeout for target connections, so a stuck statement fails and is retried (0 means no timeout)")
+	fs.DurationVar(&lockTimeout, "target-lock-timeout", 0, "lock_timeout for target connections, so a statement blocked on a lock fails and is retried (0 means no timeout)")
+	fs.Int64Var(&cfg.MaxSnapshotRows, "max-snapshot-rows", 0, "refuse to snapshot a source table estimated to have more rows than this (0 means no limit)")
+	fs.StringVar(&cfg.SnapshotOverLimit, "snapshot-over-limit", "abort", "what to do when -max-snapshot-rows is exceeded: abort or cdc-only")
+	fs.IntVar(&cfg.SnapshotWorkers, "snapshot-workers", 1, "copy the snapshot with this many workers, each reading an even share of the id range on its own connection")
+	fs.IntVar(&cfg.CursorFetchSize, "cursor-fetch-size", 0, "read the snapshot through a server-side cursor, fetching this many rows at a time to bound memory (0 reads it with a single query)")
+	fs.StringVar(&cfg.SnapshotWhere, "snapshot-where", "", "copy only the source rows matching this SQL predicate in the snapshot, e.g. \"created_at > '2024-01-01'\"; CDC still applies every change")
+	fs.Float64Var(&cfg.SnapshotSamplePercent, "snapshot-sample-percent", 0, "snapshot only a random sample of this percentage of rows, for test environments")
+	fs.DurationVar(&cfg.MinPoll, "min-poll", 250*time.Millisecond, "shortest interval between polls, used while changes keep arriving")
+	fs.DurationVar(&cfg.MaxPoll, "max-poll", 5*time.Second, "longest interval between polls, reached while idle")
+	fs.IntVar(&cfg.MaxTxnChanges, "max-txn-changes", 0, "warn when a source transaction has more than this many changes, as it is applied change by change rather than atomically (0 disables)")
+	fs.IntVar(&cfg.PollLimit, "poll-limit", 0, "consume at most about this many changes per poll, polling again until caught up (0 means no limit)")
+	fs.IntVar(&cfg.FormatVersion, "format-version", 2, "wal2json output format to read: 2, one change per row, or 1, one transaction per row, for wal2json builds that predate version 2")
+	fs.BoolVar(&cfg.SelfTest, "self-test", false, "write test rows to the source, replicate them through a slot of their own, check the target matches, clean up and exit")
+	fs.IntVar(&cfg.SelfTestRows, "self-test-rows", 10, "number of rows -self-test writes")
+	fs.BoolVar(&cfg.CompareSchemas, "compare-schemas", false, "diff the columns, types, nullability, defaults and primary key of person between the source and target, print the differences and exit, non-zero on drift")
+	fs.BoolVar(&cfg.Verify, "verify", false, "compare every row of the source with the target by row hash, print the differences and exit; run it against a quiesced source")
+	fs.StringVar(&cfg.ChecksumAlgorithm, "checksum-algorithm", "fnv", "row hash used by -verify on both sides: fnv (fast, non-cryptographic), md5 or sha256")
+	fs.BoolVar(&cfg.ValidateOnly, "validate-only", false, "run preflight checks against all databases, print a report and exit")
+	fs.BoolVar(&cfg.DumpConfig, "dump-config", false, "print the effective configuration as JSON, with secrets redacted, and exit")
+	fs.BoolVar(&cfg.PrintDDL, "print-ddl", false, "print the DDL the replicator would run on the target for the other flags, without connecting, and exit")
+	fs.BoolVar(&quietFlag, "quiet", false, "only log warnings and errors")
+	fs.BoolVar(&verboseFlag, "verbose", false, "also print every change")
+	fs.BoolVar(&vvFlag, "vv", false, "also print every change and the SQL applying it")
+	// -chaos is for resilience testing only and is left out of -help.
+	fs.Float64Var(&cfg.Chaos, "chaos", 0, "probability of injecting a failure into each CDC statement")
+	fs.Usage = func() {
+		visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+		fs.VisitAll(func(f *flag.Flag) {
+			if f.Name != "chaos" {
+				visible.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		visible.SetOutput(fs.Output())
+		visible.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return config{}, err
+	}
+	// A flag not on the command line can be set in the environment, by its
+	// name in upper case with CDC_ in front and _ for -, as in
+	// CDC_TARGET_DSN. Both take precedence over -secrets-file.
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || given[f.Name] || envErr != nil {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			envErr = fmt.Errorf("invalid %s: %w", envName(f.Name), err)
+		}
+	})
+	if envErr != nil {
+		return config{}, envErr
+	}
+	fs.Visit(func(f *flag.Flag) { cfg.SetFlags = append(cfg.SetFlags, f.Name) })
+
+	cfg.SourceDSNs = sourceDSNs
+	cfg.TargetDSN = "host=localhost port=5431 user=postgres password=postgres dbname=testdb sslmode=disable"
+	if len(targetDSNs) > 0 {
+		cfg.TargetDSN, cfg.ShardDSNs = targetDSNs[0], targetDSNs[1:]
+	}
+	// The file stands in for flags not given, so it is applied before they
+	// are checked
+	if cfg.SecretsFile != "" {
+		s, err := readSecrets(cfg.SecretsFile)
+		if err != nil {
+			return config{}, fmt.Errorf("could not read -secrets-file: %w", err)
+		}
+		s.without(cfg.SetFlags).apply(&cfg)
+	}
+	if cfg.NamePrefix != "" {
+		if err := pgutil.CheckIdentifier("name prefix", cfg.NamePrefix); err != nil {
+			return config{}, err
+		}
+	}
+	cfg.SlotName = pgutil.Prefix(cfg.NamePrefix, cfg.SlotName)
+	// An attached slot keeps the name it was provisioned with
+	if attachSlot != "" {
+		cfg.SlotName, cfg.AttachSlot = attachSlot, true
+	}
+	if err := pgutil.CheckIdentifier("slot name", cfg.SlotName); err != nil {
+		return config{}, err
+	}
+	if err := pgutil.CheckIdentifier("progress table name", cfg.progressTable()); err != nil {
+		return config{}, err
+	}
+	if cfg.ApplicationName == "" {
+		cfg.ApplicationName = pgutil.ApplicationName("cdc-replicator", cfg.SlotName)
+	}
+	switch {
+	case quietFlag && (verboseFlag || vvFlag):
+		return config{}, errors.New("-quiet cannot be combined with -verbose or -vv")
+	case quietFlag:
+		cfg.Verbosity = quiet
+	case vvFlag:
+		cfg.Verbosity = veryVerbose
+	case verboseFlag:
+		cfg.Verbosity = verbose
+	}
+	if *noUpdateColumns != "" {
+		cfg.NoUpdateColumns = strings.Split(*noUpdateColumns, ",")
+	}
+	if *watchColumns != "" {
+		cfg.WatchColumns = strings.Split(*watchColumns, ",")
+	}
+	if *allowedTargetHosts != "" {
+		cfg.AllowedTargetHosts = strings.Split(*allowedTargetHosts, ",")
+	}
+	if *shardRanges != "" {
+		for _, bound := range strings.Split(*shardRanges, ",") {
+			n, err := strconv.ParseInt(strings.TrimSpace(bound), 10, 64)
+			if err != nil {
+				return config{}, fmt.Errorf("invalid -shard-ranges entry %q: %w", bound, err)
+			}
+			if len(cfg.ShardRanges) > 0 && n <= cfg.ShardRanges[len(cfg.ShardRanges)-1] {
+				return config{}, errors.New("-shard-ranges must be ascending")
+			}
+			cfg.ShardRanges = append(cfg.ShardRanges, n)
+		}
+	}
+	if _, err := regexp.Compile(cfg.ProductionTarget); err != nil {
+		return config{}, fmt.Errorf("invalid -production-target-pattern: %w", err)
+	}
+	cfg.Masks = masks
+	cfg.EnumMaps = enumMaps
+	parents, err := parsePartitionParents(partitionParents)
+	if err != nil {
+		return config{}, err
+	}
+	cfg.PartitionParents = parents
+	if cfg.PreSnapshotSQL, err = loadHookSQL(cfg.PreSnapshotSQL); err != nil {
+		return config{}, fmt.Errorf("could not read -pre-snapshot-sql: %w", err)
+	}
+	if cfg.PostSnapshotSQL, err = loadHookSQL(cfg.PostSnapshotSQL); err != nil {
+		return config{}, fmt.Errorf("could not read -post-snapshot-sql: %w", err)
+	}
+	cfg.TargetSettings = targetSettings
+	if searchPath != "" {
+		cfg.TargetSettings = append(cfg.TargetSettings, "search_path="+searchPath)
+	}
+	if replicationRole != "" {
+		cfg.TargetSettings = append(cfg.TargetSettings, "session_replication_role="+replicationRole)
+	}
+	if statementTimeout > 0 {
+		cfg.TargetSettings = append(cfg.TargetSettings, fmt.Sprintf("statement_timeout=%d", statementTimeout.Milliseconds()))
+	}
+	if lockTimeout > 0 {
+		cfg.TargetSettings = append(cfg.TargetSettings, fmt.Sprintf("lock_timeout=%d", lockTimeout.Milliseconds()))
+	}
+	if err := cfg.check(); err != nil {
+		return config{}, err
+	}
+	targets := append([]string{cfg.TargetDSN}, cfg.ShardDSNs...)
+	if cfg.TargetReadDSN != "" { // otherwise reads go to -target-dsn
+		targets = append(targets, cfg.TargetReadDSN)
+	}
+	for _, dsn := range targets {
+		if err := cfg.checkTargetDSN(dsn); err != nil {
+			return config{}, err
+		}
+	}
+	if len(cfg.SourceDSNs) == 0 {
+		cfg.SourceDSNs = []string{"host=localhost port=5429 user=postgres password=postgres dbname=testdb sslmode=disable"}
+	}
+	dsns := cfg.SourceDSNs
+	cfg.SourceDSNs, cfg.SourceIDs = make([]string, len(dsns)), make([]int, len(dsns))
+	for i, dsn := range dsns {
+		cfg.SourceIDs[i], cfg.SourceDSNs[i] = parseSourceDSN(dsn)
+	}
+	if err := checkSourceIDs(cfg.SourceIDs); err != nil {
+		return config{}, fmt.Errorf("invalid fan-in: %w", err)
+	}
+	return cfg, nil
+}
+
+// options are the settings taking part in conflicts and requirements, by the
+// name used in their errors.
+var options = map[string]func(cfg config) bool{
+	"fan-in":                      func(cfg config) bool { return len(cfg.SourceDSNs) > 1 },
+	"several -target-dsn":         func(cfg config) bool { return len(cfg.ShardDSNs) > 0 },
+	"-target-read-dsn":            func(cfg config) bool { return cfg.TargetReadDSN != "" },
+	"-secrets-file":               func(cfg config) bool { return cfg.SecretsFile != "" },
+	"-shard-by-column":            func(cfg config) bool { return cfg.ShardByColumn != "" },
+	"-shard-ranges":               func(cfg config) bool { return len(cfg.ShardRanges) > 0 },
+	"-shard-mapping range":        func(cfg config) bool { return cfg.ShardMapping == "range" },
+	"-temporary-slot":             func(cfg config) bool { return cfg.TemporarySlot },
+	"-attach-slot":                func(cfg config) bool { return cfg.AttachSlot },
+	"-drop-slot-on-clean-exit":    func(cfg config) bool { return cfg.DropSlotOnExit },
+	"-snapshot-only":              func(cfg config) bool { return cfg.SnapshotOnly },
+	"-cdc-only":                   func(cfg config) bool { return cfg.CDCOnly },
+	"-no-snapshot":                func(cfg config) bool { return cfg.NoSnapshot },
+	"-resync-table":               func(cfg config) bool { return cfg.ResyncTable != "" },
+	"-bootstrap-dump":             func(cfg config) bool { return cfg.BootstrapDump != "" },
+	"-bootstrap-lsn":              func(cfg config) bool { return cfg.BootstrapLSN != "" },
+	"-max-snapshot-rows":          func(cfg config) bool { return cfg.MaxSnapshotRows > 0 },
+	"-snapshot-workers":           func(cfg config) bool { return cfg.SnapshotWorkers > 1 },
+	"-snapshot-sample-percent":    func(cfg config) bool { return cfg.SnapshotSamplePercent > 0 },
+	"-pre-snapshot-sql":           func(cfg config) bool { return cfg.PreSnapshotSQL != "" },
+	"-post-snapshot-sql":          func(cfg config) bool { return cfg.PostSnapshotSQL != "" },
+	"-target-none":                func(cfg config) bool { return cfg.TargetNone },
+	"-peek":                       func(cfg config) bool { return cfg.Peek },
+	"-poll-limit":                 func(cfg config) bool { return cfg.PollLimit > 0 },
+	"-format-version 1":           func(cfg config) bool { return cfg.FormatVersion == 1 },
+	"-row-as-jsonb":               func(cfg config) bool { return cfg.RowAsJSONB },
+	"-append-only":                func(cfg config) bool { return cfg.AppendOnly },
+	"-apply-mode merge":           func(cfg config) bool { return cfg.ApplyMode == "merge" },
+	"-apply-ordering relaxed":     func(cfg config) bool { return cfg.ApplyOrdering == "relaxed" },
+	"-insert-conflict do-nothing": func(cfg config) bool { return cfg.InsertConflict == "do-nothing" },
+	"-created-at target-now":      func(cfg config) bool { return cfg.CreatedAt == "target-now" },
+	"-target-key other than id":   func(cfg config) bool { return cfg.TargetKey != "id" },
+	"-no-update-columns":          func(cfg config) bool { return len(cfg.NoUpdateColumns) > 0 },
+	"-annotate":                   func(cfg config) bool { return cfg.Annotate },
+	"-soft-delete":                func(cfg config) bool { return cfg.SoftDelete != "" },
+	"-check-column-types":         func(cfg config) bool { return cfg.CheckColumnTypes },
+	"-unwatched-updates apply":    func(cfg config) bool { return cfg.UnwatchedUpdates == "apply" && len(cfg.WatchColumns) > 0 },
+	"-strict":                     func(cfg config) bool { return cfg.Strict },
+	"-breaker-failures":           func(cfg config) bool { return cfg.BreakerFailures > 0 },
+	"-max-lag-exit":               func(cfg config) bool { return cfg.MaxLagExit != "" },
+	"-sink":                       func(cfg config) bool { return cfg.Sink != "" },
+	"-sink nats":                  func(cfg config) bool { return cfg.Sink == "nats" },
+	"-sink-txn-markers":           func(cfg config) bool { return cfg.SinkTxnMarkers },
+	"-dedupe-window":              func(cfg config) bool { return cfg.DedupeWindow > 0 },
+	"-dedupe-window-file":         func(cfg config) bool { return cfg.DedupeWindowFile != "" },
+	"-seen-changes":               func(cfg config) bool { return cfg.SeenChanges > 0 },
+	"-seen-changes-file":          func(cfg config) bool { return cfg.SeenChangesFile != "" },
+	"-reconcile":                  func(cfg config) bool { return cfg.Reconcile },
+	"-verify":                     func(cfg config) bool { return cfg.Verify },
+	"-compare-schemas":            func(cfg config) bool { return cfg.CompareSchemas },
+	"-self-test":                  func(cfg config) bool { return cfg.SelfTest },
+	"-target-readonly-guard":      func(cfg config) bool { return cfg.TargetReadonlyGuard != "" },
+}
+
+// conflicts lists the options each option cannot be combined with, and why
+// where that is not obvious.
+var conflicts = []struct {
+	option string
+	with   []string
+	why    string
+}{
+	{"-snapshot-only", []string{"-cdc-only"}, ""},
+	{"-no-snapshot", []string{"-snapshot-only", "-cdc-only"}, ""},
+	{"-temporary-slot", []string{"-snapshot-only", "-cdc-only"}, "the slot does not outlive the run"},
+	{"-attach-slot", []string{"-snapshot-only", "-cdc-only", "-no-snapshot", "-temporary-slot"}, ""},
+	{"-drop-slot-on-clean-exit", []string{"-temporary-slot", "-attach-slot", "-snapshot-only", "-target-none"}, ""},
+	{"-resync-table", []string{"-cdc-only", "-no-snapshot", "-temporary-slot", "-target-none"}, ""},
+	{"-bootstrap-dump", []string{"-cdc-only", "-no-snapshot", "-resync-table", "-temporary-slot", "-target-none", "-row-as-jsonb", "-append-only", "fan-in"}, ""},
+	{"-snapshot-workers", []string{"-snapshot-sample-percent"}, ""},
+	{"several -target-dsn", []string{"fan-in", "-target-none", "-target-read-dsn", "-secrets-file", "-bootstrap-dump", "-reconcile", "-verify", "-compare-schemas", "-self-test", "-sink-txn-markers", "-target-readonly-guard", "-pre-snapshot-sql", "-post-snapshot-sql"}, ""},
+	{"-row-as-jsonb", []string{"-apply-mode merge", "fan-in"}, ""},
+	{"-append-only", []string{"-row-as-jsonb", "-apply-mode merge", "fan-in"}, ""},
+	{"-created-at target-now", []string{"-row-as-jsonb", "-append-only"}, ""},
+	{"-insert-conflict do-nothing", []string{"-apply-mode merge", "-append-only"}, ""},
+	{"-target-key other than id", []string{"-row-as-jsonb", "-append-only", "fan-in"}, ""},
+	{"-no-update-columns", []string{"-row-as-jsonb", "-append-only", "fan-in"}, ""},
+	{"-apply-ordering relaxed", []string{"-append-only", "-strict", "-sink", "-target-key other than id"}, "they depend on source order across rows"},
+	{"-annotate", []string{"-row-as-jsonb", "fan-in"}, ""},
+	{"-annotate", []string{"-append-only"}, "it records source_lsn already"},
+	{"-soft-delete", []string{"-row-as-jsonb", "-append-only", "fan-in"}, ""},
+	{"-check-column-types", []string{"-row-as-jsonb"}, "its target has no per-column types"},
+	{"-self-test", []string{"-row-as-jsonb", "-append-only", "-target-none", "fan-in"}, ""},
+	{"-verify", []string{"-row-as-jsonb", "-append-only", "-target-none", "fan-in"}, ""},
+	{"-compare-schemas", []string{"-row-as-jsonb", "-append-only", "-target-none", "fan-in"}, ""},
+	{"-format-version 1", []string{"-strict", "-sink-txn-markers", "-dedupe-window", "-sink nats", "-breaker-failures"}, "they need a row per change or transaction boundaries"},
+	{"-peek", []string{"-poll-limit"}, ""},
+	{"-strict", []string{"-target-none", "-peek"}, ""},
+	{"-breaker-failures", []string{"-target-none", "-peek"}, ""},
+	{"-max-lag-exit", []string{"-target-none"}, ""},
+}
+
+// requirements lists options that only work together with another.
+var requirements = []struct{ option, needs string }{
+	{"-bootstrap-dump", "-bootstrap-lsn"},
+	{"-bootstrap-lsn", "-bootstrap-dump"},
+	{"-shard-by-column", "several -target-dsn"},
+	{"-shard-ranges", "-shard-mapping range"},
+	{"-peek", "-target-none"},
+	{"-unwatched-updates apply", "-sink"},
+	{"-sink-txn-markers", "-sink"},
+	{"-dedupe-window", "-sink"},
+	{"-dedupe-window-file", "-dedupe-window"},
+	{"-seen-changes-file", "-seen-changes"},
+}
+
+// check reports the first problem with cfg's flag values: a value out of
+// range or not among a flag's choices, or options in conflict or missing an
+// option they need.
+func (cfg config) check() error {
+	for _, c := range []struct {
+		flag, value string
+		want        []string
+	}{
+		{"-apply-mode", cfg.ApplyMode, []string{"upsert", "merge"}},
+		{"-apply-ordering", cfg.ApplyOrdering, []string{"strict", "relaxed"}},
+		{"-created-at", cfg.CreatedAt, []string{"source", "target-now"}},
+		{"-target-key", cfg.TargetKey, keyColumns},
+		{"-unwatched-updates", cfg.UnwatchedUpdates, []string{"skip", "apply"}},
+		{"-replica-identity-check", cfg.ReplicaIdentityCheck, []string{"warn", "error", "off"}},
+		{"-on-unsupported-type", cfg.OnUnsupportedType, []string{"raw-text", "skip-column", "fail"}},
+		{"-shard-mapping", cfg.ShardMapping, []string{"modulo", "range"}},
+		{"-append-updates", cfg.AppendUpdates, []string{"ignore", "error", "tombstone"}},
+		{"-snapshot-over-limit", cfg.SnapshotOverLimit, []string{"abort", "cdc-only"}},
+		{"-output-format", cfg.OutputFormat, []string{"table", "json", "csv"}},
+		{"-checksum-algorithm", cfg.ChecksumAlgorithm, sortedKeys(checksumAlgorithms)},
+		// These three are unset by default.
+		{"-apply-isolation", cfg.ApplyIsolation, append([]string{""}, sortedKeys(isolationLevels)...)},
+		{"-insert-conflict", cfg.InsertConflict, []string{"", "do-update", "do-nothing"}},
+		{"-target-readonly-guard", cfg.TargetReadonlyGuard, []string{"", "warn", "halt"}},
+	} {
+		if !slices.Contains(c.want, c.value) {
+			return fmt.Errorf("invalid %s %q, want %s", c.flag, c.value, orList(slices.DeleteFunc(slices.Clone(c.want), func(s string) bool { return s == "" })))
+		}
+	}
+	if cfg.FormatVersion != 1 && cfg.FormatVersion != 2 {
+		return fmt.Errorf("invalid -format-version %d, want 1 or 2", cfg.FormatVersion)
+	}
+	if cfg.TCPKeepAlive < 0 {
+		return errors.New("-tcp-keepalive must not be negative")
+	}
+	if cfg.PoolHealthCheck <= 0 {
+		return errors.New("-pool-health-check must be positive")
+	}
+	if cfg.ApplyWorkers < 1 {
+		return errors.New("-apply-workers must be at least 1")
+	}
+	if cfg.SnapshotWorkers < 1 {
+		return errors.New("-snapshot-workers must be at least 1")
+	}
+	if cfg.CursorFetchSize < 0 {
+		return errors.New("-cursor-fetch-size cannot be negative")
+	}
+	if cfg.SnapshotSamplePercent < 0 || cfg.SnapshotSamplePercent > 100 {
+		return errors.New("-snapshot-sample-percent must be between 0 and 100")
+	}
+	if cfg.MinPoll <= 0 || cfg.MaxPoll < cfg.MinPoll {
+		return errors.New("-min-poll must be positive and no larger than -max-poll")
+	}
+	if cfg.SelfTest && cfg.SelfTestRows < 1 {
+		return errors.New("-self-test-rows must be at least 1")
+	}
+	for _, col := range cfg.NoUpdateColumns {
+		if !slices.Contains(keyColumns, col) || col == cfg.TargetKey {
+			return fmt.Errorf("invalid -no-update-columns entry %q, want one of %s other than the -target-key", col, strings.Join(keyColumns, ", "))
+		}
+	}
+	if len(cfg.NoUpdateColumns) > 0 {
+		updated := slices.DeleteFunc(slices.Clone(keyColumns), func(col string) bool {
+			return col == cfg.TargetKey || slices.Contains(cfg.NoUpdateColumns, col)
+		})
+		if len(updated) == 0 {
+			return errors.New("-no-update-columns must leave at least one column to update")
+		}
+	}
+	for _, col := range cfg.WatchColumns {
+		if !slices.Contains(keyColumns, col) {
+			return fmt.Errorf("invalid -watch-columns entry %q, want one of %s", col, strings.Join(keyColumns, ", "))
+		}
+	}
+	if cfg.SoftDelete != "" {
+		if err := pgutil.CheckIdentifier("-soft-delete column", cfg.SoftDelete); err != nil {
+			return err
+		}
+		if slices.Contains(keyColumns, cfg.SoftDelete) || cfg.SoftDelete == "created_at" || slices.Contains(annotationColumns, cfg.SoftDelete) {
+			return fmt.Errorf("invalid -soft-delete %q: it is already a column of the target", cfg.SoftDelete)
+		}
+	}
+	if cfg.ResyncTable != "" && cfg.ResyncTable != "person" {
+		return fmt.Errorf("invalid -resync-table %q: the target holds only the replicated table person", cfg.ResyncTable)
+	}
+	if cfg.BootstrapLSN != "" && parseLSN(cfg.BootstrapLSN) == 0 {
+		return fmt.Errorf("invalid -bootstrap-lsn %q, want an LSN such as 0/16B3748", cfg.BootstrapLSN)
+	}
+	if len(cfg.ShardDSNs) > 0 && !slices.Contains(keyColumns, cfg.ShardByColumn) {
+		return fmt.Errorf("several -target-dsn need -shard-by-column, one of %s", strings.Join(keyColumns, ", "))
+	}
+	if cfg.ShardMapping == "range" {
+		if cfg.ShardByColumn == "name" || cfg.ShardByColumn == "uid" {
+			return errors.New("-shard-mapping range needs an integer -shard-by-column, id or score")
+		}
+		if len(cfg.ShardDSNs) > 0 && len(cfg.ShardRanges) != len(cfg.ShardDSNs) {
+			return fmt.Errorf("-shard-mapping range needs %d -shard-ranges bounds for %d targets", len(cfg.ShardDSNs), len(cfg.ShardDSNs)+1)
+		}
+	}
+	if cfg.MaxLagExit != "" {
+		if _, _, err := parseMaxLag(cfg.MaxLagExit); err != nil {
+			return err
+		}
+	}
+	if _, err := newMasker(cfg.Masks, cfg.MaskKey); err != nil {
+		return err
+	}
+	for _, setting := range cfg.TargetSettings {
+		if name, _, ok := strings.Cut(setting, "="); !ok || name == "" {
+			return fmt.Errorf("invalid -target-session %q, want name=value", setting)
+		}
+	}
+	for _, c := range conflicts {
+		if !options[c.option](cfg) {
+			continue
+		}
+		var set []string
+		for _, other := range c.with {
+			if options[other](cfg) {
+				set = append(set, other)
+			}
+		}
+		if len(set) == 0 {
+			continue
+		}
+		err := fmt.Sprintf("%s cannot be combined with %s", c.option, orList(set))
+		if c.why != "" {
+			err += ": " + c.why
+		}
+		return errors.New(err)
+	}
+	for _, r := range requirements {
+		if options[r.option](cfg) && !options[r.needs](cfg) {
+			return fmt.Errorf("%s needs %s", r.option, r.needs)
+		}
+	}
+	return nil
+}
+
+// envName returns the environment variable setting the flag name.
+func envName(name string) string {
+	return "CDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// orList joins words as in "a, b or c".
+func orList(words []string) string {
+	if len(words) < 2 {
+		return strings.Join(words, "")
+	}
+	return strings.Join(words[:len(words)-1], ", ") + " or " + words[len(words)-1]
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testParseConfig parses args as the replicator's command line.
+func testParseConfig(args ...string) (config, error) {
+	fs := flag.NewFlagSet("replicator", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return parseConfig(fs, args)
+}
+
+func TestParseConfigDefaults(t *testing.T) {
+	cfg, err := testParseConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.SourceDSNs) != 1 || !strings.Contains(cfg.SourceDSNs[0], "port=5429") || !strings.Contains(cfg.TargetDSN, "port=5431") {
+		t.Errorf("source %q, target %q, want the docker-compose databases", cfg.SourceDSNs, cfg.TargetDSN)
+	}
+	if cfg.SlotName != "migration_slot" || cfg.ApplyMode != "upsert" || cfg.FormatVersion != 2 {
+		t.Errorf("slot %q, apply mode %q, format version %d, want the flag defaults", cfg.SlotName, cfg.ApplyMode, cfg.FormatVersion)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string // substring of the error; "" for none
+	}{
+		{[]string{"-apply-mode", "merge"}, ""},
+		{[]string{"-apply-mode", "replace"}, `invalid -apply-mode "replace", want upsert or merge`},
+		{[]string{"-apply-isolation", "serializable"}, ""},
+		{[]string{"-apply-isolation", "snapshot"}, "want read-committed, repeatable-read or serializable"},
+		{[]string{"-insert-conflict", "do-nothing"}, ""},
+		{[]string{"-format-version", "3"}, "invalid -format-version 3"},
+		{[]string{"-quiet", "-vv"}, "-quiet cannot be combined with -verbose or -vv"},
+		{[]string{"-snapshot-only", "-cdc-only"}, "-snapshot-only cannot be combined with -cdc-only"},
+		{[]string{"-temporary-slot", "-cdc-only"}, "-temporary-slot cannot be combined with -cdc-only: the slot does not outlive the run"},
+		{[]string{"-row-as-jsonb", "-apply-mode", "merge"}, "-row-as-jsonb cannot be combined with -apply-mode merge"},
+		{[]string{"-source-dsn", "1=host=a", "-source-dsn", "2=host=b", "-row-as-jsonb"}, "-row-as-jsonb cannot be combined with fan-in"},
+		{[]string{"-source-dsn", "1=host=a", "-source-dsn", "2=host=b"}, ""},
+		{[]string{"-source-dsn", "host=a", "-source-dsn", "host=b"}, "invalid fan-in"},
+		{[]string{"-append-only", "-row-as-jsonb", "-apply-mode", "merge"}, "-row-as-jsonb cannot be combined with -apply-mode merge"},
+		{[]string{"-annotate", "-append-only"}, "-annotate cannot be combined with -append-only: it records source_lsn already"},
+		{[]string{"-apply-ordering", "relaxed", "-strict", "-target-key", "uid"}, "-apply-ordering relaxed cannot be combined with -strict or -target-key other than id"},
+		{[]string{"-format-version", "1", "-strict"}, "-format-version 1 cannot be combined with -strict"},
+		{[]string{"-peek"}, "-peek needs -target-none"},
+		{[]string{"-peek", "-target-none"}, ""},
+		{[]string{"-peek", "-target-none", "-poll-limit", "10"}, "-peek cannot be combined with -poll-limit"},
+		{[]string{"-dedupe-window", "10"}, "-dedupe-window needs -sink"},
+		{[]string{"-bootstrap-lsn", "0/10"}, "-bootstrap-lsn needs -bootstrap-dump"},
+		{[]string{"-watch-columns", "score", "-unwatched-updates", "apply"}, "-unwatched-updates apply needs -sink"},
+		{[]string{"-unwatched-updates", "apply"}, ""},
+		{[]string{"-target-dsn", "host=a", "-target-dsn", "host=b"}, "several -target-dsn need -shard-by-column"},
+		{[]string{"-target-dsn", "host=a", "-target-dsn", "host=b", "-shard-by-column", "id"}, ""},
+		{[]string{"-target-dsn", "host=a", "-target-dsn", "host=b", "-shard-by-column", "id", "-verify"}, "several -target-dsn cannot be combined with -verify"},
+		{[]string{"-shard-by-column", "id"}, "-shard-by-column needs several -target-dsn"},
+		{[]string{"-shard-ranges", "10"}, "-shard-ranges needs -shard-mapping range"},
+		{[]string{"-shard-ranges", "10,5"}, "-shard-ranges must be ascending"},
+		{[]string{"-target-session", "nonsense"}, `invalid -target-session "nonsense"`},
+		{[]string{"-max-lag-exit", "1073741824", "-target-none"}, "-max-lag-exit cannot be combined with -target-none"},
+		{[]string{"-mask", "name=hash"}, "-mask name=hash needs -mask-key"},
+		{[]string{"-mask", "name=hash", "-mask-key", "0102"}, ""},
+		{[]string{"-slot-name", "orders_slot"}, ""},
+		{[]string{"-slot-name", "Orders-Slot"}, `slot name "Orders-Slot" must be lower case letters`},
+		{[]string{"-name-prefix", "tenant_a", "-slot-name", strings.Repeat("s", 60)}, "is longer than 63 bytes"},
+		{[]string{"-no-update-columns", "uid,score"}, ""},
+		{[]string{"-no-update-columns", "created_at"}, `invalid -no-update-columns entry "created_at"`},
+		{[]string{"-no-update-columns", "id"}, `invalid -no-update-columns entry "id"`},
+		{[]string{"-no-update-columns", "name,uid,score"}, "-no-update-columns must leave at least one column to update"},
+		{[]string{"-no-update-columns", "score", "-append-only"}, "-no-update-columns cannot be combined with -append-only"},
+		{[]string{"-soft-delete", "deleted_at"}, ""},
+		{[]string{"-soft-delete", "score"}, `invalid -soft-delete "score": it is already a column of the target`},
+		{[]string{"-soft-delete", "_src_lsn"}, `invalid -soft-delete "_src_lsn": it is already a column of the target`},
+		{[]string{"-soft-delete", "Deleted At"}, "must be lower case letters"},
+		{[]string{"-snapshot-workers", "4"}, ""},
+		{[]string{"-snapshot-workers", "0"}, "-snapshot-workers must be at least 1"},
+		{[]string{"-snapshot-workers", "4", "-snapshot-sample-percent", "10"}, "-snapshot-workers cannot be combined with -snapshot-sample-percent"},
+		{[]string{"-no-such-flag"}, "flag provided but not defined"},
+	}
+	for _, tt := range tests {
+		_, err := testParseConfig(tt.args...)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%q: %v", tt.args, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%q: error %v, want %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+func TestApplicationNameFlag(t *testing.T) {
+	cfg, err := testParseConfig("-slot-name", "orders_slot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(cfg.ApplicationName, "cdc-replicator/orders_slot/") {
+		t.Errorf("default application name %q, want cdc-replicator/orders_slot/<hostname>", cfg.ApplicationName)
+	}
+	if cfg, err = testParseConfig("-application-name", "migration-eu"); err != nil || cfg.ApplicationName != "migration-eu" {
+		t.Errorf("application name %q, %v, want migration-eu", cfg.ApplicationName, err)
+	}
+}
+
+func TestTargetTimeoutSettings(t *testing.T) {
+	cfg, err := testParseConfig("-target-statement-timeout", "30s", "-target-lock-timeout", "250ms", "-target-session", "work_mem=64MB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"work_mem=64MB", "statement_timeout=30000", "lock_timeout=250"}
+	if strings.Join(cfg.TargetSettings, " ") != strings.Join(want, " ") {
+		t.Errorf("target settings %q, want %q", cfg.TargetSettings, want)
+	}
+	if cfg, err = testParseConfig(); err != nil || len(cfg.TargetSettings) != 0 {
+		t.Errorf("default target settings %q, %v, want none", cfg.TargetSettings, err)
+	}
+}
+
+func TestConflictsAndRequirementsNameOptions(t *testing.T) {
+	known := func(name string) {
+		t.Helper()
+		if options[name] == nil {
+			t.Errorf("%q is not in options", name)
+		}
+	}
+	for _, c := range conflicts {
+		known(c.option)
+		for _, other := range c.with {
+			known(other)
+		}
+	}
+	for _, r := range requirements {
+		known(r.option)
+		known(r.needs)
+	}
+}
+
+func TestOrList(t *testing.T) {
+	tests := []struct {
+		words []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"a"}, "a"},
+		{[]string{"a", "b"}, "a or b"},
+		{[]string{"a", "b", "c"}, "a, b or c"},
+	}
+	for _, tt := range tests {
+		if got := orList(tt.words); got != tt.want {
+			t.Errorf("orList(%q) = %q, want %q", tt.words, got, tt.want)
+		}
+	}
+}
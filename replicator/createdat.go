@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// insertValuesRE matches the column and value lists of an INSERT, with any
+// OVERRIDING clause in between.
+var insertValuesRE = regexp.MustCompile(`\(([^()]*)\)(\s*(?:OVERRIDING SYSTEM VALUE\s*)?VALUES\s*)\(([^()]*)\)`)
+
+// withTargetCreatedAt makes the snapshot and CDC inserts of stmts fall back to
+// def, the target's default for created_at, when they are given a NULL
+// created_at, as they are with -created-at target-now. The parameter stays in
+// place, so the arguments keep their positions. Without a default, the NULL is
+// written as is.
+func withTargetCreatedAt(stmts statements, def string) statements {
+	if def == "" {
+		return stmts
+	}
+	rewrite := func(sql string) string {
+		return insertValuesRE.ReplaceAllStringFunc(sql, func(m string) string {
+			parts := insertValuesRE.FindStringSubmatch(m)
+			cols, values := strings.Split(parts[1], ","), strings.Split(parts[3], ",")
+			for i, col := range cols {
+				if strings.TrimSpace(col) == "created_at" && i < len(values) {
+					values[i] = " COALESCE(" + strings.TrimSpace(values[i]) + ", " + def + ")"
+				}
+			}
+			return "(" + parts[1] + ")" + parts[2] + "(" + strings.TrimPrefix(strings.Join(values, ","), " ") + ")"
+		})
+	}
+	stmts.snapshotInsert = rewrite(stmts.snapshotInsert)
+	stmts.insert = rewrite(stmts.insert)
+	stmts.merge = rewrite(stmts.merge)
+	return stmts
+}
+
+// columnDefault returns the default expression of a column of the target
+// person table, or "" if it has none.
+func columnDefault(ctx context.Context, pool *pgxpool.Pool, column string) (string, error) {
+	var def string
+	err := pool.QueryRow(ctx, `
+		SELECT COALESCE(pg_get_expr(d.adbin, d.adrelid), '')
+		FROM pg_attribute a
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE a.attrelid = 'person'::regclass AND a.attname = $1`, column).Scan(&def)
+	return def, err
+}
+
+// createdAt returns the created_at value written for a row: the source's, or
+// NULL with -created-at target-now, for the target's default to apply.
+func (r *replicator) createdAt(v any) any {
+	if r.cfg.CreatedAt == "target-now" {
+		return nil
+	}
+	return v
+}
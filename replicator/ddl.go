@@ -0,0 +1,53 @@
+package main
+
+import "strings"
+
+// targetDDL returns the DDL the replicator runs on the target for cfg, for
+// -print-ddl: the person table in the shape the flags ask for, with its
+// primary key or -target-key constraint, the progress table, with fan-in the
+// sources table and, with -target-readonly-guard, the write guard. Every
+// statement is idempotent, as the replicator itself runs them on each start.
+func targetDDL(cfg config, fanIn bool) string {
+	// The flags append statements to createTable, indented differently
+	var chunks []string
+	for _, stmt := range strings.SplitAfter(statementsFor(cfg, fanIn).createTable, ";") {
+		if strings.TrimSpace(stmt) != "" {
+			chunks = append(chunks, stmt)
+		}
+	}
+	chunks = append(chunks, createProgressTableSQL(cfg.progressTable()))
+	if fanIn {
+		chunks = append(chunks, createSourcesTableSQL(cfg.sourcesTable()))
+	}
+	if cfg.TargetReadonlyGuard != "" {
+		chunks = append(chunks, createForeignWritesSQL, foreignWriteTriggerSQL(cfg.ApplicationName))
+	}
+	var b strings.Builder
+	for _, chunk := range chunks {
+		b.WriteString(dedent(chunk))
+		b.WriteString("\n\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// dedent removes the indentation that SQL embedded in Go source shares,
+// along with leading and trailing blank lines.
+func dedent(sql string) string {
+	lines := strings.Split(strings.Trim(sql, "\n"), "\n")
+	indent := -1
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		n := len(line) - len(strings.TrimLeft(line, "\t"))
+		if indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	for i, line := range lines {
+		if len(line) >= indent {
+			lines[i] = line[max(indent, 0):]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
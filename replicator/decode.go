@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// decodeValue converts a wal2json column value into a Go value to bind on the
+// target, based on the column type reported by wal2json. Values it cannot
+// convert are bound as they are; this includes enum labels, which are bound
+// as strings so the target can cast them to its own enum type, and range
+// values such as int4range or tstzrange, whose literals the target parses
+// itself.
+func decodeValue(col WAL2JSONColumn) any {
+	s, ok := col.Value.(string)
+	if !ok {
+		return col.Value // numbers, JSON booleans and nulls
+	}
+	switch {
+	case col.Type == "boolean" || col.Type == "bool":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			log.Printf("Warning: binding %s column %s as text: %v", col.Type, col.Name, err)
+			return s
+		}
+		return b
+	case strings.HasPrefix(col.Type, "timestamp"), col.Type == "date":
+		t, err := parseTimestamp(s)
+		if err != nil {
+			log.Printf("Warning: binding %s column %s as text: %v", col.Type, col.Name, err)
+			return s
+		}
+		return t
+	case col.Type == "hstore":
+		var h pgtype.Hstore
+		if err := h.Scan(s); err != nil {
+			log.Printf("Warning: binding %s column %s as text: %v", col.Type, col.Name, err)
+			return s
+		}
+		return h
+	}
+	return s
+}
+
+// timestampLayouts are the formats Postgres uses to output timestamp,
+// timestamptz and date values under the various DateStyle settings, most
+// common (ISO) first. DateStyle SQL is left out: whether its 03/04/2024 is
+// March or April depends on the server's field order, which the value does
+// not show, so it is bound as text for the target to parse instead.
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999-07:00:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+	"Mon Jan 02 15:04:05.999999999 2006 MST", // DateStyle Postgres
+	"Mon Jan 02 15:04:05.999999999 2006",
+	"02.01.2006 15:04:05.999999999 MST", // DateStyle German
+	"02.01.2006 15:04:05.999999999",
+}
+
+// parseTimestamp parses a timestamp as printed by Postgres. Special values
+// such as "infinity" and BC dates are not parsed; they are best bound as text.
+func parseTimestamp(s string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised timestamp %q", s)
+}
+
+// parseEnumMaps parses -enum-map specs of the form column=from:to into a
+// map from column to source label to target label.
+func parseEnumMaps(specs []string) (map[string]map[string]string, error) {
+	labels := make(map[string]map[string]string)
+	for _, spec := range specs {
+		column, mapping, ok := strings.Cut(spec, "=")
+		from, to, ok2 := strings.Cut(mapping, ":")
+		if !ok || !ok2 || column == "" || from == "" {
+			return nil, fmt.Errorf("invalid enum map %q, want column=from:to", spec)
+		}
+		if labels[column] == nil {
+			labels[column] = make(map[string]string)
+		}
+		labels[column][from] = to
+	}
+	return labels, nil
+}
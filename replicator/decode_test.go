@@ -0,0 +1,183 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	at := func(offset int) time.Time {
+		return time.Date(2024, 3, 5, 14, 30, 15, 123456000, time.FixedZone("", offset))
+	}
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		// DateStyle ISO, as timestamptz in whole-hour, half-hour and
+		// historical zones, and as timestamp and date
+		{"2024-03-05 14:30:15.123456+01", at(3600)},
+		{"2024-03-05 14:30:15.123456-08", at(-8 * 3600)},
+		{"2024-03-05 14:30:15.123456+05:30", at(5*3600 + 30*60)},
+		{"2024-03-05 14:30:15.123456+00:53:28", at(53*60 + 28)},
+		{"2024-03-05 14:30:15.123456", at(0)},
+		{"2024-03-05 14:30:15+00", time.Date(2024, 3, 5, 14, 30, 15, 0, time.UTC)},
+		{"2024-03-05", time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)},
+		// RFC 3339, as JSON output writes it
+		{"2024-03-05T14:30:15.123456Z", at(0)},
+		{"2024-03-05T14:30:15.123456+05:30", at(5*3600 + 30*60)},
+		{"2024-03-05T14:30:15.123456", at(0)},
+		// DateStyle Postgres and German, with and without a zone
+		{"Tue Mar 05 14:30:15.123456 2024 UTC", at(0)},
+		{"Tue Mar 05 14:30:15.123456 2024", at(0)},
+		{"05.03.2024 14:30:15.123456 UTC", at(0)},
+		{"05.03.2024 14:30:15.123456", at(0)},
+	}
+	for _, tt := range tests {
+		got, err := parseTimestamp(tt.in)
+		if err != nil {
+			t.Errorf("parseTimestamp(%q): %v", tt.in, err)
+			continue
+		}
+		_, gotOffset := got.Zone()
+		_, wantOffset := tt.want.Zone()
+		if !got.Equal(tt.want) || gotOffset != wantOffset {
+			t.Errorf("parseTimestamp(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseTimestampErrors(t *testing.T) {
+	for _, in := range []string{
+		"03/05/2024 14:30:15.123456 UTC", // DateStyle SQL: March 5 or May 3
+		"03/05/2024 14:30:15.123456",
+		"infinity",
+		"-infinity",
+		"2024-03-05 14:30:15 BC",
+		"",
+	} {
+		if got, err := parseTimestamp(in); err == nil {
+			t.Errorf("parseTimestamp(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestDecodeTimestampColumns(t *testing.T) {
+	for _, typ := range []string{"timestamp without time zone", "timestamp with time zone", "date"} {
+		if _, ok := decodeValue(WAL2JSONColumn{Name: "at", Type: typ, Value: "2024-03-05"}).(time.Time); !ok {
+			t.Errorf("%s not decoded to a time", typ)
+		}
+	}
+	if got := decodeValue(WAL2JSONColumn{Name: "at", Type: "timestamp with time zone", Value: "infinity"}); got != "infinity" {
+		t.Errorf("infinity decoded to %#v, want it bound as text", got)
+	}
+	if got := decodeValue(WAL2JSONColumn{Name: "at", Type: "date", Value: nil}); got != nil {
+		t.Errorf("NULL decoded to %#v", got)
+	}
+}
+
+func TestDecodeBool(t *testing.T) {
+	tests := []struct {
+		typ   string
+		value any
+		want  any
+	}{
+		{"boolean", "t", true},
+		{"boolean", "f", false},
+		{"boolean", "true", true},
+		{"bool", "false", false},
+		{"boolean", true, true}, // a JSON boolean
+		{"boolean", nil, nil},
+		{"boolean", "maybe", "maybe"}, // bound as text
+		{"text", "t", "t"},
+	}
+	for _, tt := range tests {
+		if got := decodeValue(WAL2JSONColumn{Name: "active", Type: tt.typ, Value: tt.value}); got != tt.want {
+			t.Errorf("decodeValue(%s %#v) = %#v, want %#v", tt.typ, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseEnumMaps(t *testing.T) {
+	labels, err := parseEnumMaps([]string{"mood=happy:glad", "mood=sad:blue", "size=s:small"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labels["mood"]["happy"] != "glad" || labels["mood"]["sad"] != "blue" || labels["size"]["s"] != "small" || len(labels) != 2 {
+		t.Errorf("parseEnumMaps = %v", labels)
+	}
+	for _, spec := range []string{"mood", "mood=happy", "=happy:glad", "mood=:glad"} {
+		if _, err := parseEnumMaps([]string{spec}); err == nil {
+			t.Errorf("parseEnumMaps(%q): no error", spec)
+		}
+	}
+}
+
+func TestValuesRemapsEnumLabels(t *testing.T) {
+	labels, err := parseEnumMaps([]string{"mood=happy:glad"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &replicator{enumLabels: labels}
+	got := r.values([]WAL2JSONColumn{
+		{Name: "mood", Type: "mood", Value: "happy"},
+		{Name: "name", Type: "text", Value: "happy"},
+	})
+	if got["mood"] != "glad" || got["name"] != "happy" {
+		t.Errorf("values = %v, want only the mood label renamed", got)
+	}
+	got = r.values([]WAL2JSONColumn{{Name: "mood", Type: "mood", Value: "sad"}, {Name: "id", Type: "integer", Value: 1.0}})
+	if got["mood"] != "sad" || got["id"] != 1.0 {
+		t.Errorf("values = %v, want unmapped labels and other columns kept", got)
+	}
+	if got := r.values([]WAL2JSONColumn{{Name: "mood", Type: "mood", Value: nil}}); got["mood"] != nil {
+		t.Errorf("NULL mood remapped to %#v", got["mood"])
+	}
+}
+
+func TestDecodeHstore(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		in   string
+		want pgtype.Hstore
+	}{
+		{``, pgtype.Hstore{}},
+		{`"a"=>"1"`, pgtype.Hstore{"a": str("1")}},
+		{`"a"=>"1", "b"=>NULL`, pgtype.Hstore{"a": str("1"), "b": nil}},
+		{`"key with spaces"=>"va\"l\\ue", "empty"=>""`, pgtype.Hstore{"key with spaces": str(`va"l\ue`), "empty": str("")}},
+		{`"null"=>"NULL"`, pgtype.Hstore{"null": str("NULL")}},
+	}
+	for _, tt := range tests {
+		got, ok := decodeValue(WAL2JSONColumn{Name: "tags", Type: "hstore", Value: tt.in}).(pgtype.Hstore)
+		if !ok {
+			t.Errorf("%s not decoded to an hstore", tt.in)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s decoded to %d keys, want %d", tt.in, len(got), len(tt.want))
+		}
+		for key, want := range tt.want {
+			v, ok := got[key]
+			switch {
+			case !ok:
+				t.Errorf("%s: no key %q", tt.in, key)
+			case (v == nil) != (want == nil) || v != nil && *v != *want:
+				t.Errorf("%s: %q decoded to %v, want %v", tt.in, key, deref(v), deref(want))
+			}
+		}
+	}
+	for _, in := range []string{`"a"=>`, `"a" "1"`, `a=>"1`} {
+		if got := decodeValue(WAL2JSONColumn{Name: "tags", Type: "hstore", Value: in}); got != in {
+			t.Errorf("invalid hstore %s decoded to %#v, want it bound as text", in, got)
+		}
+	}
+}
+
+// deref returns *s, or "NULL" if s is nil.
+func deref(s *string) string {
+	if s == nil {
+		return "NULL"
+	}
+	return *s
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const redacted = "REDACTED"
+
+// dumpConfig renders the effective configuration as indented JSON, with
+// passwords and keys redacted.
+func dumpConfig(cfg config) ([]byte, error) {
+	cfg.SourceDSNs = append([]string(nil), cfg.SourceDSNs...)
+	for i, dsn := range cfg.SourceDSNs {
+		cfg.SourceDSNs[i] = redactDSN(dsn)
+	}
+	cfg.TargetDSN = redactDSN(cfg.TargetDSN)
+	cfg.ShardDSNs = append([]string(nil), cfg.ShardDSNs...)
+	for i, dsn := range cfg.ShardDSNs {
+		cfg.ShardDSNs[i] = redactDSN(dsn)
+	}
+	cfg.TargetReadDSN = redactDSN(cfg.TargetReadDSN)
+	if cfg.MaskKey != "" {
+		cfg.MaskKey = redacted
+	}
+	// The command may well hold the password itself, as in echo.
+	if cfg.PasswordCommand != "" {
+		cfg.PasswordCommand = redacted
+	}
+
+	// Durations are shown as "5s" rather than nanoseconds, and the userinfo
+	// of any other URL, such as -nats-url's, is redacted.
+	out := make(map[string]any)
+	v := reflect.ValueOf(cfg)
+	for i := 0; i < v.NumField(); i++ {
+		switch field := v.Field(i).Interface().(type) {
+		case time.Duration:
+			out[v.Type().Field(i).Name] = field.String()
+		case string:
+			out[v.Type().Field(i).Name] = redactURL(field)
+		default:
+			out[v.Type().Field(i).Name] = field
+		}
+	}
+	return json.MarshalIndent(out, "", "  ")
+}
+
+var (
+	dsnPasswordRE = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+	urlPasswordRE = regexp.MustCompile(`(\w+://[^:/@\s]*:)[^@\s]*@`)
+)
+
+// redactDSN hides the password in a keyword/value or URL connection string,
+// or in an error that quotes one, such as pgx's parse errors.
+func redactDSN(dsn string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return redacted
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		q := u.Query()
+		if q.Has("password") {
+			q.Set("password", redacted)
+			u.RawQuery = q.Encode()
+		}
+		return u.String()
+	}
+	return urlPasswordRE.ReplaceAllString(dsnPasswordRE.ReplaceAllString(dsn, "${1}"+redacted), "${1}"+redacted+"@")
+}
+
+// redactURL hides the userinfo password of s if it is a URL. A user without
+// a password is hidden too, as it may be a token, as with NATS.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	} else {
+		u.User = url.User(redacted)
+	}
+	return u.String()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/juliaogris/postgres-cdc-example/internal/pgutil"
+)
+
+// parseSourceDSN splits a -source-dsn of the form ID=DSN into the source id
+// fan-in tags its rows with and the connection string. A DSN without such a
+// prefix, whose text before the first '=' is not all digits, has id 0.
+func parseSourceDSN(s string) (int, string) {
+	prefix, dsn, ok := strings.Cut(s, "=")
+	if !ok || prefix == "" || strings.Trim(prefix, "0123456789") != "" {
+		return 0, s
+	}
+	id, err := strconv.Atoi(prefix)
+	if err != nil {
+		return 0, s
+	}
+	return id, dsn
+}
+
+// checkSourceIDs checks that each of several sources has its own positive id,
+// as ids rather than the order of the flags identify their rows on the target.
+func checkSourceIDs(ids []int) error {
+	if len(ids) < 2 {
+		return nil
+	}
+	seen := map[int]bool{}
+	for i, id := range ids {
+		switch {
+		case id <= 0:
+			return fmt.Errorf("-source-dsn %d has no id; give every source one, as in -source-dsn '1=host=...'", i+1)
+		case seen[id]:
+			return fmt.Errorf("source id %d is used twice", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// sameSource reports whether the source database of system and database is
+// the one recorded as wantSystem and wantDatabase. An unknown system, on
+// either side, matches any.
+func sameSource(system, database, wantSystem, wantDatabase string) bool {
+	return database == wantDatabase && (system == wantSystem || system == "" || wantSystem == "")
+}
+
+// identifySource returns the system identifier and name of the database of
+// source. pg_control_system needs superuser or pg_monitor, which managed
+// services often withhold from the replication user; without them the system
+// is returned as "".
+func identifySource(ctx context.Context, source *pgxpool.Pool) (string, string, error) {
+	var system, database string
+	err := source.QueryRow(ctx, `SELECT system_identifier::text, current_database() FROM pg_control_system()`).Scan(&system, &database)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "42501" { // insufficient_privilege
+		err = source.QueryRow(ctx, `SELECT current_database()`).Scan(&database)
+	}
+	return system, database, err
+}
+
+// The sources table records which source database each fan-in source id
+// stands for, so that a restart with the ids swapped or reused is refused
+// rather than mixing up rows. It is named cdc_sources, after -name-prefix if
+// set.
+func createSourcesTableSQL(table string) string {
+	return `
+	CREATE TABLE IF NOT EXISTS ` + table + ` (
+		source_id INTEGER PRIMARY KEY,
+		system_identifier TEXT NOT NULL,
+		database TEXT NOT NULL,
+		registered_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);`
+}
+
+// sourcesTable returns the name of the sources table.
+func (cfg config) sourcesTable() string {
+	return pgutil.Prefix(cfg.NamePrefix, "cdc_sources")
+}
+
+// registerSource records the source database of id on the target, or checks
+// that it is the one recorded before.
+func registerSource(ctx context.Context, cfg config, target, source *pgxpool.Pool, id int) error {
+	system, database, err := identifySource(ctx, source)
+	if err != nil {
+		return fmt.Errorf("could not identify source %d: %w", id, err)
+	}
+	if system == "" {
+		log.Printf("Warning: Not allowed to read the system identifier of source %d; telling it apart by database name only", id)
+	}
+	_, err = target.Exec(ctx, `
+		INSERT INTO `+cfg.sourcesTable()+` (source_id, system_identifier, database)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (source_id) DO NOTHING`, id, system, database)
+	if err != nil {
+		return fmt.Errorf("could not record source %d: %w", id, err)
+	}
+	var wantSystem, wantDatabase string
+	err = target.QueryRow(ctx, `SELECT system_identifier, database FROM `+cfg.sourcesTable()+` WHERE source_id = $1`, id).Scan(&wantSystem, &wantDatabase)
+	if err != nil {
+		return fmt.Errorf("could not read source %d: %w", id, err)
+	}
+	if !sameSource(system, database, wantSystem, wantDatabase) {
+		return fmt.Errorf("source id %d is database %s of system %s, but the target holds its rows for database %s of system %s", id, database, system, wantDatabase, wantSystem)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestParseSourceDSN(t *testing.T) {
+	tests := []struct {
+		in      string
+		id      int
+		wantDSN string
+	}{
+		{"1=host=db1 dbname=testdb", 1, "host=db1 dbname=testdb"},
+		{"42=postgres://u:p@db/testdb?sslmode=disable", 42, "postgres://u:p@db/testdb?sslmode=disable"},
+		{"host=db1 dbname=testdb", 0, "host=db1 dbname=testdb"},
+		{"postgres://u:p@db/testdb?sslmode=disable", 0, "postgres://u:p@db/testdb?sslmode=disable"},
+		{"=host=db1", 0, "=host=db1"},
+		{"", 0, ""},
+	}
+	for _, tt := range tests {
+		id, dsn := parseSourceDSN(tt.in)
+		if id != tt.id || dsn != tt.wantDSN {
+			t.Errorf("parseSourceDSN(%q) = %d, %q, want %d, %q", tt.in, id, dsn, tt.id, tt.wantDSN)
+		}
+	}
+}
+
+func TestCheckSourceIDs(t *testing.T) {
+	tests := []struct {
+		ids []int
+		ok  bool
+	}{
+		{[]int{0}, true}, // a single source needs no id
+		{[]int{1, 2}, true},
+		{[]int{7, 3}, true},
+		{[]int{1, 0}, false},
+		{[]int{2, 2}, false},
+	}
+	for _, tt := range tests {
+		if err := checkSourceIDs(tt.ids); (err == nil) != tt.ok {
+			t.Errorf("checkSourceIDs(%v) = %v, want ok %v", tt.ids, err, tt.ok)
+		}
+	}
+}
+
+func TestSameSource(t *testing.T) {
+	tests := []struct {
+		system, database, wantSystem, wantDatabase string
+		want                                       bool
+	}{
+		{"7301", "db1", "7301", "db1", true},
+		{"7301", "db1", "7302", "db1", false},
+		{"7301", "db1", "7301", "db2", false},
+		{"", "db1", "7301", "db1", true},
+		{"7301", "db1", "", "db1", true},
+		{"", "db1", "", "db2", false},
+	}
+	for _, tt := range tests {
+		if got := sameSource(tt.system, tt.database, tt.wantSystem, tt.wantDatabase); got != tt.want {
+			t.Errorf("sameSource(%q, %q, %q, %q) = %v, want %v", tt.system, tt.database, tt.wantSystem, tt.wantDatabase, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// wal2jsonV1 is a transaction as wal2json's format-version 1 writes it: one
+// object holding all of its changes, with each row's columns as parallel
+// arrays of names, types and values.
+type wal2jsonV1 struct {
+	Timestamp string `json:"timestamp"`
+	Change    []struct {
+		Kind         string   `json:"kind"` // insert, update, delete or message
+		Schema       string   `json:"schema"`
+		Table        string   `json:"table"`
+		ColumnNames  []string `json:"columnnames"`
+		ColumnTypes  []string `json:"columntypes"`
+		ColumnValues []any    `json:"columnvalues"`
+		OldKeys      struct {
+			KeyNames  []string `json:"keynames"`
+			KeyTypes  []string `json:"keytypes"`
+			KeyValues []any    `json:"keyvalues"`
+		} `json:"oldkeys"`
+	} `json:"change"`
+}
+
+var v1Actions = map[string]string{"insert": "I", "update": "U", "delete": "D"}
+
+// decodeChanges parses a row of wal2json output into the changes it holds:
+// a single change with -format-version 2, or every change of a transaction
+// with -format-version 1, normalized into the version 2 shape. A version 1
+// transaction has no begin and commit rows, and its changes all share the
+// row's LSN and xid.
+func (r *replicator) decodeChanges(data, lsn string, xid uint32) ([]WAL2JSONChange, error) {
+	if r.cfg.FormatVersion != 1 {
+		var change WAL2JSONChange
+		if err := json.Unmarshal([]byte(data), &change); err != nil {
+			return nil, err
+		}
+		change.LSN, change.XID = lsn, xid
+		return []WAL2JSONChange{change}, nil
+	}
+	var txn wal2jsonV1
+	if err := json.Unmarshal([]byte(data), &txn); err != nil {
+		return nil, err
+	}
+	changes := make([]WAL2JSONChange, 0, len(txn.Change))
+	for _, c := range txn.Change {
+		action, ok := v1Actions[c.Kind]
+		if !ok {
+			continue // logical decoding messages carry no row
+		}
+		columns, err := v1Columns(c.ColumnNames, c.ColumnTypes, c.ColumnValues)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s columns: %w", c.Schema, c.Table, err)
+		}
+		identity, err := v1Columns(c.OldKeys.KeyNames, c.OldKeys.KeyTypes, c.OldKeys.KeyValues)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s oldkeys: %w", c.Schema, c.Table, err)
+		}
+		changes = append(changes, WAL2JSONChange{
+			Action: action, Timestamp: txn.Timestamp, Schema: c.Schema, Table: c.Table,
+			Columns: columns, Identity: identity, LSN: lsn, XID: xid,
+		})
+	}
+	return changes, nil
+}
+
+// v1Columns zips version 1's parallel arrays into columns.
+func v1Columns(names, types []string, values []any) ([]WAL2JSONColumn, error) {
+	if len(types) != len(names) || len(values) != len(names) {
+		return nil, fmt.Errorf("%d names, %d types and %d values", len(names), len(types), len(values))
+	}
+	var columns []WAL2JSONColumn
+	for i, name := range names {
+		columns = append(columns, WAL2JSONColumn{Name: name, Type: types[i], Value: values[i]})
+	}
+	return columns, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeChangesV1(t *testing.T) {
+	r := &replicator{cfg: config{FormatVersion: 1}}
+	data := `{"xid":812,"timestamp":"2024-01-02 03:04:05.678+00","change":[
+		{"kind":"insert","schema":"public","table":"person","columnnames":["id","name"],"columntypes":["integer","text"],"columnvalues":[1,"Ada"]},
+		{"kind":"message","transactional":true,"prefix":"p","content":"x"},
+		{"kind":"update","schema":"public","table":"person","columnnames":["id","name"],"columntypes":["integer","text"],"columnvalues":[1,"Grace"],
+		 "oldkeys":{"keynames":["id"],"keytypes":["integer"],"keyvalues":[1]}},
+		{"kind":"delete","schema":"public","table":"person","oldkeys":{"keynames":["id"],"keytypes":["integer"],"keyvalues":[1]}}
+	]}`
+	changes, err := r.decodeChanges(data, "0/16B3748", 812)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := []WAL2JSONColumn{{Name: "id", Type: "integer", Value: float64(1)}}
+	want := []WAL2JSONChange{
+		{Action: "I", Schema: "public", Table: "person", Columns: []WAL2JSONColumn{
+			{Name: "id", Type: "integer", Value: float64(1)}, {Name: "name", Type: "text", Value: "Ada"}}},
+		{Action: "U", Schema: "public", Table: "person", Columns: []WAL2JSONColumn{
+			{Name: "id", Type: "integer", Value: float64(1)}, {Name: "name", Type: "text", Value: "Grace"}}, Identity: id},
+		{Action: "D", Schema: "public", Table: "person", Identity: id},
+	}
+	for i := range want {
+		want[i].Timestamp, want[i].LSN, want[i].XID = "2024-01-02 03:04:05.678+00", "0/16B3748", 812
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("decoded\n%+v\nwant\n%+v", changes, want)
+	}
+}
+
+func TestDecodeChangesV1Errors(t *testing.T) {
+	r := &replicator{cfg: config{FormatVersion: 1}}
+	for _, data := range []string{
+		`not json`,
+		`{"change":[{"kind":"insert","schema":"public","table":"person","columnnames":["id","name"],"columntypes":["integer"],"columnvalues":[1,"Ada"]}]}`,
+		`{"change":[{"kind":"delete","schema":"public","table":"person","oldkeys":{"keynames":["id"],"keytypes":["integer"],"keyvalues":[]}}]}`,
+	} {
+		if _, err := r.decodeChanges(data, "0/1", 1); err == nil {
+			t.Errorf("%s: no error", data)
+		}
+	}
+}
+
+func TestDecodeChangesV2(t *testing.T) {
+	r := &replicator{cfg: config{FormatVersion: 2}}
+	changes, err := r.decodeChanges(`{"action":"I","schema":"public","table":"person","columns":[{"name":"id","type":"integer","value":1}]}`, "0/1", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Action != "I" || changes[0].LSN != "0/1" || changes[0].XID != 7 {
+		t.Errorf("decoded %+v", changes)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// -target-readonly-guard installs a statement trigger on the target person
+// table that records every write made by a session whose application_name is
+// not the replicator's, so that a second writer silently diverging the target
+// is noticed. Sessions with session_replication_role=replica do not fire the
+// trigger, which is how the replicator's own writes can be hidden from it too.
+const createForeignWritesSQL = `
+	CREATE TABLE IF NOT EXISTS cdc_foreign_writes (
+		id BIGSERIAL PRIMARY KEY,
+		table_name TEXT NOT NULL,
+		operation TEXT NOT NULL,
+		application_name TEXT NOT NULL,
+		username TEXT NOT NULL,
+		client_addr INET,
+		written_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+
+	CREATE OR REPLACE FUNCTION cdc_record_foreign_write() RETURNS trigger
+	LANGUAGE plpgsql AS $$
+	BEGIN
+		IF current_setting('application_name') <> TG_ARGV[0] THEN
+			INSERT INTO cdc_foreign_writes (table_name, operation, application_name, username, client_addr)
+			VALUES (TG_TABLE_NAME, TG_OP, current_setting('application_name'), session_user, inet_client_addr());
+		END IF;
+		RETURN NULL;
+	END
+	$$;
+
+	DROP TRIGGER IF EXISTS cdc_foreign_write ON person;`
+
+// foreignWriteTriggerSQL returns the statement creating the trigger that
+// records writes from sessions other than appName.
+func foreignWriteTriggerSQL(appName string) string {
+	return `
+	CREATE TRIGGER cdc_foreign_write
+	AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON person
+	FOR EACH STATEMENT EXECUTE FUNCTION cdc_record_foreign_write('` + strings.ReplaceAll(appName, "'", "''") + `');`
+}
+
+// writeGuard watches cdc_foreign_writes for writes recorded after it was
+// installed.
+type writeGuard struct {
+	pool   *pgxpool.Pool
+	halt   bool
+	lastID int64
+}
+
+// installWriteGuard creates the trigger recording writes to person from
+// sessions other than appName, and returns a guard that reports them. With
+// halt, the guard stops the replicator on the first such write.
+func installWriteGuard(ctx context.Context, pool *pgxpool.Pool, appName string, halt bool) (*writeGuard, error) {
+	if _, err := pool.Exec(ctx, createForeignWritesSQL); err != nil {
+		return nil, err
+	}
+	if _, err := pool.Exec(ctx, foreignWriteTriggerSQL(appName)); err != nil {
+		return nil, err
+	}
+	g := &writeGuard{pool: pool, halt: halt}
+	err := pool.QueryRow(ctx, `SELECT COALESCE(max(id), 0) FROM cdc_foreign_writes`).Scan(&g.lastID)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// watch checks for foreign writes every interval until ctx is done.
+func (g *writeGuard) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		g.check(ctx)
+	}
+}
+
+// check logs the foreign writes recorded since the last check.
+func (g *writeGuard) check(ctx context.Context) {
+	rows, err := g.pool.Query(ctx, `
+		SELECT id, table_name, operation, application_name, username, COALESCE(host(client_addr), 'local'), written_at
+		FROM cdc_foreign_writes
+		WHERE id > $1
+		ORDER BY id`, g.lastID)
+	if err != nil {
+		log.Printf("Warning: Could not check for foreign writes: %v", err)
+		return
+	}
+	defer rows.Close()
+	found := false
+	for rows.Next() {
+		var table, op, appName, user, addr string
+		var at time.Time
+		if err := rows.Scan(&g.lastID, &table, &op, &appName, &user, &addr, &at); err != nil {
+			log.Printf("Warning: Could not read foreign write: %v", err)
+			return
+		}
+		log.Printf("Warning: %s on target %s at %s by %s from %s (application_name %q) was not made by the replicator; the target may diverge from the source",
+			op, table, at.Format(time.RFC3339), user, addr, appName)
+		found = true
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Warning: Could not check for foreign writes: %v", err)
+		return
+	}
+	if found && g.halt {
+		log.Fatal("Stopping: the target is being written by another client (-target-readonly-guard halt)")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// health tracks whether every source is streaming and, with
+// -health-require-caught-up, whether each has kept its slot lag under
+// -health-max-lag-bytes for -health-caught-up-for. It backs the /readyz
+// endpoint served on -health-addr.
+type health struct {
+	mu              sync.Mutex
+	requireCaughtUp bool
+	maxLagBytes     int64
+	caughtUpFor     time.Duration
+	sources         []sourceHealth
+	names           []string // of the sources, by index
+	breaker         *breaker // nil unless -breaker-failures is set
+}
+
+type sourceHealth struct {
+	streaming     bool
+	lagBytes      int64
+	caughtUpSince time.Time // zero while lag is above the threshold
+}
+
+func newHealth(cfg config) *health {
+	return &health{
+		requireCaughtUp: cfg.HealthRequireCaughtUp,
+		maxLagBytes:     cfg.HealthMaxLagBytes,
+		caughtUpFor:     cfg.HealthCaughtUpFor,
+		sources:         make([]sourceHealth, cfg.streams()),
+		names:           streamNames(cfg),
+	}
+}
+
+// observe records the slot lag of source i measured at now. A source counts
+// as caught up from the first of an unbroken run of measurements under the
+// threshold; a single measurement above it resets that.
+func (h *health) observe(i int, lagBytes int64, now time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := &h.sources[i]
+	s.streaming = true
+	s.lagBytes = lagBytes
+	switch {
+	case lagBytes > h.maxLagBytes:
+		s.caughtUpSince = time.Time{}
+	case s.caughtUpSince.IsZero():
+		s.caughtUpSince = now
+	}
+}
+
+// ready reports whether the replicator is ready at now, and if not, why.
+func (h *health) ready(now time.Time) (bool, string) {
+	if state := h.breaker.current(); state != breakerClosed {
+		return false, "circuit breaker " + state.String()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, s := range h.sources {
+		switch {
+		case !s.streaming:
+			return false, fmt.Sprintf("%s: not streaming yet", h.names[i])
+		case !h.requireCaughtUp:
+		case s.caughtUpSince.IsZero():
+			return false, fmt.Sprintf("%s: lag %d bytes is above %d", h.names[i], s.lagBytes, h.maxLagBytes)
+		case now.Sub(s.caughtUpSince) < h.caughtUpFor:
+			return false, fmt.Sprintf("%s: caught up for %v, need %v", h.names[i], now.Sub(s.caughtUpSince).Round(time.Second), h.caughtUpFor)
+		}
+	}
+	return true, "ok"
+}
+
+// serve serves handler on addr.
+func (h *health) serve(addr string, metrics http.Handler) {
+	log.Fatal(http.ListenAndServe(addr, h.handler(metrics)))
+}
+
+// handler answers /healthz while the process is up, /readyz according to
+// ready, and /metrics with metrics.
+func (h *health) handler(metrics http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		ok, reason := h.ready(time.Now())
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintln(w, reason)
+	})
+	return mux
+}
+
+// updateHealth measures how far the slot's confirmed position is behind the
+// source's current WAL position, for readiness and the -max-lag-exit
+// watchdog. busy reports whether the last poll returned changes; after an
+// empty one the replicator has caught up and the age of its last applied
+// change is no delay.
+func (r *replicator) updateHealth(ctx context.Context, busy bool) {
+	if r.health == nil && r.watchdog == nil {
+		return
+	}
+	var lag int64
+	err := r.source.QueryRow(ctx, `
+		SELECT pg_wal_lsn_diff(pg_current_wal_lsn(), confirmed_flush_lsn)::bigint
+		FROM pg_replication_slots
+		WHERE slot_name = $1`, r.slotName).Scan(&lag)
+	if err != nil {
+		log.Printf("%sFailed to measure slot lag: %v", r.prefix, err)
+		return
+	}
+	now := time.Now()
+	r.health.observe(r.sourceIndex, lag, now)
+	var delay time.Duration
+	if busy && !r.lastCommit.IsZero() {
+		delay = now.Sub(r.lastCommit)
+	}
+	r.watchdog.observe(r.sourceIndex, lag, delay, now)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthReadyStreaming(t *testing.T) {
+	h := newHealth(config{SourceDSNs: []string{"a", "b"}})
+	now := time.Now()
+	if ok, reason := h.ready(now); ok || !strings.Contains(reason, "source 1: not streaming") {
+		t.Errorf("before any source streams: %t %q", ok, reason)
+	}
+	h.observe(0, 1<<30, now)
+	if ok, reason := h.ready(now); ok || !strings.Contains(reason, "source 2: not streaming") {
+		t.Errorf("with one source streaming: %t %q", ok, reason)
+	}
+	h.observe(1, 1<<30, now)
+	if ok, reason := h.ready(now); !ok {
+		t.Errorf("both streaming without -health-require-caught-up: not ready, %q", reason)
+	}
+}
+
+func TestHealthReadyCaughtUp(t *testing.T) {
+	h := newHealth(config{SourceDSNs: []string{"a"}, HealthRequireCaughtUp: true, HealthMaxLagBytes: 1000, HealthCaughtUpFor: time.Minute})
+	start := time.Now()
+	h.observe(0, 5000, start)
+	if ok, reason := h.ready(start); ok || !strings.Contains(reason, "lag 5000 bytes is above 1000") {
+		t.Errorf("lagging: %t %q", ok, reason)
+	}
+	h.observe(0, 10, start.Add(time.Second))
+	if ok, reason := h.ready(start.Add(30 * time.Second)); ok || !strings.Contains(reason, "caught up for 29s, need 1m0s") {
+		t.Errorf("caught up for too short: %t %q", ok, reason)
+	}
+	h.observe(0, 20, start.Add(40*time.Second))
+	if ok, reason := h.ready(start.Add(61 * time.Second)); !ok {
+		t.Errorf("caught up for a minute: not ready, %q", reason)
+	}
+	h.observe(0, 2000, start.Add(62*time.Second))
+	if ok, _ := h.ready(start.Add(62 * time.Second)); ok {
+		t.Error("lag above the threshold again: still ready")
+	}
+}
+
+func TestHealthReadyBreaker(t *testing.T) {
+	h := newHealth(config{SourceDSNs: []string{"a"}})
+	now := time.Now()
+	h.observe(0, 0, now)
+	h.breaker = &breaker{threshold: 1, window: time.Minute, cooldown: time.Minute}
+	h.breaker.failure(now)
+	if ok, reason := h.ready(now); ok || reason != "circuit breaker open" {
+		t.Errorf("breaker open: %t %q", ok, reason)
+	}
+}
+
+func TestHealthReadyHysteresis(t *testing.T) {
+	h := newHealth(config{SourceDSNs: []string{"a", "b"}, HealthRequireCaughtUp: true, HealthMaxLagBytes: 1000, HealthCaughtUpFor: 10 * time.Second})
+	start := time.Now()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+	steps := []struct {
+		second int
+		source int
+		lag    int64
+		ready  bool
+	}{
+		{0, 0, 1000, false}, // at the threshold counts as caught up
+		{0, 1, 10, false},
+		{5, 0, 999, false},
+		{10, 1, 0, true},     // both caught up for 10s
+		{11, 0, 1001, false}, // one measurement above resets source 1
+		{12, 0, 0, false},
+		{21, 1, 0, false}, // only caught up again for 9s
+		{22, 0, 0, true},
+		{23, 1, 5000, false}, // either source resets readiness
+	}
+	for _, step := range steps {
+		h.observe(step.source, step.lag, at(step.second))
+		if ok, reason := h.ready(at(step.second)); ok != step.ready {
+			t.Errorf("at %ds after source %d lag %d: ready %t (%s), want %t", step.second, step.source+1, step.lag, ok, reason, step.ready)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	h := newHealth(config{SourceDSNs: []string{"a"}})
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { fmt.Fprintln(w, "cdc_up 1") })
+	server := httptest.NewServer(h.handler(metrics))
+	defer server.Close()
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, strings.TrimSpace(string(body))
+	}
+
+	if code, body := get("/healthz"); code != http.StatusOK || body != "ok" {
+		t.Errorf("/healthz: %d %q", code, body)
+	}
+	if code, body := get("/readyz"); code != http.StatusServiceUnavailable || body != "source 1: not streaming yet" {
+		t.Errorf("/readyz before streaming: %d %q", code, body)
+	}
+	h.observe(0, 0, time.Now())
+	if code, body := get("/readyz"); code != http.StatusOK || body != "ok" {
+		t.Errorf("/readyz while streaming: %d %q", code, body)
+	}
+	if code, body := get("/metrics"); code != http.StatusOK || body != "cdc_up 1" {
+		t.Errorf("/metrics: %d %q", code, body)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// snapshotHooks run -pre-snapshot-sql on the target before any source is
+// snapshotted and -post-snapshot-sql once every source has been, e.g. to
+// drop indexes or disable triggers for the bulk load and restore them after.
+// Each hook runs in its own transaction; a failing hook stops the replicator.
+type snapshotHooks struct {
+	pool    *pgxpool.Pool
+	pre     string
+	post    string
+	mu      sync.Mutex
+	pending int // snapshots not yet finished
+}
+
+// loadHookSQL returns the SQL of a hook flag: the contents of the named file
+// for a value starting with @, otherwise the value itself.
+func loadHookSQL(value string) (string, error) {
+	path, ok := strings.CutPrefix(value, "@")
+	if !ok {
+		return value, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// before runs the pre-snapshot hook.
+func (h *snapshotHooks) before(ctx context.Context) {
+	h.run(ctx, "pre-snapshot", h.pre)
+}
+
+// finished records that a snapshot is done, running the post-snapshot hook
+// after the last one. The caller running it waits for it to finish, so CDC
+// does not start before the target is restored.
+func (h *snapshotHooks) finished(ctx context.Context) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending--
+	if h.pending == 0 {
+		h.run(ctx, "post-snapshot", h.post)
+	}
+}
+
+func (h *snapshotHooks) run(ctx context.Context, name, sql string) {
+	if h == nil || sql == "" {
+		return
+	}
+	log.Printf("Running %s SQL on the target", name)
+	err := pgx.BeginFunc(ctx, h.pool, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, sql)
+		return err
+	})
+	if err != nil {
+		log.Fatalf("Failed to run %s SQL, rolled back: %v", name, err)
+	}
+	log.Printf("Finished %s SQL", name)
+}
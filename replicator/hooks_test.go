@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadHookSQL(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "post.sql")
+	if err := os.WriteFile(file, []byte("CREATE INDEX ON person (score);\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		value, want string
+	}{
+		{"ALTER TABLE person DISABLE TRIGGER ALL", "ALTER TABLE person DISABLE TRIGGER ALL"},
+		{"@" + file, "CREATE INDEX ON person (score);\n"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got, err := loadHookSQL(tt.value); err != nil || got != tt.want {
+			t.Errorf("loadHookSQL(%q) = %q, %v, want %q", tt.value, got, err, tt.want)
+		}
+	}
+	if _, err := loadHookSQL("@" + filepath.Join(t.TempDir(), "missing.sql")); err == nil {
+		t.Error("missing hook file: no error")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// idGeneratedAlways reports whether the id column of the target person table
+// is GENERATED ALWAYS AS IDENTITY, which rejects explicit ids unless the
+// insert overrides it.
+func idGeneratedAlways(ctx context.Context, pool *pgxpool.Pool) (bool, error) {
+	var identity string
+	err := pool.QueryRow(ctx, `
+		SELECT attidentity::text
+		FROM pg_attribute
+		WHERE attrelid = 'person'::regclass AND attname = 'id'`).Scan(&identity)
+	return identity == "a", err
+}
+
+// withOverridingSystemValue makes the snapshot and CDC inserts of stmts write
+// the source's ids into a GENERATED ALWAYS identity column.
+func withOverridingSystemValue(stmts statements) statements {
+	rewrite := func(sql string) string {
+		return insertValuesRE.ReplaceAllString(sql, "($1) OVERRIDING SYSTEM VALUE$2($3)")
+	}
+	stmts.snapshotInsert = rewrite(stmts.snapshotInsert)
+	stmts.insert = rewrite(stmts.insert)
+	stmts.merge = rewrite(stmts.merge)
+	return stmts
+}
+
+// replicaIdentityFull reports whether the person table of pool has REPLICA
+// IDENTITY FULL, so that wal2json reports the whole old row of every update
+// and delete.
+func replicaIdentityFull(ctx context.Context, pool *pgxpool.Pool) (bool, error) {
+	var identity string
+	err := pool.QueryRow(ctx, `SELECT relreplident::text FROM pg_class WHERE oid = 'person'::regclass`).Scan(&identity)
+	return identity == "f", err
+}
+
+// checkReplicaIdentity checks that the source person table's replica identity
+// makes wal2json report the id of updated and deleted rows, which they are
+// applied by. With REPLICA IDENTITY NOTHING, or DEFAULT without a primary key,
+// deletes carry no identity and are lost; an identity index without id, or a
+// primary key without id, leaves them without the id.
+func checkReplicaIdentity(ctx context.Context, pool *pgxpool.Pool) error {
+	var identity string
+	var keyHasID, hasKey, indexHasID bool
+	err := pool.QueryRow(ctx, `
+		SELECT c.relreplident::text,
+		       EXISTS (SELECT 1 FROM pg_index i WHERE i.indrelid = c.oid AND i.indisprimary),
+		       EXISTS (SELECT 1 FROM pg_index i JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum = ANY (i.indkey)
+		               WHERE i.indrelid = c.oid AND i.indisprimary AND a.attname = 'id'),
+		       EXISTS (SELECT 1 FROM pg_index i JOIN pg_attribute a ON a.attrelid = c.oid AND a.attnum = ANY (i.indkey)
+		               WHERE i.indrelid = c.oid AND i.indisreplident AND a.attname = 'id')
+		FROM pg_class c
+		WHERE c.oid = 'person'::regclass`).Scan(&identity, &hasKey, &keyHasID, &indexHasID)
+	if err != nil {
+		return err
+	}
+	const fix = "; fix with ALTER TABLE person REPLICA IDENTITY FULL"
+	switch {
+	case identity == "n":
+		return errors.New("replica identity is NOTHING, so deletes carry no id" + fix)
+	case identity == "d" && !hasKey:
+		return errors.New("replica identity is DEFAULT but person has no primary key, so updates and deletes are not decoded" + fix)
+	case identity == "d" && !keyHasID:
+		return errors.New("replica identity is the primary key, which does not include id" + fix)
+	case identity == "i" && !indexHasID:
+		return errors.New("replica identity index does not include id" + fix)
+	}
+	return nil
+}
+
+// checkReplicaIdentity applies -replica-identity-check to the source.
+func (r *replicator) checkReplicaIdentity(ctx context.Context) {
+	if r.cfg.ReplicaIdentityCheck == "off" {
+		return
+	}
+	err := checkReplicaIdentity(ctx, r.source)
+	switch {
+	case err == nil:
+	case r.cfg.ReplicaIdentityCheck == "error":
+		log.Fatalf("%sSource %v", r.prefix, err)
+	default:
+		log.Printf("%sWarning: Source %v", r.prefix, err)
+	}
+}
@@ -0,0 +1,874 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Integration tests run against the databases named by CDC_TEST_SOURCE_DSN
+// and CDC_TEST_TARGET_DSN, such as those of docker-compose.yml, and are
+// skipped without them. Tests needing a second target also use
+// CDC_TEST_TARGET2_DSN, and those needing a second source, another database,
+// CDC_TEST_SOURCE2_DSN. They drop and recreate the person table on every one
+// of them, so only point them at scratch databases.
+
+// integrationDSN returns the DSN in the environment variable name, or skips t
+// if it is unset.
+func integrationDSN(t *testing.T, name string) string {
+	t.Helper()
+	dsn := os.Getenv(name)
+	if dsn == "" {
+		t.Skipf("%s not set", name)
+	}
+	return dsn
+}
+
+// testConfig returns the config of a replicator run with args against the
+// integration test databases, with slot and progress table names of its own.
+func testConfig(t *testing.T, args ...string) config {
+	t.Helper()
+	source, target := integrationDSN(t, "CDC_TEST_SOURCE_DSN"), integrationDSN(t, "CDC_TEST_TARGET_DSN")
+	prefix := "t_" + strings.ToLower(regexp.MustCompile(`\W+`).ReplaceAllString(t.Name(), "_"))
+	cfg, err := testParseConfig(append([]string{"-source-dsn", source, "-target-dsn", target, "-name-prefix", prefix[:min(len(prefix), 40)], "-quiet"}, args...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// testPool connects to dsn as the replicator would, closing the pool when t
+// is done.
+func testPool(t *testing.T, dsn string, cfg config, settings ...string) *pgxpool.Pool {
+	t.Helper()
+	pool, err := newPool(context.Background(), dsn, cfg, settings...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+// mustExec runs each of sqls on pool, failing t on the first error.
+func mustExec(t *testing.T, pool *pgxpool.Pool, sqls ...string) {
+	t.Helper()
+	for _, sql := range sqls {
+		if _, err := pool.Exec(context.Background(), sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+}
+
+// newTestReplicator returns a replicator for cfg's first source and its
+// targets, set up as main does. The person table is recreated empty on the
+// source and every target, and the replicator's slot and progress table are
+// dropped when t is done. With several sources the target is set up for
+// fan-in; newTestSourceReplicator returns the replicators of the others.
+func newTestReplicator(t *testing.T, cfg config) *replicator {
+	t.Helper()
+	source := testPool(t, cfg.SourceDSNs[0], cfg)
+	fanIn := len(cfg.SourceDSNs) > 1
+	stmts := statementsFor(cfg, fanIn)
+	mustExec(t, source, `DROP TABLE IF EXISTS person`, singleSourceStatements.createTable)
+	var pools []*pgxpool.Pool
+	for _, dsn := range append([]string{cfg.TargetDSN}, cfg.ShardDSNs...) {
+		pool := testPool(t, dsn, cfg, cfg.TargetSettings...)
+		mustExec(t, pool, `DROP TABLE IF EXISTS person`, `DROP TABLE IF EXISTS `+cfg.progressTable(), stmts.createTable, createProgressTableSQL(cfg.progressTable()))
+		if fanIn {
+			mustExec(t, pool, `DROP TABLE IF EXISTS `+cfg.sourcesTable(), createSourcesTableSQL(cfg.sourcesTable()))
+		}
+		pools = append(pools, pool)
+	}
+	masker, err := newMasker(cfg.Masks, cfg.MaskKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &replicator{cfg: cfg, slotName: cfg.SlotName, source: source, target: pools[0], targetRead: pools[0], stmts: stmts, masker: masker, metrics: newMetrics(streamLabels(cfg))}
+	if len(pools) > 1 {
+		r.shards = r.newShards(pools)
+	}
+	if fanIn {
+		if err := registerSource(context.Background(), cfg, r.target, source, cfg.SourceIDs[0]); err != nil {
+			t.Fatal(err)
+		}
+		r.sourceID = cfg.SourceIDs[0]
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		source.Exec(ctx, `SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = $1`, cfg.SlotName)
+		for _, pool := range pools {
+			pool.Exec(ctx, `DROP TABLE IF EXISTS `+cfg.progressTable())
+			pool.Exec(ctx, `DROP TABLE IF EXISTS `+cfg.sourcesTable())
+		}
+	})
+	return r
+}
+
+// newTestSourceReplicator returns the fan-in replicator for source i of
+// first's config, sharing its target, with the person table recreated empty
+// on that source and its slot dropped when t is done.
+func newTestSourceReplicator(t *testing.T, first *replicator, i int) *replicator {
+	t.Helper()
+	cfg := first.cfg
+	source := testPool(t, cfg.SourceDSNs[i], cfg)
+	mustExec(t, source, `DROP TABLE IF EXISTS person`, singleSourceStatements.createTable)
+	if err := registerSource(context.Background(), cfg, first.target, source, cfg.SourceIDs[i]); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		source.Exec(context.Background(), `SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = $1`, cfg.SlotName)
+	})
+	r := newTestReplicatorOn(first)
+	r.source, r.sourceIndex, r.sourceID = source, i, cfg.SourceIDs[i]
+	return r
+}
+
+// insertPeople inserts people with ids on pool.
+func insertPeople(t *testing.T, pool *pgxpool.Pool, ids ...int) {
+	t.Helper()
+	for _, id := range ids {
+		_, err := pool.Exec(context.Background(), `INSERT INTO person (id, name, uid, score) VALUES ($1, $2, gen_random_uuid(), $1)`, id, fmt.Sprintf("person %d", id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// personIDs returns the ids of the person table on pool, in order.
+func personIDs(t *testing.T, pool *pgxpool.Pool) []int {
+	t.Helper()
+	rows, err := pool.Query(context.Background(), `SELECT id FROM person ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+// pollAll polls r until a poll returns no changes.
+func pollAll(t *testing.T, r *replicator) {
+	t.Helper()
+	for {
+		n, err := r.poll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return
+		}
+	}
+}
+
+func TestIntegrationShardByIDModulo(t *testing.T) {
+	cfg := testConfig(t, "-target-dsn", integrationDSN(t, "CDC_TEST_TARGET2_DSN"), "-shard-by-column", "id")
+	r := newTestReplicator(t, cfg)
+	ctx := context.Background()
+	insertPeople(t, r.source, 1, 2, 3, 4)
+	r.createSlot(ctx)
+	r.snapshot(ctx)
+
+	insertPeople(t, r.source, 5, 6)
+	mustExec(t, r.source, `UPDATE person SET score = 20 WHERE id = 2`, `DELETE FROM person WHERE id = 3`)
+	pollAll(t, r)
+
+	for i, want := range [][]int{{2, 4, 6}, {1, 5}} {
+		if got := personIDs(t, r.shards[i].target); !slices.Equal(got, want) {
+			t.Errorf("shard %d has ids %v, want %v", i, got, want)
+		}
+	}
+	var score int
+	if err := r.shards[0].target.QueryRow(ctx, `SELECT score FROM person WHERE id = 2`).Scan(&score); err != nil || score != 20 {
+		t.Errorf("updated score %d, %v, want 20", score, err)
+	}
+}
+
+// slotPosition returns the confirmed_flush_lsn of r's slot.
+func slotPosition(t *testing.T, r *replicator) string {
+	t.Helper()
+	var lsn string
+	if err := r.source.QueryRow(context.Background(), `SELECT confirmed_flush_lsn::text FROM pg_replication_slots WHERE slot_name = $1`, r.slotName).Scan(&lsn); err != nil {
+		t.Fatal(err)
+	}
+	return lsn
+}
+
+// recordedProgress returns the progress r recorded on its target.
+func recordedProgress(t *testing.T, r *replicator) string {
+	t.Helper()
+	var lsn string
+	if err := r.target.QueryRow(context.Background(), `SELECT lsn::text FROM `+r.cfg.progressTable()+` WHERE slot_name = $1`, r.slotName).Scan(&lsn); err != nil {
+		t.Fatal(err)
+	}
+	return lsn
+}
+
+// flakySink keeps the events emitted to it, and fails to flush them while
+// failFlush is set.
+type flakySink struct {
+	events    []Event
+	failFlush bool
+}
+
+func (s *flakySink) Emit(ev Event) error {
+	s.events = append(s.events, ev)
+	return nil
+}
+
+func (s *flakySink) Flush(context.Context) error {
+	if s.failFlush {
+		return errors.New("flush failed")
+	}
+	return nil
+}
+
+func (s *flakySink) Close() error { return nil }
+
+func TestIntegrationSinkFlushFailureRedelivers(t *testing.T) {
+	r := newTestReplicator(t, testConfig(t))
+	sink := &flakySink{failFlush: true}
+	r.sink = sink
+	ctx := context.Background()
+	r.createSlot(ctx)
+	before := slotPosition(t, r)
+
+	insertPeople(t, r.source, 1)
+	if _, err := r.poll(ctx); err == nil {
+		t.Fatal("poll with a failing sink flush: no error")
+	}
+	if got := slotPosition(t, r); got != before {
+		t.Errorf("slot advanced from %s to %s though the sink flush failed", before, got)
+	}
+	if len(sink.events) != 1 {
+		t.Fatalf("%d events emitted, want the insert", len(sink.events))
+	}
+
+	sink.failFlush = false
+	pollAll(t, r)
+	if len(sink.events) != 2 || sink.events[1].Op != "c" || sink.events[1].LSN != sink.events[0].LSN {
+		t.Fatalf("events %+v, want the insert delivered again", sink.events)
+	}
+	if got := personIDs(t, r.target); !slices.Equal(got, []int{1}) {
+		t.Errorf("target ids %v, want [1]", got)
+	}
+	if slot, progress := slotPosition(t, r), recordedProgress(t, r); slot == before || progress != slot {
+		t.Errorf("slot at %s, progress %s, want both past %s and equal", slot, progress, before)
+	}
+}
+
+func TestIntegrationAttachSlotCleanRestart(t *testing.T) {
+	cfg := testConfig(t, "-attach-slot", "t_attach_clean_restart")
+	r := newTestReplicator(t, cfg)
+	ctx := context.Background()
+	insertPeople(t, r.source, 1, 2)
+	mustExec(t, r.source, `SELECT pg_create_logical_replication_slot('t_attach_clean_restart', 'wal2json')`)
+	r.attachSlot(ctx)
+	if !r.attachedSlotNeedsSnapshot(ctx) {
+		t.Fatal("no snapshot for a slot without recorded progress")
+	}
+	r.snapshot(ctx)
+	insertPeople(t, r.source, 3)
+	mustExec(t, r.source, `UPDATE person SET score = 30 WHERE id = 1`)
+	pollAll(t, r)
+
+	// A fresh replicator, as after a restart, resumes from the slot
+	restarted := newTestReplicatorOn(r)
+	restarted.attachSlot(ctx)
+	if restarted.attachedSlotNeedsSnapshot(ctx) {
+		t.Errorf("clean restart snapshots again: slot at %s, progress %s", slotPosition(t, r), recordedProgress(t, r))
+	}
+	insertPeople(t, r.source, 4)
+	pollAll(t, restarted)
+	if got := personIDs(t, r.target); !slices.Equal(got, []int{1, 2, 3, 4}) {
+		t.Errorf("target ids %v, want [1 2 3 4]", got)
+	}
+}
+
+// newTestReplicatorOn returns a replicator sharing r's config and pools but
+// none of its state, as a restart would.
+func newTestReplicatorOn(r *replicator) *replicator {
+	return &replicator{cfg: r.cfg, slotName: r.slotName, source: r.source, target: r.target, targetRead: r.targetRead, stmts: r.stmts, masker: r.masker, metrics: r.metrics}
+}
+
+// personRows returns the id, name and score of every row of person on pool.
+func personRows(t *testing.T, pool *pgxpool.Pool) []string {
+	t.Helper()
+	rows, err := pool.Query(context.Background(), `SELECT format('%s %s %s', id, name, score) FROM person ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestIntegrationRelaxedOrderMatchesSource(t *testing.T) {
+	r := newTestReplicator(t, testConfig(t, "-apply-ordering", "relaxed", "-apply-workers", "8"))
+	ctx := context.Background()
+	r.createSlot(ctx)
+	var ids []int
+	for id := 1; id <= 50; id++ {
+		ids = append(ids, id)
+	}
+	insertPeople(t, r.source, ids...)
+	for step := 0; step < 5; step++ {
+		mustExec(t, r.source, fmt.Sprintf(`UPDATE person SET score = score + %d`, step))
+	}
+	mustExec(t, r.source,
+		`DELETE FROM person WHERE id % 7 = 0`,
+		`UPDATE person SET id = id + 100 WHERE id % 5 = 0`,
+		`UPDATE person SET name = 'moved ' || id WHERE id > 100`)
+	pollAll(t, r)
+
+	if got, want := personRows(t, r.target), personRows(t, r.source); !slices.Equal(got, want) {
+		t.Errorf("target rows %q, want the source's %q", got, want)
+	}
+}
+
+func TestIntegrationFanInConverges(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.SourceDSNs = append(cfg.SourceDSNs, integrationDSN(t, "CDC_TEST_SOURCE2_DSN"))
+	cfg.SourceIDs = []int{1, 2}
+	first := newTestReplicator(t, cfg)
+	second := newTestSourceReplicator(t, first, 1)
+	ctx := context.Background()
+
+	// Both sources use the same ids, which fan-in keeps apart
+	insertPeople(t, first.source, 1, 2, 3)
+	insertPeople(t, second.source, 1, 2)
+	for _, r := range []*replicator{first, second} {
+		r.createSlot(ctx)
+		r.snapshot(ctx)
+	}
+	insertPeople(t, first.source, 4)
+	insertPeople(t, second.source, 3)
+	mustExec(t, first.source, `DELETE FROM person WHERE id = 2`)
+	mustExec(t, second.source, `UPDATE person SET score = 10 WHERE id = 1`)
+	pollAll(t, second)
+	pollAll(t, first)
+
+	var want []string
+	for _, r := range []*replicator{first, second} {
+		for _, row := range personRows(t, r.source) {
+			want = append(want, fmt.Sprintf("%d %s", r.sourceID, row))
+		}
+	}
+	rows, err := first.target.Query(ctx, `SELECT format('%s %s %s %s', source_id, id, name, score) FROM person ORDER BY source_id, id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("target rows %q, want the sources' %q", got, want)
+	}
+
+	// Swapping the ids is refused
+	if err := registerSource(ctx, cfg, first.target, second.source, 1); err == nil {
+		t.Error("source 2 registered again as id 1")
+	}
+}
+
+func TestIntegrationTargetTimeouts(t *testing.T) {
+	cfg := testConfig(t, "-target-statement-timeout", "5s", "-target-lock-timeout", "200ms", "-apply-retries", "0")
+	r := newTestReplicator(t, cfg)
+	ctx := context.Background()
+	for setting, want := range map[string]string{"statement_timeout": "5s", "lock_timeout": "200ms"} {
+		var got string
+		if err := r.target.QueryRow(ctx, `SELECT current_setting($1)`, setting).Scan(&got); err != nil || got != want {
+			t.Errorf("target session %s = %q, %v, want %q", setting, got, err, want)
+		}
+	}
+
+	// Another session, without the timeouts, holds a lock on person
+	locker, err := testPool(t, cfg.TargetDSN, cfg).Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locker.Rollback(ctx)
+	if _, err := locker.Exec(ctx, `LOCK TABLE person IN ACCESS EXCLUSIVE MODE`); err != nil {
+		t.Fatal(err)
+	}
+	insert := `INSERT INTO person (id, name, uid, score) VALUES (1, 'blocked', gen_random_uuid(), 1)`
+	if err := r.exec(ctx, insert); !isTimeout(err) {
+		t.Fatalf("insert blocked on a lock: %v, want a timeout", err)
+	}
+
+	// A retry after the lock is released succeeds
+	r.cfg.ApplyRetries = 10
+	released := make(chan error)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		released <- locker.Rollback(ctx)
+	}()
+	if err := r.exec(ctx, insert); err != nil {
+		t.Errorf("insert retried past the lock: %v", err)
+	}
+	if err := <-released; err != nil {
+		t.Fatal(err)
+	}
+	if got := personIDs(t, r.target); !slices.Equal(got, []int{1}) {
+		t.Errorf("target ids %v, want [1]", got)
+	}
+}
+
+func TestIntegrationVerifyNullsAndChunks(t *testing.T) {
+	cfg := testConfig(t)
+	r := newTestReplicator(t, cfg)
+	ctx := context.Background()
+	fill := fmt.Sprintf(`INSERT INTO person (id, name, uid, score, created_at)
+		SELECT i, 'person ' || i, md5(i::text)::uuid, i, CASE WHEN i %% 3 = 0 THEN NULL ELSE timestamp '2024-01-01' + i * interval '1 second' END
+		FROM generate_series(1, %d) i`, 2*verifyChunkSize+5)
+	mustExec(t, r.source, fill)
+	mustExec(t, r.target, fill)
+	if !verify(ctx, cfg) {
+		t.Fatal("equal tables with NULL created_at failed verification")
+	}
+
+	mustExec(t, r.target, `UPDATE person SET created_at = NULL WHERE id = 1`, `UPDATE person SET created_at = now() WHERE id = 3`, fmt.Sprintf(`DELETE FROM person WHERE id = %d`, verifyChunkSize+1))
+	if verify(ctx, cfg) {
+		t.Error("tables differing in NULLs and a missing row passed verification")
+	}
+}
+
+func TestIntegrationAppendOnly(t *testing.T) {
+	tests := []struct {
+		updates string
+		want    []string // op and id of the target rows, in seq order
+	}{
+		{"ignore", []string{"r 1", "c 2"}},
+		{"tombstone", []string{"r 1", "c 2", "u 1", "u 1", "d 2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.updates, func(t *testing.T) {
+			r := newTestReplicator(t, testConfig(t, "-append-only", "-append-updates", tt.updates))
+			ctx := context.Background()
+			insertPeople(t, r.source, 1)
+			r.createSlot(ctx)
+			r.snapshot(ctx)
+			insertPeople(t, r.source, 2)
+			mustExec(t, r.source, `UPDATE person SET score = 10 WHERE id = 1`, `UPDATE person SET score = 11 WHERE id = 1`, `DELETE FROM person WHERE id = 2`)
+			pollAll(t, r)
+
+			rows, err := r.target.Query(ctx, `SELECT op || ' ' || id, source_lsn::text FROM person ORDER BY seq`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			var lastLSN uint64
+			for rows.Next() {
+				var row string
+				var lsn *string
+				if err := rows.Scan(&row, &lsn); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, row)
+				switch {
+				case row[0] == 'r' && lsn != nil:
+					t.Errorf("snapshot row %s has source_lsn %s", row, *lsn)
+				case row[0] != 'r' && (lsn == nil || parseLSN(*lsn) < lastLSN):
+					t.Errorf("row %s has source_lsn %v, want one at or past %X", row, lsn, lastLSN)
+				case lsn != nil:
+					lastLSN = parseLSN(*lsn)
+				}
+			}
+			if err := rows.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("target rows %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntegrationApplicationName(t *testing.T) {
+	cfg := testConfig(t, "-application-name", "cdc-test-replicator")
+	for _, dsn := range []string{cfg.SourceDSNs[0], cfg.TargetDSN} {
+		var name string
+		if err := testPool(t, dsn, cfg).QueryRow(context.Background(), `SELECT application_name FROM pg_stat_activity WHERE pid = pg_backend_pid()`).Scan(&name); err != nil || name != "cdc-test-replicator" {
+			t.Errorf("application_name %q, %v, want cdc-test-replicator", name, err)
+		}
+	}
+}
+
+func TestIntegrationDrainDeadlineKeepsChanges(t *testing.T) {
+	r := newTestReplicator(t, testConfig(t))
+	background := context.Background()
+	r.createSlot(background)
+	before := slotPosition(t, r)
+	insertPeople(t, r.source, 1)
+
+	// The apply blocks on a target lock until the drain timeout cancels it
+	locker, err := testPool(t, r.cfg.TargetDSN, r.cfg).Begin(background)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locker.Rollback(background)
+	if _, err := locker.Exec(background, `LOCK TABLE person IN ACCESS EXCLUSIVE MODE`); err != nil {
+		t.Fatal(err)
+	}
+	stop, stopNow := context.WithCancel(background)
+	ctx, cancel := context.WithCancel(background)
+	defer cancel()
+	go cancelAfterDrain(stop, 200*time.Millisecond, cancel)
+	stopNow()
+	if _, err := r.poll(ctx); err == nil {
+		t.Fatal("poll cut short by the drain timeout: no error")
+	}
+	if got := slotPosition(t, r); got != before {
+		t.Errorf("slot advanced from %s to %s past an unapplied change", before, got)
+	}
+
+	// After a restart the change is applied
+	if err := locker.Rollback(background); err != nil {
+		t.Fatal(err)
+	}
+	pollAll(t, newTestReplicatorOn(r))
+	if got := personIDs(t, r.target); !slices.Equal(got, []int{1}) {
+		t.Errorf("target ids %v, want [1]", got)
+	}
+}
+
+func TestIntegrationSnapshotOnlyThenCDCOnly(t *testing.T) {
+	r := newTestReplicator(t, testConfig(t, "-snapshot-only"))
+	ctx := context.Background()
+	insertPeople(t, r.source, 1, 2)
+	r.run(ctx) // returns once the snapshot is copied
+	if got := personIDs(t, r.target); !slices.Equal(got, []int{1, 2}) {
+		t.Fatalf("target ids after -snapshot-only %v, want [1 2]", got)
+	}
+
+	// Changes between the two runs are kept in the slot
+	insertPeople(t, r.source, 3)
+	mustExec(t, r.source, `UPDATE person SET score = 10 WHERE id = 1`, `DELETE FROM person WHERE id = 2`)
+	cdc := newTestReplicatorOn(r)
+	cdc.cfg.SnapshotOnly, cdc.cfg.CDCOnly = false, true
+	cdc.attachSlot(ctx)
+	pollAll(t, cdc)
+	if got, want := personRows(t, r.target), personRows(t, r.source); !slices.Equal(got, want) {
+		t.Errorf("target rows %q, want the source's %q", got, want)
+	}
+}
+
+func TestIntegrationTargetReadPoolRouting(t *testing.T) {
+	replica := integrationDSN(t, "CDC_TEST_TARGET2_DSN")
+	r := newTestReplicator(t, testConfig(t, "-target-read-dsn", replica))
+	ctx := context.Background()
+	// The second target stands in for a replica that already has the rows
+	// the snapshot missed, so reconciliation, reading from it, finds none
+	read, err := newTargetReadPool(ctx, r.cfg, r.target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(read.Close)
+	mustExec(t, read, `DROP TABLE IF EXISTS person`, r.stmts.createTable)
+	r.targetRead = read
+	insertPeople(t, r.source, 1, 2)
+	insertPeople(t, read, 1, 2)
+	r.createSlot(ctx)
+	r.snapshotMaxID = 2
+	r.reconcile(ctx)
+	if got := personIDs(t, r.target); len(got) != 0 {
+		t.Errorf("reconcile wrote ids %v, want none: it read the write target", got)
+	}
+
+	// Changes are applied to the write target only
+	insertPeople(t, r.source, 3)
+	pollAll(t, r)
+	if got := personIDs(t, r.target); !slices.Equal(got, []int{3}) {
+		t.Errorf("write target ids %v, want [3]", got)
+	}
+	if got := personIDs(t, read); !slices.Equal(got, []int{1, 2}) {
+		t.Errorf("read target ids %v, want [1 2] untouched", got)
+	}
+}
+
+func TestIntegrationSlotNamesAreIndependent(t *testing.T) {
+	orders := newTestReplicator(t, testConfig(t, "-slot-name", "orders_slot"))
+	cfg := testConfig(t, "-slot-name", "audit_slot")
+	cfg.TargetDSN = integrationDSN(t, "CDC_TEST_TARGET2_DSN")
+	audit := newTestReplicator(t, cfg)
+	ctx := context.Background()
+	orders.createSlot(ctx)
+	audit.createSlot(ctx)
+	insertPeople(t, orders.source, 1, 2)
+
+	// Consuming one slot leaves the other's changes in place
+	pollAll(t, orders)
+	if got := personIDs(t, audit.target); len(got) != 0 {
+		t.Errorf("audit target has ids %v before its slot was polled", got)
+	}
+	insertPeople(t, orders.source, 3)
+	pollAll(t, audit)
+	pollAll(t, orders)
+	for _, r := range []*replicator{orders, audit} {
+		if got := personIDs(t, r.target); !slices.Equal(got, []int{1, 2, 3}) {
+			t.Errorf("%s target ids %v, want [1 2 3]", r.slotName, got)
+		}
+		if slot, progress := slotPosition(t, r), recordedProgress(t, r); slot != progress {
+			t.Errorf("%s at %s, progress %s", r.slotName, slot, progress)
+		}
+	}
+}
+
+func TestIntegrationNoUpdateColumns(t *testing.T) {
+	r := newTestReplicator(t, testConfig(t, "-no-update-columns", "uid,score"))
+	ctx := context.Background()
+	insertPeople(t, r.source, 1)
+	r.createSlot(ctx)
+	r.snapshot(ctx)
+	var uid string
+	if err := r.target.QueryRow(ctx, `SELECT uid::text FROM person WHERE id = 1`).Scan(&uid); err != nil {
+		t.Fatal(err)
+	}
+
+	mustExec(t, r.source, `UPDATE person SET name = 'renamed', uid = gen_random_uuid(), score = 10 WHERE id = 1`)
+	insertPeople(t, r.source, 2)
+	pollAll(t, r)
+	if got := personRows(t, r.target); !slices.Equal(got, []string{"1 renamed 1", "2 person 2 2"}) {
+		t.Errorf("target rows %q, want the update to keep score 1 and the insert to set it", got)
+	}
+	var after string
+	if err := r.target.QueryRow(ctx, `SELECT uid::text FROM person WHERE id = 1`).Scan(&after); err != nil || after != uid {
+		t.Errorf("uid %s, %v, want %s kept from the insert", after, err, uid)
+	}
+}
+
+func TestIntegrationSerializableApplyRetries(t *testing.T) {
+	cfg := testConfig(t, "-apply-isolation", "serializable", "-apply-retries", "0")
+	r := newTestReplicator(t, cfg)
+	ctx := context.Background()
+	insertPeople(t, r.target, 1)
+	other := testPool(t, cfg.TargetDSN, cfg)
+	// concurrently starts an update of the row in another session and
+	// commits it while update waits for the row lock, so that the update
+	// fails to serialize
+	concurrently := func(score int, update func() error) error {
+		tx, err := other.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback(ctx)
+		if _, err := tx.Exec(ctx, `UPDATE person SET score = $1 WHERE id = 1`, score); err != nil {
+			t.Fatal(err)
+		}
+		committed := make(chan error)
+		go func() {
+			time.Sleep(300 * time.Millisecond)
+			committed <- tx.Commit(ctx)
+		}()
+		err = update()
+		if err := <-committed; err != nil {
+			t.Fatal(err)
+		}
+		return err
+	}
+	update := func() error { return r.exec(ctx, `UPDATE person SET name = 'applied' WHERE id = 1`) }
+
+	if err := concurrently(10, update); !isConflict(err) {
+		t.Fatalf("update racing a concurrent one: %v, want a serialization failure", err)
+	}
+	r.cfg.ApplyRetries = 3
+	if err := concurrently(20, update); err != nil {
+		t.Fatalf("update retried after a serialization failure: %v", err)
+	}
+	if got := personRows(t, r.target); !slices.Equal(got, []string{"1 applied 20"}) {
+		t.Errorf("target rows %q, want both updates applied", got)
+	}
+}
+
+func TestIntegrationSnapshotHooksOrder(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.SourceDSNs = append(cfg.SourceDSNs, integrationDSN(t, "CDC_TEST_SOURCE2_DSN"))
+	cfg.SourceIDs = []int{1, 2}
+	first := newTestReplicator(t, cfg)
+	second := newTestSourceReplicator(t, first, 1)
+	ctx := context.Background()
+	insertPeople(t, first.source, 1, 2, 3)
+	insertPeople(t, second.source, 1, 2)
+
+	// Each hook logs how many rows the target has when it runs
+	mustExec(t, first.target, `DROP TABLE IF EXISTS t_hook_log`, `CREATE TABLE t_hook_log (seq serial, hook text, rows bigint)`)
+	t.Cleanup(func() { first.target.Exec(context.Background(), `DROP TABLE IF EXISTS t_hook_log`) })
+	hooks := &snapshotHooks{
+		pool:    first.target,
+		pre:     `INSERT INTO t_hook_log (hook, rows) SELECT 'pre', count(*) FROM person`,
+		post:    `INSERT INTO t_hook_log (hook, rows) SELECT 'post', count(*) FROM person`,
+		pending: 2,
+	}
+	hookLog := func() []string {
+		rows, err := first.target.Query(ctx, `SELECT format('%s %s', hook, rows) FROM t_hook_log ORDER BY seq`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	hooks.before(ctx)
+	for i, r := range []*replicator{first, second} {
+		r.hooks = hooks
+		r.createSlot(ctx)
+		r.snapshot(ctx)
+		r.hooks.finished(ctx)
+		if i == 0 {
+			if got := hookLog(); !slices.Equal(got, []string{"pre 0"}) {
+				t.Errorf("hooks run after the first of two snapshots: %q, want only the pre-snapshot hook", got)
+			}
+		}
+	}
+	if got := hookLog(); !slices.Equal(got, []string{"pre 0", "post 5"}) {
+		t.Errorf("hooks run %q, want pre-snapshot before any rows and post-snapshot after all of them", got)
+	}
+}
+
+func TestIntegrationAnnotateRecordsSourceChange(t *testing.T) {
+	r := newTestReplicator(t, testConfig(t, "-annotate"))
+	ctx := context.Background()
+	insertPeople(t, r.source, 1, 2)
+	r.createSlot(ctx)
+	r.snapshot(ctx)
+	before := slotPosition(t, r)
+
+	var started time.Time
+	err := pgx.BeginFunc(ctx, r.source, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `UPDATE person SET score = 10 WHERE id = 1`); err != nil {
+			return err
+		}
+		return tx.QueryRow(ctx, `SELECT now()`).Scan(&started)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pollAll(t, r)
+	after := slotPosition(t, r)
+
+	// Snapshot rows have no change behind them; the update records its own
+	var snapshotted bool
+	if err := r.target.QueryRow(ctx, `SELECT _src_lsn IS NULL AND _src_committed_at IS NULL FROM person WHERE id = 2`).Scan(&snapshotted); err != nil || !snapshotted {
+		t.Errorf("snapshot row annotated: %v", err)
+	}
+	var inRange bool
+	var committed time.Time
+	err = r.target.QueryRow(ctx, `SELECT _src_lsn > $1::pg_lsn AND _src_lsn <= $2::pg_lsn, _src_committed_at FROM person WHERE id = 1`, before, after).Scan(&inRange, &committed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !inRange {
+		t.Errorf("_src_lsn not between the slot positions %s and %s around the update", before, after)
+	}
+	if committed.Before(started) || committed.After(started.Add(10*time.Second)) {
+		t.Errorf("_src_committed_at %v, want the update's commit shortly after %v", committed, started)
+	}
+}
+
+func TestIntegrationSoftDeleteAndReinsert(t *testing.T) {
+	r := newTestReplicator(t, testConfig(t, "-soft-delete", "deleted_at"))
+	ctx := context.Background()
+	insertPeople(t, r.source, 1, 2)
+	r.createSlot(ctx)
+	r.snapshot(ctx)
+	tombstones := func() []string {
+		rows, err := r.target.Query(ctx, `SELECT format('%s %s', id, deleted_at IS NOT NULL) FROM person ORDER BY id`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	var deleted time.Time
+	err := pgx.BeginFunc(ctx, r.source, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM person WHERE id = 1`); err != nil {
+			return err
+		}
+		return tx.QueryRow(ctx, `SELECT now()`).Scan(&deleted)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pollAll(t, r)
+	if got := tombstones(); !slices.Equal(got, []string{"1 true", "2 false"}) {
+		t.Fatalf("tombstones %q, want the deleted row kept and tombstoned", got)
+	}
+	var at time.Time
+	if err := r.target.QueryRow(ctx, `SELECT deleted_at FROM person WHERE id = 1`).Scan(&at); err != nil || at.Before(deleted) || at.After(deleted.Add(10*time.Second)) {
+		t.Errorf("deleted_at %v, %v, want the delete's commit shortly after %v", at, err, deleted)
+	}
+
+	// Inserting the id again brings the row back with the new values
+	mustExec(t, r.source, `INSERT INTO person (id, name, uid, score) VALUES (1, 'back', gen_random_uuid(), 5)`)
+	pollAll(t, r)
+	if got := tombstones(); !slices.Equal(got, []string{"1 false", "2 false"}) {
+		t.Errorf("tombstones %q after the re-insert, want none", got)
+	}
+	if got := personRows(t, r.target); !slices.Equal(got, []string{"1 back 5", "2 person 2 2"}) {
+		t.Errorf("target rows %q, want the re-inserted values", got)
+	}
+}
+
+func TestIntegrationParallelSnapshot(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		ids, want []int
+	}{
+		{"uneven ranges", []string{"-snapshot-workers", "4"}, []int{1, 2, 3, 5, 8, 13, 21, 34, 55, 89, 144, 1000}, nil},
+		{"more workers than ids", []string{"-snapshot-workers", "8"}, []int{7, 9}, nil},
+		{"cursor", []string{"-snapshot-workers", "3", "-cursor-fetch-size", "2"}, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, nil},
+		{"where", []string{"-snapshot-workers", "3", "-snapshot-where", "id % 2 = 0"}, []int{1, 2, 3, 4, 5, 6, 7, 8}, []int{2, 4, 6, 8}},
+		{"empty", []string{"-snapshot-workers", "4"}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestReplicator(t, testConfig(t, tt.args...))
+			insertPeople(t, r.source, tt.ids...)
+			want := tt.want
+			if want == nil {
+				want = tt.ids
+			}
+			count := r.parallelSnapshot(context.Background())
+			if got := personIDs(t, r.target); !slices.Equal(got, want) {
+				t.Errorf("target ids %v, want %v", got, want)
+			}
+			if count.rows != len(want) || count.skipped != 0 || len(want) > 0 && count.maxID != want[len(want)-1] {
+				t.Errorf("copied %d rows up to id %d, skipped %d, want %d copied", count.rows, count.maxID, count.skipped, len(want))
+			}
+			if tt.want == nil && len(want) > 0 {
+				if got, source := personRows(t, r.target), personRows(t, r.source); !slices.Equal(got, source) {
+					t.Errorf("target rows %q, want the source's %q", got, source)
+				}
+			}
+		})
+	}
+}
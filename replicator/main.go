@@ -2,13 +2,17 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -33,245 +37,752 @@ type WAL2JSONChange struct {
 	Schema    string           `json:"schema"`
 	Table     string           `json:"table"`
 	Columns   []WAL2JSONColumn `json:"columns"`
-	Identity  []WAL2JSONColumn `json:"identity,omitempty"` // For updates and deletes
+	Identity  []WAL2JSONColumn `json:"identity,omitempty"` // For updates and deletes only: inserts have no old row
+
+	// Reported by pg_logical_slot_peek_changes alongside the wal2json output
+	LSN string `json:"-"`
+	XID uint32 `json:"-"`
+}
+
+func parseFlags() config {
+	cfg, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	return cfg
 }
 
 func main() {
-	sourceConnStr := "host=localhost port=5429 user=postgres password=postgres dbname=testdb sslmode=disable"
-	targetConnStr := "host=localhost port=5431 user=postgres password=postgres dbname=testdb sslmode=disable"
+	cfg := parseFlags()
+	fanIn := len(cfg.SourceDSNs) > 1
+
+	if cfg.DumpConfig {
+		b, err := dumpConfig(cfg)
+		if err != nil {
+			log.Fatal("Failed to dump config:", err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	if cfg.PrintDDL {
+		fmt.Print(targetDDL(cfg, fanIn))
+		return
+	}
 
 	ctx := context.Background()
-	sourcePool, err := pgxpool.New(ctx, sourceConnStr)
-	if err != nil {
-		log.Fatal("Failed to connect to source database:", err)
+	if cfg.ValidateOnly {
+		if !validate(ctx, cfg) {
+			os.Exit(1)
+		}
+		return
+	}
+	if cfg.SelfTest {
+		if !selfTest(ctx, cfg) {
+			os.Exit(1)
+		}
+		return
+	}
+	if cfg.Verify {
+		if !verify(ctx, cfg) {
+			os.Exit(1)
+		}
+		return
+	}
+	if cfg.CompareSchemas {
+		if !compareSchemas(ctx, cfg) {
+			os.Exit(1)
+		}
+		return
+	}
+	if cfg.TargetNone {
+		analyze(ctx, cfg)
+		return
 	}
-	defer sourcePool.Close()
 
-	targetPool, err := pgxpool.New(ctx, targetConnStr)
+	secrets, err := newSecretsWatcher(cfg.SecretsFile, cfg.SetFlags, cfg.checkTargetDSN)
+	if err != nil {
+		log.Fatal("Failed to read -secrets-file:", err)
+	}
+	targetPool, err := secrets.newPool(ctx, "target-dsn", cfg.TargetDSN, cfg, cfg.TargetSettings...)
 	if err != nil {
 		log.Fatal("Failed to connect to target database:", err)
 	}
 	defer targetPool.Close()
+	targetReadPool, err := newTargetReadPool(ctx, cfg, targetPool, secrets)
+	if err != nil {
+		log.Fatal("Failed to connect to target read database:", err)
+	}
+	if targetReadPool != targetPool {
+		defer targetReadPool.Close()
+	}
 
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS person (
-		id SERIAL PRIMARY KEY,
-		name VARCHAR(100) NOT NULL,
-		uid UUID NOT NULL,
-		score INTEGER NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
-
-	_, err = targetPool.Exec(ctx, createTableSQL)
+	stmts := statementsFor(cfg, fanIn)
+	_, err = targetPool.Exec(ctx, stmts.createTable)
 	if err != nil {
 		log.Fatal("Failed to create target table:", err)
 	}
+	if cfg.TargetKey != "id" {
+		if err := checkUniqueKey(ctx, targetReadPool, cfg.TargetKey); err != nil {
+			log.Fatal("Invalid -target-key:", err)
+		}
+	}
+	generatedAlways, err := idGeneratedAlways(ctx, targetReadPool)
+	if err != nil {
+		log.Fatal("Failed to read the target's id column:", err)
+	}
+	if generatedAlways {
+		stmts = withOverridingSystemValue(stmts)
+	}
+	if cfg.CreatedAt == "target-now" {
+		def, err := columnDefault(ctx, targetReadPool, "created_at")
+		if err != nil {
+			log.Fatal("Failed to read the target's created_at default:", err)
+		}
+		stmts = withTargetCreatedAt(stmts, def)
+	}
 
-	// Set up replication slot using wal2json plugin
-	slotName := "migration_slot"
-	var slotExists bool
-	checkSlotSQL := `SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)`
-	err = sourcePool.QueryRow(ctx, checkSlotSQL, slotName).Scan(&slotExists)
+	_, err = targetPool.Exec(ctx, createProgressTableSQL(cfg.progressTable()))
 	if err != nil {
-		log.Fatalf("Warning: Could not check if slot exists: %v", err)
+		log.Fatal("Failed to create progress table:", err)
+	}
+	if fanIn {
+		if _, err := targetPool.Exec(ctx, createSourcesTableSQL(cfg.sourcesTable())); err != nil {
+			log.Fatal("Failed to create sources table:", err)
+		}
 	}
 
-	if slotExists {
-		dropSlotSQL := `SELECT pg_drop_replication_slot($1)`
-		_, err = sourcePool.Exec(ctx, dropSlotSQL, slotName)
+	// Fan-out: every further -target-dsn is a shard with its own pool and
+	// tables, assumed to have the same schema as the first
+	shardPools := []*pgxpool.Pool{targetPool}
+	for i, dsn := range cfg.ShardDSNs {
+		pool, err := newPool(ctx, dsn, cfg, cfg.TargetSettings...)
 		if err != nil {
-			log.Fatalf("Warning: Could not drop existing slot: %v", err)
+			log.Fatalf("Failed to connect to target database %d: %v", i+2, err)
+		}
+		defer pool.Close()
+		for _, sql := range []string{stmts.createTable, createProgressTableSQL(cfg.progressTable())} {
+			if _, err := pool.Exec(ctx, sql); err != nil {
+				log.Fatalf("Failed to create tables on target database %d: %v", i+2, err)
+			}
 		}
+		shardPools = append(shardPools, pool)
 	}
 
-	createSlotSQL := `SELECT pg_create_logical_replication_slot($1, 'wal2json')`
-	_, err = sourcePool.Exec(ctx, createSlotSQL, slotName)
+	var guard *writeGuard
+	if cfg.TargetReadonlyGuard != "" {
+		guard, err = installWriteGuard(ctx, targetPool, cfg.ApplicationName, cfg.TargetReadonlyGuard == "halt")
+		if err != nil {
+			log.Fatal("Failed to install target write guard:", err)
+		}
+	}
+
+	capturer, err := openCapture(cfg.Capture)
 	if err != nil {
-		log.Fatalf("Warning: Could not create replication slot (might already exist): %v", err)
-	} else {
-		fmt.Printf("Created replication slot: %s\n", slotName)
+		log.Fatal("Failed to open capture file:", err)
 	}
+	defer capturer.Close()
 
-	// Bulk copy existing data
-	fmt.Println("\nStarting bulk copy of existing data...")
+	deadLetter, err := openCapture(cfg.DeadLetterFile)
+	if err != nil {
+		log.Fatal("Failed to open dead letter file:", err)
+	}
+	defer deadLetter.Close()
 
-	rows, err := sourcePool.Query(ctx, `
-		SELECT id, name, uid, score, created_at
-		FROM person
-		ORDER BY id`)
+	seen, err := newSeenChanges(cfg.SeenChanges, cfg.SeenChangesFile)
 	if err != nil {
-		log.Fatal("Failed to query source data:", err)
+		log.Fatal("Failed to load seen changes:", err)
 	}
-	defer rows.Close()
 
-	copiedCount := 0
-	batch := &pgx.Batch{}
+	var schema *schemaCache
+	if cfg.CheckColumnTypes {
+		schema = &schemaCache{pool: targetReadPool, interval: cfg.SchemaRefreshInterval}
+	}
+
+	enumLabels, err := parseEnumMaps(cfg.EnumMaps)
+	if err != nil {
+		log.Fatal("Invalid enum map:", err)
+	}
 
-	for rows.Next() {
-		var p Person
-		err := rows.Scan(&p.ID, &p.Name, &p.UID, &p.Score, &p.CreatedAt)
+	masker, err := newMasker(cfg.Masks, cfg.MaskKey)
+	if err != nil {
+		log.Fatal("Invalid mask configuration:", err)
+	}
+
+	var sink Sink
+	if cfg.Sink != "" {
+		sink, err = openSink(cfg)
 		if err != nil {
-			log.Printf("Failed to scan row: %v", err)
-			continue
+			log.Fatal("Failed to open sink:", err)
 		}
-
-		batch.Queue(`
-			INSERT INTO person (id, name, uid, score, created_at)
-			VALUES ($1, $2, $3, $4, $5)
-			ON CONFLICT (id) DO NOTHING`,
-			p.ID, p.Name, p.UID, p.Score, p.CreatedAt)
-		copiedCount++
-
-		// Execute batch every 100 rows
-		if batch.Len() >= 100 {
-			br := targetPool.SendBatch(ctx, batch)
-			if err := br.Close(); err != nil {
-				log.Printf("Failed to execute batch: %v", err)
+		if cfg.DedupeWindow > 0 {
+			window, err := newSeenChanges(cfg.DedupeWindow, cfg.DedupeWindowFile)
+			if err != nil {
+				log.Fatal("Failed to load dedupe window:", err)
 			}
-			batch = &pgx.Batch{}
+			sink = &dedupeSink{inner: sink, seen: window}
 		}
-	}
-	if batch.Len() > 0 {
-		br := targetPool.SendBatch(ctx, batch)
-		if err := br.Close(); err != nil {
-			log.Printf("Failed to execute final batch: %v", err)
+		if cfg.SinkBatchSize > 0 || cfg.SinkFlushInterval > 0 {
+			sink = newBatchSink(sink, cfg.SinkBatchSize, cfg.SinkFlushInterval)
 		}
+		defer sink.Close()
 	}
-	fmt.Printf("Bulk copied %d records\n", copiedCount)
 
-	// Update sequence to avoid conflicts
-	var maxID int
-	err = targetPool.QueryRow(ctx, "SELECT COALESCE(MAX(id), 0) FROM person").Scan(&maxID)
-	if err == nil && maxID > 0 {
-		_, err = targetPool.Exec(ctx, fmt.Sprintf("ALTER SEQUENCE person_id_seq RESTART WITH %d", maxID+1))
+	merge := false
+	if cfg.ApplyMode == "merge" {
+		var version int
+		err = targetPool.QueryRow(ctx, "SELECT current_setting('server_version_num')::int").Scan(&version)
 		if err != nil {
-			log.Printf("Warning: Could not update sequence: %v", err)
+			log.Fatal("Failed to get target server version:", err)
+		}
+		if version >= 150000 {
+			merge = true
+		} else {
+			log.Printf("Warning: MERGE needs Postgres 15 or later, target is %d; falling back to upsert", version)
 		}
 	}
 
-	// Poll for changes using pg_logical_slot_get_changes
-	fmt.Println("\nStarting CDC (Change Data Capture)...")
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
+	if cfg.TemporarySlot {
+		log.Print("Warning: -temporary-slot is dropped on exit; changes made while the replicator is down are lost and a restart starts over")
+	}
 
-	for range ticker.C {
-		// Get changes from replication slot
-		changesSQL := `
-		SELECT data::text
-		FROM pg_logical_slot_get_changes($1, NULL, NULL,
-			'format-version', '2',
-			'include-timestamp', 'true',
-			'include-transaction', 'false')`
+	var chaosMonkey *chaos
+	if cfg.Chaos > 0 {
+		log.Printf("WARNING: CHAOS MODE IS ON: injecting failures into %.0f%% of CDC statements. Never use this in production!", cfg.Chaos*100)
+		chaosMonkey = &chaos{probability: cfg.Chaos}
+	}
 
-		changeRows, err := sourcePool.Query(ctx, changesSQL, slotName)
+	var circuit *breaker
+	if cfg.BreakerFailures > 0 {
+		circuit = &breaker{threshold: cfg.BreakerFailures, window: cfg.BreakerWindow, cooldown: cfg.BreakerCooldown}
+	}
+
+	state := newManifest(cfg.Manifest, cfg)
+
+	watchdog := newLagWatchdog(cfg)
+
+	collector := newMetrics(streamLabels(cfg))
+	collector.breaker = circuit
+	collector.watchdog = watchdog
+	var readiness *health
+	if cfg.HealthAddr != "" {
+		readiness = newHealth(cfg)
+		readiness.breaker = circuit
+		go readiness.serve(cfg.HealthAddr, collector)
+	}
+	var gateway *pushGateway
+	if cfg.MetricsPushgateway != "" {
+		gateway, err = newPushGateway(cfg.MetricsPushgateway, cfg.SlotName, collector)
 		if err != nil {
-			log.Printf("Failed to get changes: %v", err)
-			continue
+			log.Fatal("Invalid -metrics-pushgateway:", err)
 		}
+	}
 
-		fmt.Println("ticker", time.Now().Format("15:04:05"))
+	// On SIGINT or SIGTERM stop polling but finish applying and checkpointing
+	// the changes already consumed. Past -drain-timeout, cancel in-flight
+	// statements instead. A second signal exits straight away.
+	stop, stopped := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopped()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-stop.Done()
+		stopped()
+	}()
+	go cancelAfterDrain(stop, cfg.DrainTimeout, cancel)
+
+	if guard != nil {
+		go guard.watch(ctx, cfg.MaxPoll)
+	}
+	if secrets != nil {
+		go secrets.watch(ctx)
+	}
+	if gateway != nil && cfg.MetricsPushInterval > 0 {
+		go gateway.pushEvery(ctx, cfg.MetricsPushInterval)
+	}
 
-		processedChanges := 0
-		for changeRows.Next() {
-			fmt.Println("processing change", processedChanges)
-			var changeData string
-			if err := changeRows.Scan(&changeData); err != nil {
-				log.Printf("Failed to scan change: %v", err)
-				continue
-			}
+	var hooks *snapshotHooks
+	if (cfg.PreSnapshotSQL != "" || cfg.PostSnapshotSQL != "") && !cfg.CDCOnly && !cfg.NoSnapshot {
+		hooks = &snapshotHooks{pool: targetPool, pre: cfg.PreSnapshotSQL, post: cfg.PostSnapshotSQL, pending: cfg.streams()}
+		hooks.before(ctx)
+	}
 
-			// Parse wal2json output (v2 format - single object per line)
-			var change WAL2JSONChange
-			if err := json.Unmarshal([]byte(changeData), &change); err != nil {
-				log.Printf("Failed to parse change JSON: %v", err)
-				continue
-			}
+	var wg sync.WaitGroup
+	for i, dsn := range cfg.SourceDSNs {
+		sourcePool, err := newPool(ctx, dsn, cfg)
+		if err != nil {
+			log.Fatalf("Failed to connect to source database %d: %v", i+1, err)
+		}
+		defer sourcePool.Close()
 
-			fmt.Printf("CDC change: action=%s, table=%s\n", change.Action, change.Table)
-			if change.Table != "person" {
-				continue
+		// Each source is a separate database, so the slot name can be shared
+		newReplicator := func(index int) *replicator {
+			return &replicator{cfg: cfg, slotName: cfg.SlotName, source: sourcePool, target: targetPool, targetRead: targetReadPool, sink: sink, masker: masker, stmts: stmts, merge: merge, chaos: chaosMonkey, health: readiness, sourceIndex: index, capture: capturer, deadLetter: deadLetter, schema: schema, metrics: collector, enumLabels: enumLabels, hooks: hooks, seen: seen, breaker: circuit, manifest: state, watchdog: watchdog, stop: stop.Done()}
+		}
+		var replicators []*replicator
+		switch {
+		case fanIn:
+			if err := registerSource(ctx, cfg, targetPool, sourcePool, cfg.SourceIDs[i]); err != nil {
+				log.Fatal("Invalid fan-in:", err)
 			}
-
-			switch change.Action {
-			case "I": // Insert
-				// Map column values
-				values := make(map[string]any)
-				for _, col := range change.Columns {
-					values[col.Name] = col.Value
-				}
-
-				// Insert into target
-				insertSQL := `
-						INSERT INTO person (id, name, uid, score, created_at)
-						VALUES ($1, $2, $3, $4, $5)
-						ON CONFLICT (id) DO UPDATE SET
-							name = EXCLUDED.name,
-							uid = EXCLUDED.uid,
-							score = EXCLUDED.score`
-
-				_, err = targetPool.Exec(ctx, insertSQL,
-					values["id"],
-					values["name"],
-					values["uid"],
-					values["score"],
-					values["created_at"])
-
-				if err != nil {
-					log.Printf("Failed to insert CDC record: %v", err)
-				} else {
-					fmt.Printf("CDC Insert: ID=%v, Name=%v\n", values["id"], values["name"])
-					processedChanges++
-				}
-
-			case "U": // Update
-				// Map column values
-				values := make(map[string]any)
-				for _, col := range change.Columns {
-					values[col.Name] = col.Value
-				}
-
-				// Update target
-				updateSQL := `
-						UPDATE person
-						SET name = $2, uid = $3, score = $4
-						WHERE id = $1`
-
-				_, err = targetPool.Exec(ctx, updateSQL,
-					values["id"],
-					values["name"],
-					values["uid"],
-					values["score"])
-
-				if err != nil {
-					log.Printf("Failed to update CDC record: %v", err)
-				} else {
-					fmt.Printf("CDC Update: ID=%v, Name=%v\n", values["id"], values["name"])
-					processedChanges++
-				}
-
-			case "D": // Delete
-				// Map identity values (primary key)
-				values := make(map[string]any)
-				for _, col := range change.Identity {
-					values[col.Name] = col.Value
-				}
-
-				// Delete from target
-				deleteSQL := `DELETE FROM person WHERE id = $1`
-				_, err = targetPool.Exec(ctx, deleteSQL, values["id"])
-
-				if err != nil {
-					log.Printf("Failed to delete CDC record: %v", err)
-				} else {
-					fmt.Printf("CDC Delete: ID=%v\n", values["id"])
-					processedChanges++
-				}
+			r := newReplicator(i)
+			r.sourceID = cfg.SourceIDs[i]
+			r.prefix = fmt.Sprintf("[source %d] ", r.sourceID)
+			replicators = append(replicators, r)
+		default:
+			r := newReplicator(i)
+			if len(shardPools) > 1 {
+				r.shards = r.newShards(shardPools)
 			}
+			replicators = append(replicators, r)
+		}
+		for _, r := range replicators {
+			wg.Add(1)
+			go func(r *replicator) {
+				defer wg.Done()
+				r.run(ctx)
+			}(r)
+		}
+	}
+	wg.Wait()
+	if gateway != nil {
+		if err := gateway.push(context.Background()); err != nil {
+			log.Printf("Warning: Failed to push final metrics: %v", err)
+		}
+	}
+	log.Print("Replication stopped, exiting")
+}
+
+// replicator copies and streams the person table from one source database
+// into the target. In fan-in mode several replicators share the target and
+// each tags its rows with its own sourceID.
+type replicator struct {
+	cfg      config
+	source   *pgxpool.Pool
+	target   *pgxpool.Pool
+	sink     Sink // nil unless -sink is set
+	masker   *masker
+	slotName string
+	sourceID int    // 0 unless running in fan-in mode
+	prefix   string // prepended to progress output in fan-in mode
+	stmts    statements
+	merge    bool   // apply inserts, updates and deletes with MERGE
+	chaos    *chaos // nil unless -chaos is set
+
+	slotConn *pgxpool.Conn // holds a -temporary-slot; nil otherwise
+
+	schema     *schemaCache // nil unless -check-column-types is set
+	deadLetter *capture     // nil unless -dead-letter-file is set
+
+	health      *health  // nil unless -health-addr is set
+	sourceIndex int      // position in -source-dsn
+	capture     *capture // nil unless -capture is set
+	metrics     *metrics // nil in -target-none mode
+
+	stop <-chan struct{} // closed on shutdown; nil in -target-none mode
+
+	enumLabels map[string]map[string]string // -enum-map: column to source label to target label
+	targetRead *pgxpool.Pool                // -target-read-dsn, or target; nil in -target-none mode
+
+	stats        *changeStats // set in -target-none mode, where nothing is applied
+	peekedCommit uint64       // commit LSN of the last transaction seen with -peek
+	advancedTo   string       // the slot's position after the last poll advancing it
+
+	snapshotMaxID int // highest id copied by the snapshot
+
+	partitions partitionRouter
+	hooks      *snapshotHooks // nil unless -pre-snapshot-sql or -post-snapshot-sql is set
+	seen       *seenChanges   // nil unless -seen-changes is set
+	breaker    *breaker       // nil unless -breaker-failures is set
+	manifest   *manifest      // nil unless -manifest is set
+	watchdog   *lagWatchdog   // nil unless -max-lag-exit is set
+	lastCommit time.Time      // commit time of the last applied change
+	txnXID     uint32         // source transaction of the last change read
+	txnChanges int            // changes read so far of txnXID
+	txnBegin   string         // with -sink-txn-markers, begin LSN of the transaction being read
+	txnMarked  bool           // whether the sink got the begin of that transaction
+
+	// warnedUnwatched is set once an update without old values was
+	// reported, atomically as relaxed order applies updates at once.
+	warnedUnwatched int32
+
+	unsupportedTypes map[string]bool // by wal2json type name, whether it has no decoder
+
+	shards []*replicator // one per -target-dsn when fanning out; nil otherwise
+}
+
+// cancelAfterDrain calls cancel once drain has passed since stop was done.
+func cancelAfterDrain(stop context.Context, drain time.Duration, cancel context.CancelFunc) {
+	<-stop.Done()
+	log.Printf("Shutting down, draining for up to %v", drain)
+	time.AfterFunc(drain, func() {
+		log.Print("Drain timeout passed, cancelling in-flight changes")
+		cancel()
+	})
+}
+
+// emit hands ev to the sink, if one is configured. Updates changing no
+// -watch-columns are applied to the target but kept from the sink.
+func (r *replicator) emit(ev Event) {
+	if r.sink == nil || ev.Op == "u" && !r.watchedChanged(ev.LSN, ev.Before, ev.After) {
+		return
+	}
+	ev.Database = r.source.Config().ConnConfig.Database
+	ev.Before = r.masker.apply(ev.Before)
+	ev.After = r.masker.apply(ev.After)
+	if r.cfg.SinkTxnMarkers && ev.LSN != "" && !r.txnMarked {
+		// Transactions without events for the sink are not marked
+		r.markTxn(Txn{XID: ev.XID, LSN: r.txnBegin}, false)
+		r.txnMarked = true
+	}
+	if err := r.sink.Emit(ev); err != nil {
+		log.Printf("%sFailed to emit change to sink: %v", r.prefix, err)
+	}
+}
+
+// markTxn hands the sink the begin or commit of txn.
+func (r *replicator) markTxn(txn Txn, commit bool) {
+	txn.Database = r.source.Config().ConnConfig.Database
+	if err := markTxn(r.sink, txn, commit); err != nil {
+		log.Printf("%sFailed to emit transaction marker to sink: %v", r.prefix, err)
+	}
+}
+
+// stopping reports whether shutdown has begun.
+func (r *replicator) stopping() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// debugf prints per-change output with -verbose.
+func (r *replicator) debugf(format string, args ...any) {
+	if r.cfg.Verbosity >= verbose {
+		r.printf(format, args...)
+	}
+}
+
+// tracef prints the SQL applied with -vv.
+func (r *replicator) tracef(format string, args ...any) {
+	if r.cfg.Verbosity >= veryVerbose {
+		r.printf(format, args...)
+	}
+}
+
+func (r *replicator) fanIn() bool {
+	return r.sourceID != 0
+}
+
+// Verbosity levels set by -quiet, -verbose and -vv. Warnings and errors are
+// logged at every level.
+const (
+	quiet       = -1 // no progress output
+	normal      = 0  // progress summaries
+	verbose     = 1  // every change
+	veryVerbose = 2  // every change and the SQL applying it
+)
+
+// printf prints progress output, keeping leading blank lines ahead of the
+// fan-in prefix. Nothing is printed with -quiet.
+func (r *replicator) printf(format string, args ...any) {
+	if r.cfg.Verbosity < normal {
+		return
+	}
+	trimmed := strings.TrimLeft(format, "\n")
+	fmt.Print(format[:len(format)-len(trimmed)])
+	fmt.Printf(r.prefix+trimmed, args...)
+}
+
+// args prepends the source id in fan-in mode, where every statement takes
+// source_id as its first parameter.
+func (r *replicator) args(args ...any) []any {
+	if !r.fanIn() {
+		return args
+	}
+	return append([]any{r.sourceID}, args...)
+}
+
+// statements holds the SQL used to create and apply changes to the target.
+type statements struct {
+	createTable    string
+	snapshotInsert string
+	insert         string
+	update         string
+	delete         string
+
+	// Used instead of insert, update and delete with -apply-mode merge.
+	merge       string
+	mergeDelete string
+}
+
+var singleSourceStatements = statements{
+	createTable: `
+		CREATE TABLE IF NOT EXISTS person (
+			id SERIAL PRIMARY KEY,
+			name VARCHAR(100) NOT NULL,
+			uid UUID NOT NULL,
+			score INTEGER NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);`,
+	snapshotInsert: `
+		INSERT INTO person (id, name, uid, score, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO NOTHING`,
+	insert: `
+		INSERT INTO person (id, name, uid, score, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO UPDATE SET
+			name = EXCLUDED.name,
+			uid = EXCLUDED.uid,
+			score = EXCLUDED.score`,
+	update: `
+		UPDATE person
+		SET name = $2, uid = $3, score = $4
+		WHERE id = $1`,
+	delete: `DELETE FROM person WHERE id = $1`,
+	merge: `
+		MERGE INTO person t
+		USING (VALUES ($1::integer, $2::varchar, $3::uuid, $4::integer, $5::timestamp))
+			AS s (id, name, uid, score, created_at)
+		ON t.id = s.id
+		WHEN MATCHED THEN UPDATE SET
+			name = s.name,
+			uid = s.uid,
+			score = s.score
+		WHEN NOT MATCHED THEN
+			INSERT (id, name, uid, score, created_at)
+			VALUES (s.id, s.name, s.uid, s.score, s.created_at)`,
+	mergeDelete: `
+		MERGE INTO person t
+		USING (VALUES ($1::integer)) AS s (id)
+		ON t.id = s.id
+		WHEN MATCHED THEN DELETE`,
+}
+
+// fanInStatements take source_id as their first parameter. Source ids may
+// collide, so the target is keyed by (source_id, id).
+var fanInStatements = statements{
+	createTable: `
+		CREATE TABLE IF NOT EXISTS person (
+			source_id INTEGER NOT NULL,
+			id INTEGER NOT NULL,
+			name VARCHAR(100) NOT NULL,
+			uid UUID NOT NULL,
+			score INTEGER NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (source_id, id)
+		);`,
+	snapshotInsert: `
+		INSERT INTO person (source_id, id, name, uid, score, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (source_id, id) DO NOTHING`,
+	insert: `
+		INSERT INTO person (source_id, id, name, uid, score, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (source_id, id) DO UPDATE SET
+			name = EXCLUDED.name,
+			uid = EXCLUDED.uid,
+			score = EXCLUDED.score`,
+	update: `
+		UPDATE person
+		SET name = $3, uid = $4, score = $5
+		WHERE source_id = $1 AND id = $2`,
+	delete: `DELETE FROM person WHERE source_id = $1 AND id = $2`,
+	merge: `
+		MERGE INTO person t
+		USING (VALUES ($1::integer, $2::integer, $3::varchar, $4::uuid, $5::integer, $6::timestamp))
+			AS s (source_id, id, name, uid, score, created_at)
+		ON t.source_id = s.source_id AND t.id = s.id
+		WHEN MATCHED THEN UPDATE SET
+			name = s.name,
+			uid = s.uid,
+			score = s.score
+		WHEN NOT MATCHED THEN
+			INSERT (source_id, id, name, uid, score, created_at)
+			VALUES (s.source_id, s.id, s.name, s.uid, s.score, s.created_at)`,
+	mergeDelete: `
+		MERGE INTO person t
+		USING (VALUES ($1::integer, $2::integer)) AS s (source_id, id)
+		ON t.source_id = s.source_id AND t.id = s.id
+		WHEN MATCHED THEN DELETE`,
+}
+
+// jsonbStatements land each row as a single jsonb document next to its id,
+// so source schema changes need no target DDL. Updates replace the whole
+// document.
+var jsonbStatements = statements{
+	createTable: `
+		CREATE TABLE IF NOT EXISTS person (
+			id INTEGER PRIMARY KEY,
+			data JSONB NOT NULL
+		);`,
+	snapshotInsert: `
+		INSERT INTO person (id, data)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO NOTHING`,
+	insert: `
+		INSERT INTO person (id, data)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data`,
+	update: `
+		INSERT INTO person (id, data)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data`,
+	delete: `DELETE FROM person WHERE id = $1`,
+}
+
+// appendStatements never update or delete target rows: every change is a new
+// row under the target's own seq key, tagged with its op ("r" for snapshot
+// rows) and source LSN for ordering.
+var appendStatements = statements{
+	createTable: `
+		CREATE TABLE IF NOT EXISTS person (
+			seq BIGSERIAL PRIMARY KEY,
+			id INTEGER NOT NULL,
+			name VARCHAR(100),
+			uid UUID,
+			score INTEGER,
+			created_at TIMESTAMP,
+			op CHAR(1) NOT NULL,
+			source_lsn PG_LSN
+		);`,
+	snapshotInsert: `
+		INSERT INTO person (id, name, uid, score, created_at, op)
+		VALUES ($1, $2, $3, $4, $5, 'r')`,
+	insert: `
+		INSERT INTO person (id, name, uid, score, created_at, op, source_lsn)
+		VALUES ($1, $2, $3, $4, $5, 'c', $6::pg_lsn)`,
+	update: `
+		INSERT INTO person (id, name, uid, score, created_at, op, source_lsn)
+		VALUES ($1, $2, $3, $4, $5, 'u', $6::pg_lsn)`,
+	delete: `
+		INSERT INTO person (id, op, source_lsn)
+		VALUES ($1, 'd', $2::pg_lsn)`,
+}
+
+func statementsFor(cfg config, fanIn bool) statements {
+	var stmts statements
+	switch {
+	case cfg.AppendOnly:
+		return appendStatements
+	case cfg.RowAsJSONB:
+		stmts = jsonbStatements
+	case fanIn:
+		stmts = fanInStatements
+	case cfg.TargetKey != "id" || len(cfg.NoUpdateColumns) > 0 || cfg.Annotate || cfg.SoftDelete != "":
+		stmts = keyedStatements(cfg)
+	default:
+		stmts = singleSourceStatements
+	}
+	return withInsertConflict(stmts, cfg.InsertConflict)
+}
+
+// withInsertConflict makes the snapshot and CDC inserts resolve a conflict on
+// the key the same way, as -insert-conflict asks: do-update overwrites the
+// existing row as CDC inserts do, do-nothing keeps it as snapshot inserts do.
+// Both take their conflict target and update from stmts.insert. Without a
+// policy, stmts keeps snapshot inserts keeping and CDC inserts overwriting.
+func withInsertConflict(stmts statements, policy string) statements {
+	insert, onConflict, _ := strings.Cut(stmts.insert, "ON CONFLICT")
+	snapshotInsert, _, _ := strings.Cut(stmts.snapshotInsert, "ON CONFLICT")
+	target, _, _ := strings.Cut(onConflict, " DO ")
+	switch policy {
+	case "do-update":
+		stmts.snapshotInsert = snapshotInsert + "ON CONFLICT" + onConflict
+	case "do-nothing":
+		stmts.insert = insert + "ON CONFLICT" + target + " DO NOTHING"
+		stmts.snapshotInsert = snapshotInsert + "ON CONFLICT" + target + " DO NOTHING"
+	}
+	return stmts
+}
+
+// run replicates from r.source. The slot is created before the snapshot is
+// read, so it holds every change committed after the snapshot started; with
+// -snapshot-only it is kept for a later -cdc-only run to continue from
+// without a gap. Changes overlapping the snapshot are reapplied idempotently.
+func (r *replicator) run(ctx context.Context) {
+	defer r.releaseSlotConn()
+	r.checkReplicaIdentity(ctx)
+	r.checkShards(ctx)
+	r.checkTargetKey(ctx)
+	switch {
+	case r.cfg.BootstrapDump != "":
+		r.attachSlot(ctx)
+		r.bootstrap(ctx)
+		r.syncSequence(ctx)
+		r.hooks.finished(ctx)
+	case r.cfg.ResyncTable != "":
+		r.attachSlot(ctx)
+		r.resync(ctx)
+		r.hooks.finished(ctx)
+	case r.cfg.CDCOnly:
+		r.attachSlot(ctx)
+	case r.cfg.AttachSlot:
+		r.attachSlot(ctx)
+		if r.attachedSlotNeedsSnapshot(ctx) {
+			r.snapshot(ctx)
+			r.syncSequence(ctx)
 		}
-		changeRows.Close()
+		r.hooks.finished(ctx)
+	case r.cfg.NoSnapshot:
+		r.createSlot(ctx)
+		r.logConsistentPoint(ctx)
+		log.Printf("%sWarning: -no-snapshot: rows already on the source are not copied; only changes from here on are applied", r.prefix)
+		r.syncSequence(ctx)
+	default:
+		r.createSlot(ctx)
+		r.snapshot(ctx)
+		r.syncSequence(ctx)
+		r.hooks.finished(ctx)
+	}
+	r.manifest.update(r.sourceIndex, func(s *manifestSource) {
+		s.Database = r.source.Config().ConnConfig.Database
+		s.SnapshotComplete = true
+	})
+	if r.cfg.SnapshotOnly {
+		r.printf("Snapshot done, keeping slot %s for -cdc-only\n", r.slotName)
+		return
+	}
+	err := r.stream(ctx)
+	if r.cfg.DropSlotOnExit {
+		r.dropSlotOnExit(ctx, err)
+	}
+}
 
-		if processedChanges > 0 {
-			fmt.Printf("Processed %d CDC changes\n", processedChanges)
+// values maps wal2json columns by name to their decoded values, relabelling
+// enum values according to -enum-map.
+func (r *replicator) values(cols []WAL2JSONColumn) map[string]any {
+	values := columnValues(cols)
+	for column, labels := range r.enumLabels {
+		if s, ok := values[column].(string); ok {
+			if to, ok := labels[s]; ok {
+				values[column] = to
+			}
 		}
 	}
+	return values
+}
+
+// columnValues maps wal2json columns by name to their decoded values.
+func columnValues(cols []WAL2JSONColumn) map[string]any {
+	values := make(map[string]any, len(cols))
+	for _, col := range cols {
+		values[col.Name] = decodeValue(col)
+	}
+	return values
+}
+
+func changeEvent(op string, change WAL2JSONChange, before, after map[string]any) Event {
+	return Event{
+		Op:        op,
+		Schema:    change.Schema,
+		Table:     change.Table,
+		Before:    before,
+		After:     after,
+		LSN:       change.LSN,
+		XID:       change.XID,
+		Timestamp: change.Timestamp,
+	}
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWithInsertConflict(t *testing.T) {
+	tests := []struct {
+		policy               string
+		snapshot, cdcInserts string
+	}{
+		{"", "ON CONFLICT (id) DO NOTHING", "ON CONFLICT (id) DO UPDATE SET"},
+		{"do-nothing", "ON CONFLICT (id) DO NOTHING", "ON CONFLICT (id) DO NOTHING"},
+		{"do-update", "ON CONFLICT (id) DO UPDATE SET", "ON CONFLICT (id) DO UPDATE SET"},
+	}
+	for _, tt := range tests {
+		stmts := statementsFor(config{TargetKey: "id", InsertConflict: tt.policy}, false)
+		if !strings.Contains(stmts.snapshotInsert, tt.snapshot) {
+			t.Errorf("policy %q: snapshot insert %q, want %s", tt.policy, stmts.snapshotInsert, tt.snapshot)
+		}
+		if !strings.Contains(stmts.insert, tt.cdcInserts) {
+			t.Errorf("policy %q: CDC insert %q, want %s", tt.policy, stmts.insert, tt.cdcInserts)
+		}
+		if strings.Count(stmts.snapshotInsert, "ON CONFLICT") != 1 || strings.Count(stmts.insert, "ON CONFLICT") != 1 {
+			t.Errorf("policy %q: want exactly one ON CONFLICT per insert", tt.policy)
+		}
+	}
+}
+
+func TestWithInsertConflictFanIn(t *testing.T) {
+	stmts := statementsFor(config{TargetKey: "id", InsertConflict: "do-update"}, true)
+	if !strings.Contains(stmts.snapshotInsert, "ON CONFLICT (source_id, id) DO UPDATE SET") {
+		t.Errorf("fan-in snapshot insert %q does not update on (source_id, id)", stmts.snapshotInsert)
+	}
+}
+
+func TestAppendStatementsOnlyInsert(t *testing.T) {
+	stmts := statementsFor(config{AppendOnly: true, TargetKey: "id", InsertConflict: "do-update"}, false)
+	for name, sql := range map[string]string{"snapshot insert": stmts.snapshotInsert, "insert": stmts.insert, "update": stmts.update, "delete": stmts.delete} {
+		if !strings.HasPrefix(strings.TrimSpace(sql), "INSERT INTO person") || strings.Contains(sql, "ON CONFLICT") {
+			t.Errorf("append-only %s %q, want a plain insert", name, sql)
+		}
+	}
+}
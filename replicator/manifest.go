@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// manifest is the -manifest file: a JSON document describing the state of
+// the replication for external orchestration to poll instead of scraping the
+// logs. It is rewritten atomically whenever a source finishes its snapshot or
+// checkpoints. It is shared by all sources and a nil manifest writes nothing.
+type manifest struct {
+	mu    sync.Mutex
+	path  string
+	state manifestState
+}
+
+type manifestState struct {
+	Slot      string           `json:"slot"`
+	Tables    []string         `json:"tables"`
+	Sources   []manifestSource `json:"sources"`
+	UpdatedAt time.Time        `json:"updated_at"`
+}
+
+type manifestSource struct {
+	Source           int        `json:"source"`
+	Database         string     `json:"database"`
+	SnapshotComplete bool       `json:"snapshot_complete"`
+	AppliedLSN       string     `json:"applied_lsn,omitempty"`
+	LastCheckpoint   *time.Time `json:"last_checkpoint,omitempty"`
+}
+
+// newManifest returns the manifest written to path for cfg, or nil if path
+// is empty.
+func newManifest(path string, cfg config) *manifest {
+	if path == "" {
+		return nil
+	}
+	m := &manifest{path: path, state: manifestState{Slot: cfg.SlotName, Tables: []string{"public.person"}}}
+	for i := range cfg.SourceDSNs {
+		m.state.Sources = append(m.state.Sources, manifestSource{Source: i + 1})
+	}
+	return m
+}
+
+// update applies f to the state of source i and rewrites the file.
+func (m *manifest) update(i int, f func(*manifestSource)) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f(&m.state.Sources[i])
+	m.state.UpdatedAt = time.Now().UTC()
+	b, err := json.MarshalIndent(m.state, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(m.path, append(b, '\n'))
+	}
+	if err != nil {
+		log.Printf("Warning: Could not write manifest: %v", err)
+	}
+}
+
+// writeFileAtomic replaces path with b, so that readers never see a partly
+// written file.
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// masker rewrites sensitive columns before changes are handed to a sink.
+// Rules map a column name to one of "hash", "redact" or "encrypt".
+type masker struct {
+	rules   map[string]string
+	aead    cipher.AEAD // set when any rule uses encrypt
+	hashKey []byte      // set when any rule uses hash
+}
+
+// newMasker parses -mask specs of the form column=mode. key is hex encoded:
+// the HMAC key of the hash mode, which a plain digest of a guessable value
+// such as a name would not protect, and the AES key (16, 24 or 32 bytes) of
+// the encrypt mode.
+func newMasker(specs []string, key string) (*masker, error) {
+	m := &masker{rules: make(map[string]string)}
+	for _, spec := range specs {
+		column, mode, ok := strings.Cut(spec, "=")
+		if !ok || column == "" {
+			return nil, fmt.Errorf("invalid mask %q, want column=mode", spec)
+		}
+		switch mode {
+		case "redact":
+		case "hash":
+			b, err := hex.DecodeString(key)
+			if err != nil {
+				return nil, fmt.Errorf("-mask-key must be hex encoded: %w", err)
+			}
+			if len(b) == 0 {
+				return nil, fmt.Errorf("-mask %s=hash needs -mask-key", column)
+			}
+			m.hashKey = b
+		case "encrypt":
+			if m.aead == nil {
+				aead, err := newAEAD(key)
+				if err != nil {
+					return nil, err
+				}
+				m.aead = aead
+			}
+		default:
+			return nil, fmt.Errorf("unknown mask mode %q for column %s", mode, column)
+		}
+		m.rules[column] = mode
+	}
+	return m, nil
+}
+
+func newAEAD(key string) (cipher.AEAD, error) {
+	b, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("-mask-key must be hex encoded: %w", err)
+	}
+	block, err := aes.NewCipher(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -mask-key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// apply returns a copy of values with the masked columns rewritten.
+func (m *masker) apply(values map[string]any) map[string]any {
+	if values == nil || len(m.rules) == 0 {
+		return values
+	}
+	masked := make(map[string]any, len(values))
+	for name, v := range values {
+		mode, ok := m.rules[name]
+		if !ok || v == nil {
+			masked[name] = v
+			continue
+		}
+		switch mode {
+		case "hash":
+			mac := hmac.New(sha256.New, m.hashKey)
+			fmt.Fprint(mac, v)
+			masked[name] = hex.EncodeToString(mac.Sum(nil))
+		case "redact":
+			masked[name] = redact(v)
+		case "encrypt":
+			masked[name] = m.encrypt(v)
+		}
+	}
+	return masked
+}
+
+// redact replaces v with a placeholder of a compatible type where possible.
+func redact(v any) any {
+	switch v.(type) {
+	case int, int32, int64, float64:
+		return 0
+	case bool:
+		return false
+	default:
+		return "***"
+	}
+}
+
+// encrypt seals the JSON encoding of v and returns base64(nonce|ciphertext).
+func (m *masker) encrypt(v any) any {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return "***"
+	}
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "***"
+	}
+	return base64.StdEncoding.EncodeToString(m.aead.Seal(nonce, nonce, plain, nil))
+}
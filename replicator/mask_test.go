@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+const testMaskKey = "000102030405060708090a0b0c0d0e0f"
+
+func TestMaskHash(t *testing.T) {
+	m, err := newMasker([]string{"name=hash"}, testMaskKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := hex.DecodeString(testMaskKey)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("Ada"))
+	want := hex.EncodeToString(mac.Sum(nil))
+	if got := m.apply(map[string]any{"name": "Ada"})["name"]; got != want {
+		t.Errorf("hash = %v, want HMAC-SHA256 %s", got, want)
+	}
+	plain := sha256.Sum256([]byte("Ada"))
+	if got := m.apply(map[string]any{"name": "Ada"})["name"]; got == hex.EncodeToString(plain[:]) {
+		t.Error("hash is the unkeyed SHA-256")
+	}
+
+	other, err := newMasker([]string{"name=hash"}, "0f0e0d0c0b0a09080706050403020100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.apply(map[string]any{"name": "Ada"})["name"] == want {
+		t.Error("hashes under different keys are equal")
+	}
+}
+
+func TestMaskRedact(t *testing.T) {
+	m, err := newMasker([]string{"name=redact", "score=redact", "active=redact", "ratio=redact"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := m.apply(map[string]any{"name": "Ada", "score": int64(7), "active": true, "ratio": 0.5})
+	want := map[string]any{"name": "***", "score": 0, "active": false, "ratio": 0}
+	for col, w := range want {
+		if got[col] != w {
+			t.Errorf("%s redacted to %#v, want %#v", col, got[col], w)
+		}
+	}
+}
+
+func TestMaskEncrypt(t *testing.T) {
+	m, err := newMasker([]string{"name=encrypt"}, testMaskKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(m.apply(map[string]any{"name": "Ada"})["name"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := m.aead.NonceSize()
+	plain, err := m.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var name string
+	if err := json.Unmarshal(plain, &name); err != nil || name != "Ada" {
+		t.Errorf("decrypted %q, %v, want Ada", name, err)
+	}
+}
+
+func TestMaskNull(t *testing.T) {
+	m, err := newMasker([]string{"name=hash", "uid=redact", "score=encrypt"}, testMaskKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := m.apply(map[string]any{"name": nil, "uid": nil, "score": nil})
+	for col, v := range got {
+		if v != nil {
+			t.Errorf("NULL %s masked to %#v", col, v)
+		}
+	}
+	if m.apply(nil) != nil {
+		t.Error("no values masked to some")
+	}
+}
+
+func TestMaskPartial(t *testing.T) {
+	m, err := newMasker([]string{"name=redact"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]any{"id": 1, "name": "Ada", "score": 7}
+	got := m.apply(values)
+	if got["id"] != 1 || got["score"] != 7 || got["name"] != "***" {
+		t.Errorf("masked %v, want only name redacted", got)
+	}
+	if values["name"] != "Ada" {
+		t.Error("apply changed the values it was given, which the target still needs")
+	}
+	if _, ok := got["uid"]; ok {
+		t.Error("apply added a column")
+	}
+}
+
+func TestNewMaskerErrors(t *testing.T) {
+	tests := []struct {
+		specs []string
+		key   string
+	}{
+		{[]string{"name"}, ""},
+		{[]string{"=hash"}, testMaskKey},
+		{[]string{"name=scramble"}, ""},
+		{[]string{"name=hash"}, ""},
+		{[]string{"name=hash"}, "not hex"},
+		{[]string{"name=encrypt"}, ""},
+		{[]string{"name=encrypt"}, "0102"},
+	}
+	for _, tt := range tests {
+		if _, err := newMasker(tt.specs, tt.key); err == nil {
+			t.Errorf("newMasker(%q, %q): no error", tt.specs, tt.key)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metrics collects the replicator's metrics and renders them in the
+// Prometheus text format on /metrics of -health-addr. It is shared by all
+// sources and a nil metrics records nothing.
+type metrics struct {
+	mu           sync.Mutex
+	applyLatency histogram
+	labels       []string              // Prometheus labels by source index
+	pollInterval map[int]time.Duration // by source index
+	snapshotRows map[int][2]uint64     // written and skipped, by source index
+	tableBytes   map[string]uint64     // by schema.table
+	tableChanges map[string]uint64     // by schema.table
+	breaker      *breaker              // nil unless -breaker-failures is set
+	watchdog     *lagWatchdog          // nil unless -max-lag-exit is set
+}
+
+func newMetrics(labels []string) *metrics {
+	return &metrics{
+		labels:       labels,
+		applyLatency: newHistogram(0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 300),
+		pollInterval: make(map[int]time.Duration),
+		snapshotRows: make(map[int][2]uint64),
+		tableBytes:   make(map[string]uint64),
+		tableChanges: make(map[string]uint64),
+	}
+}
+
+// setPollInterval records the current adaptive poll interval of source i.
+func (m *metrics) setPollInterval(i int, interval time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pollInterval[i] = interval
+}
+
+// addSnapshotRows records the rows source i's snapshot wrote to the target,
+// and those it skipped as already there.
+func (m *metrics) addSnapshotRows(i int, written, skipped int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := m.snapshotRows[i]
+	rows[0] += uint64(written)
+	rows[1] += uint64(skipped)
+	m.snapshotRows[i] = rows
+}
+
+// observeApplied records the end-to-end latency of an applied change: the
+// time from its commit on the source, as reported by wal2json, until now.
+func (m *metrics) observeApplied(change WAL2JSONChange, now time.Time) {
+	if m == nil || change.Timestamp == "" {
+		return
+	}
+	committed, err := parseTimestamp(change.Timestamp)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applyLatency.observe(now.Sub(committed).Seconds())
+}
+
+// observeDecoded records a change read from a slot and the size of its
+// wal2json payload in bytes, whether or not it is then applied.
+func (m *metrics) observeDecoded(change WAL2JSONChange, size int) {
+	if m == nil {
+		return
+	}
+	table := change.Schema + "." + change.Table
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tableBytes[table] += uint64(size)
+	m.tableChanges[table]++
+}
+
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applyLatency.write(w, "cdc_apply_latency_seconds", "Time from source commit until the change was applied to the target.")
+
+	fmt.Fprintf(w, "# HELP cdc_poll_interval_seconds Current adaptive interval between polls of the slot.\n# TYPE cdc_poll_interval_seconds gauge\n")
+	sources := make([]int, 0, len(m.pollInterval))
+	for i := range m.pollInterval {
+		sources = append(sources, i)
+	}
+	sort.Ints(sources)
+	for _, i := range sources {
+		fmt.Fprintf(w, "cdc_poll_interval_seconds{%s} %g\n", m.labels[i], m.pollInterval[i].Seconds())
+	}
+
+	fmt.Fprintf(w, "# HELP cdc_snapshot_rows_total Rows copied by the snapshot, by whether they were written or skipped as already on the target.\n# TYPE cdc_snapshot_rows_total counter\n")
+	sources = sources[:0]
+	for i := range m.snapshotRows {
+		sources = append(sources, i)
+	}
+	sort.Ints(sources)
+	for _, i := range sources {
+		fmt.Fprintf(w, "cdc_snapshot_rows_total{%s,result=\"written\"} %d\n", m.labels[i], m.snapshotRows[i][0])
+		fmt.Fprintf(w, "cdc_snapshot_rows_total{%s,result=\"skipped\"} %d\n", m.labels[i], m.snapshotRows[i][1])
+	}
+
+	fmt.Fprintf(w, "# HELP cdc_breaker_state State of the apply circuit breaker: 0 closed, 1 half-open, 2 open.\n# TYPE cdc_breaker_state gauge\n")
+	fmt.Fprintf(w, "cdc_breaker_state %d\n", m.breaker.current())
+
+	if over := m.watchdog.overFor(); over != nil {
+		fmt.Fprintf(w, "# HELP cdc_lag_over_threshold_seconds How long the source's lag has stayed over -max-lag-exit.\n# TYPE cdc_lag_over_threshold_seconds gauge\n")
+		for i, d := range over {
+			fmt.Fprintf(w, "cdc_lag_over_threshold_seconds{%s} %g\n", m.labels[i], d.Seconds())
+		}
+	}
+
+	tables := make([]string, 0, len(m.tableBytes))
+	for table := range m.tableBytes {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	fmt.Fprintf(w, "# HELP cdc_bytes_processed_total Size of the wal2json payloads read from the slots.\n# TYPE cdc_bytes_processed_total counter\n")
+	for _, table := range tables {
+		fmt.Fprintf(w, "cdc_bytes_processed_total{table=%q} %d\n", table, m.tableBytes[table])
+	}
+	fmt.Fprintf(w, "# HELP cdc_average_row_bytes Average wal2json payload size of a change.\n# TYPE cdc_average_row_bytes gauge\n")
+	for _, table := range tables {
+		fmt.Fprintf(w, "cdc_average_row_bytes{table=%q} %g\n", table, float64(m.tableBytes[table])/float64(m.tableChanges[table]))
+	}
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// histogram is a cumulative histogram over fixed upper bounds.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // counts[i] is the number of observations <= bounds[i]
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) histogram {
+	return histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObserveAppliedLatency(t *testing.T) {
+	m := newMetrics(nil)
+	committed := "2024-03-05 14:30:15.000000+00"
+	at := time.Date(2024, 3, 5, 14, 30, 15, 0, time.UTC)
+	m.observeApplied(WAL2JSONChange{Timestamp: committed}, at.Add(30*time.Millisecond))
+	m.observeApplied(WAL2JSONChange{Timestamp: committed}, at.Add(2*time.Second))
+	m.observeApplied(WAL2JSONChange{Timestamp: committed}, at.Add(10*time.Minute))
+	m.observeApplied(WAL2JSONChange{}, at)                                   // no commit time, e.g. a snapshot row
+	m.observeApplied(WAL2JSONChange{Timestamp: "infinity"}, at)              // unparseable
+	(*metrics)(nil).observeApplied(WAL2JSONChange{Timestamp: committed}, at) // metrics off
+
+	var out strings.Builder
+	m.write(&out)
+	for _, want := range []string{
+		"# TYPE cdc_apply_latency_seconds histogram\n",
+		`cdc_apply_latency_seconds_bucket{le="0.01"} 0` + "\n",
+		`cdc_apply_latency_seconds_bucket{le="0.05"} 1` + "\n",
+		`cdc_apply_latency_seconds_bucket{le="1"} 1` + "\n",
+		`cdc_apply_latency_seconds_bucket{le="2.5"} 2` + "\n",
+		`cdc_apply_latency_seconds_bucket{le="300"} 2` + "\n",
+		`cdc_apply_latency_seconds_bucket{le="+Inf"} 3` + "\n",
+		"cdc_apply_latency_seconds_sum 602.03\n",
+		"cdc_apply_latency_seconds_count 3\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics missing %q in\n%s", want, out.String())
+		}
+	}
+}
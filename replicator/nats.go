@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsAckTimeout bounds how long Flush waits for JetStream to acknowledge the
+// published events.
+const natsAckTimeout = 10 * time.Second
+
+// natsSink publishes every event to a NATS JetStream stream on the subject
+// <-nats-subject>.<table>.<id>, so that consumers can keep the changes to one
+// row in order by subscribing per subject; an event without an id is refused
+// rather than published on a subject shared by all such rows. It speaks the
+// NATS client protocol directly. CDC events carry a Nats-Msg-Id header
+// derived from their LSN, so JetStream drops events published again after a
+// crash within its duplicate window. Each publish asks for an
+// acknowledgement; Flush waits for all of them, so progress is only recorded
+// past events the stream has stored. A failed publish fails every later
+// Flush; restart to resume from the last recorded progress.
+type natsSink struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	w        *bufio.Writer
+	subject  string
+	inbox    string
+	envelope string
+
+	acks    sync.Cond // signalled with mu held whenever pending shrinks or err is set
+	next    int
+	pending map[string]bool // by reply token
+	err     error
+}
+
+// natsAck is JetStream's reply to a publish, of which only errors matter.
+type natsAck struct {
+	Error *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+func openNATSSink(rawURL, subject, envelope string) (*natsSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" {
+		return nil, fmt.Errorf("unsupported NATS URL scheme %q, want nats://", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	conn, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading NATS INFO: %w", err)
+	}
+	var info struct {
+		Headers     bool `json:"headers"`
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "INFO ")), &info); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("parsing NATS INFO: %w", err)
+	}
+	if info.TLSRequired || !info.Headers {
+		conn.Close()
+		return nil, errors.New("the NATS server requires TLS or does not support headers, neither of which the sink handles")
+	}
+
+	connect := map[string]any{"verbose": false, "pedantic": false, "headers": true, "no_responders": true, "lang": "go", "name": "cdc-replicator", "protocol": 1}
+	if u.User != nil {
+		connect["user"] = u.User.Username()
+		if pass, ok := u.User.Password(); ok {
+			connect["pass"] = pass
+		}
+	}
+	b, err := json.Marshal(connect)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s := &natsSink{conn: conn, w: bufio.NewWriter(conn), subject: subject, inbox: "_INBOX." + hex.EncodeToString(token), envelope: envelope, pending: make(map[string]bool)}
+	s.acks.L = &s.mu
+	fmt.Fprintf(s.w, "CONNECT %s\r\nPING\r\nSUB %s.* 1\r\n", b, s.inbox)
+	if err := s.w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The PONG confirms the CONNECT was accepted; errors arrive before it
+	line, err = r.ReadString('\n')
+	for err == nil && strings.HasPrefix(line, "INFO ") {
+		line, err = r.ReadString('\n')
+	}
+	if err == nil && !strings.HasPrefix(line, "PONG") {
+		err = fmt.Errorf("NATS server replied %s", strings.TrimSpace(line))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go s.read(r)
+	return s, nil
+}
+
+// natsSubjectToken returns v as a single subject token: dots, spaces and
+// wildcards would split it or change its meaning.
+func natsSubjectToken(v any) string {
+	return strings.NewReplacer(".", "_", " ", "_", "*", "_", ">", "_").Replace(fmt.Sprint(v))
+}
+
+func (s *natsSink) Emit(ev Event) error {
+	b, err := encodeEvent(ev, s.envelope)
+	if err != nil {
+		return err
+	}
+	id := ev.After["id"]
+	if id == nil {
+		id = ev.Before["id"]
+	}
+	if id == nil {
+		return fmt.Errorf("%s event at %s has no id to publish it under", ev.Op, ev.LSN)
+	}
+	subject := s.subject + "." + natsSubjectToken(ev.Table) + "." + natsSubjectToken(id)
+	msgID := ""
+	if ev.LSN != "" {
+		msgID = dedupeKey(ev)
+	}
+	return s.publish(subject, msgID, b)
+}
+
+// Begin and Commit publish transaction markers on <-nats-subject>.txn.<xid>.
+func (s *natsSink) Begin(txn Txn) error {
+	return s.publishTxn(txn, false)
+}
+
+func (s *natsSink) Commit(txn Txn) error {
+	return s.publishTxn(txn, true)
+}
+
+func (s *natsSink) publishTxn(txn Txn, commit bool) error {
+	b, err := encodeTxn(txn, commit, s.envelope)
+	if err != nil {
+		return err
+	}
+	subject := s.subject + ".txn." + natsSubjectToken(txn.XID)
+	return s.publish(subject, txnKey(txn, commit), b)
+}
+
+// publish publishes b on subject, with a Nats-Msg-Id header unless msgID is
+// empty, and asks for an acknowledgement.
+func (s *natsSink) publish(subject, msgID string, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.next++
+	reply := strconv.Itoa(s.next)
+	s.pending[reply] = true
+	headers := "NATS/1.0\r\n"
+	if msgID != "" {
+		headers += "Nats-Msg-Id: " + msgID + "\r\n"
+	}
+	headers += "\r\n"
+	fmt.Fprintf(s.w, "HPUB %s %s.%s %d %d\r\n%s%s\r\n", subject, s.inbox, reply, len(headers), len(headers)+len(b), headers, b)
+	return nil
+}
+
+func (s *natsSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		if err := s.w.Flush(); err != nil {
+			s.err = err
+		}
+	}
+	timeout := time.AfterFunc(natsAckTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(s.pending) > 0 && s.err == nil {
+			s.err = fmt.Errorf("%d publishes not acknowledged within %v", len(s.pending), natsAckTimeout)
+		}
+		s.acks.Broadcast()
+	})
+	defer timeout.Stop()
+	stop := context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.acks.Broadcast()
+	})
+	defer stop()
+	for len(s.pending) > 0 && s.err == nil && ctx.Err() == nil {
+		s.acks.Wait()
+	}
+	if s.err != nil {
+		return s.err
+	}
+	return ctx.Err()
+}
+
+func (s *natsSink) Close() error {
+	err := s.Flush(context.Background())
+	if cerr := s.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// read handles what the server sends until the connection is closed: it
+// answers pings and records the acknowledgements of publishes.
+func (s *natsSink) read(r *bufio.Reader) {
+	err := s.readLoop(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = fmt.Errorf("NATS connection lost: %w", err)
+	}
+	s.acks.Broadcast()
+}
+
+func (s *natsSink) readLoop(r *bufio.Reader) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			s.mu.Lock()
+			s.w.WriteString("PONG\r\n")
+			err = s.w.Flush()
+			s.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		case "-ERR":
+			return errors.New(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		case "MSG", "HMSG":
+			// MSG <subject> <sid> <size>, HMSG <subject> <sid> <header size> <size>
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return fmt.Errorf("malformed %s", strings.TrimSpace(line))
+			}
+			msg := make([]byte, size+2) // and CRLF
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return err
+			}
+			payload := msg[:size]
+			var headers []byte
+			if fields[0] == "HMSG" {
+				n, _ := strconv.Atoi(fields[len(fields)-2])
+				headers, payload = payload[:min(n, size)], payload[min(n, size):]
+			}
+			s.ack(strings.TrimPrefix(fields[1], s.inbox+"."), headers, payload)
+		}
+	}
+}
+
+// ack records the server's reply to the publish with reply token.
+func (s *natsSink) ack(reply string, headers, payload []byte) {
+	var err error
+	var a natsAck
+	switch {
+	case strings.Contains(strings.SplitN(string(headers), "\r\n", 2)[0], "503"):
+		err = fmt.Errorf("no JetStream stream listens on %s.>", s.subject)
+	case json.Unmarshal(payload, &a) != nil:
+		err = fmt.Errorf("unexpected reply to publish: %q", payload)
+	case a.Error != nil:
+		err = fmt.Errorf("JetStream rejected publish: %s (%d)", a.Error.Description, a.Error.Code)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, reply)
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+	s.acks.Broadcast()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNATSSubjectToken(t *testing.T) {
+	tests := []struct {
+		v    any
+		want string
+	}{
+		{"person", "person"},
+		{float64(42), "42"},
+		{"a.b", "a_b"},
+		{"new york", "new_york"},
+		{"*", "_"},
+		{"a>b", "a_b"},
+	}
+	for _, tt := range tests {
+		if got := natsSubjectToken(tt.v); got != tt.want {
+			t.Errorf("natsSubjectToken(%v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestNATSSinkRefusesEventWithoutID(t *testing.T) {
+	s := &natsSink{subject: "cdc", pending: make(map[string]bool)}
+	s.acks.L = &s.mu
+	if err := s.Emit(Event{Op: "d", Table: "person", LSN: "0/1"}); err == nil {
+		t.Error("event without id: no error")
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("event without id: %d publishes pending, want none", len(s.pending))
+	}
+}
+
+func TestNATSSinkFlushStopsOnCancel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// A server that accepts publishes but never acknowledges them
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "INFO {\"headers\":true}\r\n")
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "PING") {
+				io.WriteString(conn, "PONG\r\n")
+			}
+		}
+	}()
+
+	s, err := openNATSSink("nats://"+ln.Addr().String(), "cdc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.conn.Close()
+	if err := s.Emit(Event{Op: "c", Table: "person", After: map[string]any{"id": 1}, LSN: "0/1"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	started := time.Now()
+	err = s.Flush(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Flush = %v, want %v", err, context.Canceled)
+	}
+	if took := time.Since(started); took >= natsAckTimeout {
+		t.Errorf("Flush took %v, until the ack timeout, not the cancellation", took)
+	}
+}
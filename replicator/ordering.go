@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+// relaxedApply applies the changes of one poll in parallel, for
+// -apply-ordering relaxed. Each change goes to one of -apply-workers workers
+// chosen by its row's id, so the changes of a row are applied in source order
+// by the same worker while different rows are applied at once. An update
+// changing a row's id waits for every change before it and is applied on its
+// own. The poll waits for all of them before it checkpoints. A failed change
+// is logged and skipped, as in strict order. Workers share only the
+// replicator's state that is safe to: relaxed order cannot be combined with
+// -sink, so they never emit or mark transactions, and the count and commit
+// time they update are guarded by mu.
+type relaxedApply struct {
+	r           *replicator
+	applyChange func(context.Context, WAL2JSONChange) (bool, error) // r.apply, replaced in tests
+	queues      []chan WAL2JSONChange
+	pending     sync.WaitGroup // changes handed to a worker and not yet applied
+	workers     sync.WaitGroup
+	mu          sync.Mutex
+	applied     int
+}
+
+// newRelaxedApply returns nil with -apply-ordering strict, where poll applies
+// each change itself before reading the next.
+func newRelaxedApply(ctx context.Context, r *replicator) *relaxedApply {
+	if r.cfg.ApplyOrdering != "relaxed" {
+		return nil
+	}
+	return startRelaxedApply(ctx, r, r.apply, r.cfg.ApplyWorkers)
+}
+
+// startRelaxedApply starts workers applying changes with applyChange.
+func startRelaxedApply(ctx context.Context, r *replicator, applyChange func(context.Context, WAL2JSONChange) (bool, error), workers int) *relaxedApply {
+	a := &relaxedApply{r: r, applyChange: applyChange, queues: make([]chan WAL2JSONChange, workers)}
+	for i := range a.queues {
+		queue := make(chan WAL2JSONChange, 100)
+		a.queues[i] = queue
+		a.workers.Add(1)
+		go func() {
+			defer a.workers.Done()
+			for change := range queue {
+				a.applyOne(ctx, change)
+				a.pending.Done()
+			}
+		}()
+	}
+	return a
+}
+
+// apply hands change to the worker of its row, waiting while that worker's
+// queue is full.
+func (a *relaxedApply) apply(ctx context.Context, change WAL2JSONChange) {
+	oldKey, newKey := rowKey(change.Identity), rowKey(change.Columns)
+	if change.Action == "U" && oldKey != "" && newKey != "" && oldKey != newKey {
+		// The row moves to another worker: apply it once both are idle
+		a.pending.Wait()
+		a.applyOne(ctx, change)
+		return
+	}
+	key := oldKey
+	if key == "" {
+		key = newKey
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	a.pending.Add(1)
+	a.queues[h.Sum32()%uint32(len(a.queues))] <- change
+}
+
+// rowKey returns the id among cols, or "" if it is missing.
+func rowKey(cols []WAL2JSONColumn) string {
+	for _, col := range cols {
+		if col.Name == "id" {
+			return fmt.Sprint(col.Value)
+		}
+	}
+	return ""
+}
+
+func (a *relaxedApply) applyOne(ctx context.Context, change WAL2JSONChange) {
+	r := a.r
+	started := time.Now()
+	applied, err := a.applyChange(ctx, change)
+	r.logSlowApply(change, time.Since(started))
+	if err != nil {
+		log.Printf("%sFailed to apply change at %s: %v", r.prefix, change.LSN, err)
+	}
+	if !applied {
+		return
+	}
+	r.metrics.observeApplied(change, time.Now())
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.applied++
+	if committed, err := parseTimestamp(change.Timestamp); err == nil && committed.After(r.lastCommit) {
+		r.lastCommit = committed
+	}
+}
+
+// wait stops the workers once every change handed to them is applied or has
+// failed, and returns the number applied.
+func (a *relaxedApply) wait() int {
+	if a == nil {
+		return 0
+	}
+	for _, queue := range a.queues {
+		close(queue)
+	}
+	a.workers.Wait()
+	return a.applied
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRelaxedApplyKeepsRowOrder(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string][]string{}
+	record := func(_ context.Context, change WAL2JSONChange) (bool, error) {
+		time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+		mu.Lock()
+		defer mu.Unlock()
+		key := rowKey(change.Identity)
+		if key == "" {
+			key = rowKey(change.Columns)
+		}
+		got[key] = append(got[key], change.LSN)
+		return true, nil
+	}
+	a := startRelaxedApply(context.Background(), &replicator{}, record, 4)
+
+	want := map[string][]string{}
+	for step := 0; step < 50; step++ {
+		for id := 0; id < 10; id++ {
+			change := changeOf("U", id, id)
+			switch step {
+			case 0:
+				change = changeOf("I", id, id)
+			case 49:
+				change = changeOf("D", id, id)
+			}
+			change.LSN = fmt.Sprintf("0/%X", step*10+id)
+			a.apply(context.Background(), change)
+			want[fmt.Sprint(id)] = append(want[fmt.Sprint(id)], change.LSN)
+		}
+	}
+	if applied := a.wait(); applied != 500 {
+		t.Errorf("applied %d changes, want 500", applied)
+	}
+	for id, lsns := range want {
+		if fmt.Sprint(got[id]) != fmt.Sprint(lsns) {
+			t.Errorf("row %s applied in order %v, want %v", id, got[id], lsns)
+		}
+	}
+}
+
+func TestRelaxedApplyWaitsForIDChange(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	record := func(_ context.Context, change WAL2JSONChange) (bool, error) {
+		if change.LSN == "0/1" {
+			time.Sleep(10 * time.Millisecond)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, change.LSN)
+		return true, nil
+	}
+	a := startRelaxedApply(context.Background(), &replicator{}, record, 4)
+	insert := changeOf("I", 1, 1)
+	insert.LSN = "0/1"
+	move := changeOf("U", 1, 2) // changes id 1 to 2
+	move.LSN = "0/2"
+	after := changeOf("U", 2, 2)
+	after.LSN = "0/3"
+	for _, change := range []WAL2JSONChange{insert, move, after} {
+		a.apply(context.Background(), change)
+	}
+	a.wait()
+	if fmt.Sprint(got) != "[0/1 0/2 0/3]" {
+		t.Errorf("applied in order %v, want [0/1 0/2 0/3]", got)
+	}
+}
+
+func TestRelaxedApplyConcurrentState(t *testing.T) {
+	// Workers share the replicator: run with -race
+	r := &replicator{cfg: config{WatchColumns: []string{"score"}, UnwatchedUpdates: "apply"}, metrics: newMetrics([]string{`source="1"`})}
+	var mu sync.Mutex
+	applied := map[string]int{}
+	applyChange := func(_ context.Context, change WAL2JSONChange) (bool, error) {
+		// The parts of r.apply that need no target
+		before, after := r.values(change.Identity), r.values(change.Columns)
+		r.watchedChanged(change.LSN, before, after)
+		r.emit(changeEvent("u", change, before, after))
+		mu.Lock()
+		defer mu.Unlock()
+		applied[rowKey(change.Identity)]++
+		return true, nil
+	}
+	a := startRelaxedApply(context.Background(), r, applyChange, 8)
+	last := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 1000; i++ {
+		change := changeOf("U", i%50, i%50)
+		change.LSN = fmt.Sprintf("0/%X", i)
+		change.Timestamp = last.Add(-time.Duration(i%7) * time.Second).Format("2006-01-02 15:04:05.999999-07")
+		a.apply(context.Background(), change)
+	}
+	if n := a.wait(); n != 1000 {
+		t.Errorf("applied %d changes, want 1000", n)
+	}
+	for id, n := range applied {
+		if n != 20 {
+			t.Errorf("row %s got %d changes, want 20", id, n)
+		}
+	}
+	if !r.lastCommit.Equal(last) {
+		t.Errorf("last commit %v, want the latest of the poll, %v", r.lastCommit, last)
+	}
+}
+
+func TestRelaxedApplyMatchesStrict(t *testing.T) {
+	// table applies changes to rows by id, as the target does
+	type table struct {
+		mu   sync.Mutex
+		rows map[string]string
+	}
+	applyTo := func(tbl *table) func(context.Context, WAL2JSONChange) (bool, error) {
+		return func(_ context.Context, change WAL2JSONChange) (bool, error) {
+			time.Sleep(time.Duration(rand.Intn(50)) * time.Microsecond)
+			tbl.mu.Lock()
+			defer tbl.mu.Unlock()
+			switch change.Action {
+			case "I":
+				tbl.rows[rowKey(change.Columns)] = change.LSN
+			case "U":
+				delete(tbl.rows, rowKey(change.Identity))
+				tbl.rows[rowKey(change.Columns)] = change.LSN
+			case "D":
+				delete(tbl.rows, rowKey(change.Identity))
+			}
+			return true, nil
+		}
+	}
+
+	// A random history of 20 rows, including updates changing their id
+	rng := rand.New(rand.NewSource(1))
+	live := map[int]bool{}
+	var changes []WAL2JSONChange
+	for i := 0; len(changes) < 2000; i++ {
+		id := rng.Intn(20)
+		var change WAL2JSONChange
+		switch {
+		case !live[id]:
+			change = changeOf("I", id, id)
+			live[id] = true
+		case rng.Intn(10) == 0:
+			change = changeOf("D", id, id)
+			delete(live, id)
+		case rng.Intn(10) == 0 && !live[id+20]:
+			change = changeOf("U", id, id+20)
+			delete(live, id)
+			live[id+20] = true
+		default:
+			change = changeOf("U", id, id)
+		}
+		change.LSN = fmt.Sprintf("0/%X", i)
+		changes = append(changes, change)
+	}
+
+	strict := &table{rows: map[string]string{}}
+	apply := applyTo(strict)
+	for _, change := range changes {
+		apply(context.Background(), change)
+	}
+	relaxed := &table{rows: map[string]string{}}
+	a := startRelaxedApply(context.Background(), &replicator{}, applyTo(relaxed), 4)
+	for _, change := range changes {
+		a.apply(context.Background(), change)
+	}
+	a.wait()
+	if fmt.Sprint(relaxed.rows) != fmt.Sprint(strict.rows) {
+		t.Errorf("relaxed order left rows %v, strict order %v", relaxed.rows, strict.rows)
+	}
+}
+
+// changeOf returns a change of action to the row with id oldID, which has id
+// newID after it.
+func changeOf(action string, oldID, newID int) WAL2JSONChange {
+	change := WAL2JSONChange{Action: action, Table: "person"}
+	if action != "D" {
+		change.Columns = []WAL2JSONColumn{{Name: "id", Type: "integer", Value: float64(newID)}}
+	}
+	if action != "I" {
+		change.Identity = []WAL2JSONColumn{{Name: "id", Type: "integer", Value: float64(oldID)}}
+	}
+	return change
+}
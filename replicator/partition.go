@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// partitionRouter maps the tables wal2json reports changes on to the table
+// they are applied to. wal2json reports changes to a partitioned table on the
+// leaf partition that holds the row, e.g. person_2024, so changes on the
+// partitions of person, found through pg_inherits, are routed to the single
+// person table on the target. -partition-parent adds mappings for other
+// tables. A table not seen before triggers one lookup, so partitions attached
+// while the replicator runs are picked up.
+type partitionRouter struct {
+	parents map[string]string // table to the table its changes are applied to
+	looked  map[string]bool   // tables already looked up in pg_inherits
+}
+
+// parsePartitionParents parses -partition-parent specs of the form
+// partition=parent.
+func parsePartitionParents(specs []string) (map[string]string, error) {
+	parents := make(map[string]string)
+	for _, spec := range specs {
+		partition, parent, ok := strings.Cut(spec, "=")
+		if !ok || partition == "" || parent == "" {
+			return nil, fmt.Errorf("invalid partition parent %q, want partition=parent", spec)
+		}
+		parents[partition] = parent
+	}
+	return parents, nil
+}
+
+// route returns the table a change on table is applied to.
+func (r *replicator) route(ctx context.Context, table string) string {
+	if table == "person" {
+		return table
+	}
+	if r.partitions.parents == nil {
+		r.partitions.parents, r.partitions.looked = make(map[string]string), make(map[string]bool)
+		for partition, parent := range r.cfg.PartitionParents {
+			r.partitions.parents[partition] = parent
+		}
+	}
+	if parent, ok := r.partitions.parents[table]; ok {
+		return parent
+	}
+	if !r.partitions.looked[table] {
+		r.partitions.looked[table] = true
+		if err := r.lookupPartitions(ctx); err != nil {
+			log.Printf("%sWarning: Could not look up partitions of person: %v", r.prefix, err)
+		}
+		if parent, ok := r.partitions.parents[table]; ok {
+			r.printf("Routing changes on partition %s to %s\n", table, parent)
+			return parent
+		}
+	}
+	return table
+}
+
+// lookupPartitions maps every partition of the source person table, at any
+// depth, to person.
+func (r *replicator) lookupPartitions(ctx context.Context) error {
+	rows, err := r.source.Query(ctx, `
+		WITH RECURSIVE partitions AS (
+			SELECT inhrelid FROM pg_inherits WHERE inhparent = 'person'::regclass
+			UNION ALL
+			SELECT i.inhrelid FROM pg_inherits i JOIN partitions p ON i.inhparent = p.inhrelid
+		)
+		SELECT c.relname FROM partitions p JOIN pg_class c ON c.oid = p.inhrelid`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var partition string
+		if err := rows.Scan(&partition); err != nil {
+			return err
+		}
+		if _, ok := r.partitions.parents[partition]; !ok {
+			r.partitions.parents[partition] = "person"
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/juliaogris/postgres-cdc-example/internal/pgutil"
+)
+
+// newPool connects to connStr, retrying for up to -connect-timeout. If a
+// password file or command is configured, the password is re-read before
+// every new connection so that rotated credentials take effect without a
+// restart. Each settings entry of the form name=value is applied to every new
+// connection.
+func newPool(ctx context.Context, connStr string, cfg config, settings ...string) (*pgxpool.Pool, error) {
+	return pgutil.ConnectWithRetry(ctx, connStr, pgutil.Options{
+		Timeout:         cfg.ConnectTimeout,
+		ApplicationName: cfg.ApplicationName,
+		Configure: func(poolConfig *pgxpool.Config) {
+			configurePool(poolConfig, cfg, settings)
+		},
+	})
+}
+
+// newTargetReadPool connects to -target-read-dsn for queries that only read
+// the target, or returns write if no separate read DSN is configured.
+func newTargetReadPool(ctx context.Context, cfg config, write *pgxpool.Pool, secrets *secretsWatcher) (*pgxpool.Pool, error) {
+	if cfg.TargetReadDSN == "" {
+		return write, nil
+	}
+	return secrets.newPool(ctx, "target-read-dsn", cfg.TargetReadDSN, cfg, cfg.TargetSettings...)
+}
+
+func configurePool(poolConfig *pgxpool.Config, cfg config, settings []string) {
+	// Keepalives let the kernel notice connections silently dropped by NAT
+	// or load balancers; the health check pings idle pool connections and
+	// replaces dead ones before they are handed out.
+	keepAlive := cfg.TCPKeepAlive
+	if keepAlive == 0 {
+		keepAlive = -1 // net.Dialer: disabled
+	}
+	poolConfig.ConnConfig.DialFunc = (&net.Dialer{KeepAlive: keepAlive}).DialContext
+	if cfg.PoolHealthCheck > 0 {
+		poolConfig.HealthCheckPeriod = cfg.PoolHealthCheck
+	}
+	if cfg.ApplyOrdering == "relaxed" {
+		poolConfig.MaxConns = max(poolConfig.MaxConns, int32(cfg.ApplyWorkers))
+	}
+	if cfg.PasswordFile != "" || cfg.PasswordCommand != "" {
+		poolConfig.BeforeConnect = func(ctx context.Context, connConfig *pgx.ConnConfig) error {
+			password, err := readPassword(ctx, cfg.PasswordFile, cfg.PasswordCommand)
+			if err != nil {
+				return err
+			}
+			connConfig.Password = password
+			return nil
+		}
+	}
+	poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		for _, setting := range settings {
+			name, value, _ := strings.Cut(setting, "=")
+			if _, err := conn.Exec(ctx, `SELECT set_config($1, $2, false)`, name, value); err != nil {
+				return fmt.Errorf("could not set %s: %w", name, err)
+			}
+		}
+		return registerHstore(ctx, conn)
+	}
+}
+
+// registerHstore registers the codec for the hstore extension type, if the
+// database has it, so that hstore values are bound in binary.
+func registerHstore(ctx context.Context, conn *pgx.Conn) error {
+	var oid *uint32
+	if err := conn.QueryRow(ctx, `SELECT to_regtype('hstore')::oid`).Scan(&oid); err != nil {
+		return fmt.Errorf("could not look up hstore: %w", err)
+	}
+	if oid != nil {
+		conn.TypeMap().RegisterType(&pgtype.Type{Name: "hstore", OID: *oid, Codec: pgtype.HstoreCodec{}})
+	}
+	return nil
+}
+
+// readPassword returns the current password from command, or from file if no
+// command is given. Trailing newlines are trimmed.
+func readPassword(ctx context.Context, file, command string) (string, error) {
+	var out []byte
+	var err error
+	if command != "" {
+		out, err = exec.CommandContext(ctx, "sh", "-c", command).Output()
+		if err != nil {
+			return "", fmt.Errorf("password command failed: %w", err)
+		}
+	} else {
+		out, err = os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("could not read password file: %w", err)
+		}
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
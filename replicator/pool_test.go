@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestPoolRereadsRotatedPassword(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "password")
+	tests := []struct {
+		name string
+		cfg  config
+	}{
+		{"file", config{PasswordFile: file}},
+		{"command", config{PasswordCommand: "cat " + file}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			poolConfig, err := pgxpool.ParseConfig("host=localhost password=from-dsn")
+			if err != nil {
+				t.Fatal(err)
+			}
+			configurePool(poolConfig, tt.cfg, nil)
+			// Record the password of every connection attempt, and fail
+			// it before it dials
+			var passwords []string
+			beforeConnect := poolConfig.BeforeConnect
+			poolConfig.BeforeConnect = func(ctx context.Context, connConfig *pgx.ConnConfig) error {
+				if err := beforeConnect(ctx, connConfig); err != nil {
+					return err
+				}
+				passwords = append(passwords, connConfig.Password)
+				return nil
+			}
+			poolConfig.ConnConfig.DialFunc = func(context.Context, string, string) (net.Conn, error) {
+				return nil, errors.New("no database")
+			}
+			pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pool.Close()
+
+			for _, password := range []string{"first\n", "rotated\r\n"} {
+				if err := os.WriteFile(file, []byte(password), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := pool.Acquire(context.Background()); err == nil {
+					t.Fatal("acquired a connection without a database")
+				}
+			}
+			if len(passwords) != 2 || passwords[0] != "first" || passwords[1] != "rotated" {
+				t.Errorf("connected with passwords %q, want [first rotated]", passwords)
+			}
+			if poolConfig.ConnConfig.Password != "from-dsn" {
+				t.Errorf("pool config password changed to %q", poolConfig.ConnConfig.Password)
+			}
+		})
+	}
+}
+
+func TestReadPasswordErrors(t *testing.T) {
+	if _, err := readPassword(context.Background(), filepath.Join(t.TempDir(), "missing"), ""); err == nil {
+		t.Error("missing password file: no error")
+	}
+	if _, err := readPassword(context.Background(), "", "exit 1"); err == nil {
+		t.Error("failing password command: no error")
+	}
+}
+
+func TestNewTargetReadPool(t *testing.T) {
+	ctx := context.Background()
+	write := &pgxpool.Pool{}
+	if read, err := newTargetReadPool(ctx, config{}, write, nil); err != nil || read != write {
+		t.Errorf("without -target-read-dsn: %p, %v, want the write pool %p", read, err, write)
+	}
+	// With a read DSN its pool is connected, never falling back to the
+	// write pool
+	cfg := config{TargetReadDSN: "host=127.0.0.1 port=1 connect_timeout=1"}
+	if read, err := newTargetReadPool(ctx, cfg, write, nil); err == nil || read != nil {
+		t.Errorf("with an unreachable -target-read-dsn: %p, %v, want an error", read, err)
+	}
+}
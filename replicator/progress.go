@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/juliaogris/postgres-cdc-example/internal/pgutil"
+)
+
+// The progress table records how far each slot has been consumed, for
+// operators and tooling looking at the target. It holds a single upserted row
+// per slot (and source, in fan-in mode), so it stays bounded however long the
+// replicator runs. It is named cdc_progress, after -name-prefix if set.
+func createProgressTableSQL(table string) string {
+	return `
+	CREATE TABLE IF NOT EXISTS ` + table + ` (
+		slot_name TEXT NOT NULL,
+		source_id INTEGER NOT NULL DEFAULT 0,
+		lsn PG_LSN NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (slot_name, source_id)
+	);`
+}
+
+// progressTable returns the name of the progress table.
+func (cfg config) progressTable() string {
+	return pgutil.Prefix(cfg.NamePrefix, "cdc_progress")
+}
+
+// recordProgress stores lsn as the last consumed position of the slot, on
+// every target when sharded.
+func (r *replicator) recordProgress(ctx context.Context, lsn string) {
+	if r.sharded() {
+		for _, shard := range r.shards {
+			shard.recordProgress(ctx, lsn)
+		}
+		return
+	}
+	_, err := r.target.Exec(ctx, `
+		INSERT INTO `+r.cfg.progressTable()+` (slot_name, source_id, lsn, updated_at)
+		VALUES ($1, $2, $3, now())
+		ON CONFLICT (slot_name, source_id) DO UPDATE SET
+			lsn = EXCLUDED.lsn,
+			updated_at = EXCLUDED.updated_at`,
+		r.slotName, r.sourceID, lsn)
+	if err != nil {
+		log.Printf("%sWarning: Could not record progress: %v", r.prefix, err)
+		return
+	}
+	r.manifest.update(r.sourceIndex, func(s *manifestSource) {
+		now := time.Now().UTC()
+		s.AppliedLSN, s.LastCheckpoint = lsn, &now
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pushGateway pushes the metrics to a Prometheus Pushgateway, for runs too
+// short-lived to be scraped, such as -snapshot-only migrations. Every push
+// replaces the group of metrics of this job and slot.
+type pushGateway struct {
+	url     string // of the group, /metrics/job/<job>/slot/<slot>
+	metrics *metrics
+	client  *http.Client
+}
+
+func newPushGateway(baseURL, slot string, m *metrics) (*pushGateway, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported Pushgateway URL %q, want http:// or https://", baseURL)
+	}
+	return &pushGateway{
+		url:     strings.TrimSuffix(baseURL, "/") + "/metrics/job/cdc-replicator/slot/" + url.PathEscape(slot),
+		metrics: m,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// push sends the current metrics.
+func (p *pushGateway) push(ctx context.Context) error {
+	var body bytes.Buffer
+	p.metrics.write(&body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, p.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Pushgateway replied %s", resp.Status)
+	}
+	return nil
+}
+
+// pushEvery pushes the metrics every interval until ctx is done. Failed
+// pushes are logged; the next one may succeed.
+func (p *pushGateway) pushEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := p.push(ctx); err != nil {
+			log.Printf("Warning: Failed to push metrics: %v", err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// reconcile backfills rows that exist on the source within the snapshot's key
+// range but are missing on the target. It runs once after CDC has started,
+// as a safety net against rows falling between the snapshot and the slot.
+// Rows deleted on the source after they are read here are deleted again by
+// the CDC changes that follow, so the target still converges.
+func (r *replicator) reconcile(ctx context.Context) {
+	if r.cfg.SnapshotSamplePercent > 0 || r.cfg.SnapshotWhere != "" {
+		log.Printf("%sWarning: Skipping reconciliation of a sampled or filtered snapshot", r.prefix)
+		return
+	}
+	if r.snapshotMaxID == 0 {
+		return
+	}
+	r.printf("Reconciling ids up to %d...\n", r.snapshotMaxID)
+
+	sourceIDs, err := queryIDs(ctx, r.source, `SELECT id FROM person WHERE id <= $1 ORDER BY id`, r.snapshotMaxID)
+	if err != nil {
+		log.Printf("%sFailed to read source ids for reconciliation: %v", r.prefix, err)
+		return
+	}
+	targetSQL := `SELECT id FROM person WHERE id <= $1 ORDER BY id`
+	targetArgs := []any{r.snapshotMaxID}
+	if r.fanIn() {
+		targetSQL = `SELECT id FROM person WHERE id <= $1 AND source_id = $2 ORDER BY id`
+		targetArgs = append(targetArgs, r.sourceID)
+	}
+	targetIDs, err := queryIDs(ctx, r.targetRead, targetSQL, targetArgs...)
+	if err != nil {
+		log.Printf("%sFailed to read target ids for reconciliation: %v", r.prefix, err)
+		return
+	}
+
+	var missing []int
+	t := 0
+	for _, id := range sourceIDs {
+		for t < len(targetIDs) && targetIDs[t] < id {
+			t++
+		}
+		if t == len(targetIDs) || targetIDs[t] != id {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		r.printf("Reconciliation found no missing rows\n")
+		return
+	}
+
+	rows, err := r.source.Query(ctx, `
+		SELECT id, name, uid, score, created_at
+		FROM person
+		WHERE id = ANY($1)`, missing)
+	if err != nil {
+		log.Printf("%sFailed to read missing rows: %v", r.prefix, err)
+		return
+	}
+	people, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Person])
+	if err != nil {
+		log.Printf("%sFailed to read missing rows: %v", r.prefix, err)
+		return
+	}
+	for _, p := range people {
+		if err := r.exec(ctx, r.stmts.snapshotInsert, r.snapshotArgs(p)...); err != nil {
+			log.Printf("%sFailed to backfill ID=%d: %v", r.prefix, p.ID, err)
+			continue
+		}
+		r.printf("Backfilled missing row: ID=%d, Name=%s\n", p.ID, p.Name)
+	}
+}
+
+// queryIDs returns the single integer column of sql's result rows.
+func queryIDs(ctx context.Context, pool *pgxpool.Pool, sql string, args ...any) ([]int, error) {
+	rows, err := pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[int])
+}
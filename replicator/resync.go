@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// resync empties the target person table, or only this source's rows of it
+// in fan-in mode, on every target when sharded, and snapshots it again, for
+// -resync-table. The slot and the progress recorded for it are kept. The
+// snapshot is taken after the slot's position, so the changes the slot
+// still holds are applied on top of it once streaming starts, and the
+// target converges as it does after the first snapshot: changes already in
+// the snapshot are applied again, none are missed.
+func (r *replicator) resync(ctx context.Context) {
+	sql, args := `TRUNCATE person`, []any(nil)
+	if r.fanIn() {
+		sql, args = `DELETE FROM person WHERE source_id = $1`, []any{r.sourceID}
+	}
+	for _, shard := range r.targets() {
+		if _, err := shard.target.Exec(ctx, sql, args...); err != nil {
+			log.Fatalf("%sFailed to empty target table person for resync: %v", shard.prefix, err)
+		}
+	}
+	r.printf("Emptied target table person, resyncing it from slot %s\n", r.slotName)
+	r.snapshot(ctx)
+	r.syncSequence(ctx)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// columnSchema describes a column as compareSchemas compares it.
+type columnSchema struct {
+	Type     string // as format_type prints it
+	Nullable bool
+	Default  string // "" if none
+}
+
+func (c columnSchema) String() string {
+	s := c.Type
+	if !c.Nullable {
+		s += " NOT NULL"
+	}
+	if c.Default != "" {
+		s += " DEFAULT " + c.Default
+	}
+	return s
+}
+
+// tableSchema is the shape of a table: its columns by name and its primary
+// key columns in key order.
+type tableSchema struct {
+	Columns    map[string]columnSchema
+	PrimaryKey []string
+}
+
+// schemaDrift is one difference between the source and target table.
+type schemaDrift struct {
+	Kind   string // "missing on target", "extra on target", "changed" or "primary key"
+	Column string
+	Source string
+	Target string
+}
+
+// compareSchemas diffs the person table of the first source with the target,
+// column by column, printing every difference, and reports whether they
+// match. Columns the replicator adds to the target itself, for -annotate and
+// -soft-delete, are left out, as is the primary key with a -target-key other
+// than id. It changes nothing, so it can be run from cron alongside a
+// running replicator.
+func compareSchemas(ctx context.Context, cfg config) bool {
+	source, err := newPool(ctx, cfg.SourceDSNs[0], cfg)
+	if err != nil {
+		log.Fatal("Failed to connect to source database:", err)
+	}
+	defer source.Close()
+	target, err := newPool(ctx, cfg.TargetDSN, cfg, cfg.TargetSettings...)
+	if err != nil {
+		log.Fatal("Failed to connect to target database:", err)
+	}
+	defer target.Close()
+	targetRead, err := newTargetReadPool(ctx, cfg, target, nil)
+	if err != nil {
+		log.Fatal("Failed to connect to target read database:", err)
+	}
+	if targetRead != target {
+		defer targetRead.Close()
+	}
+
+	fmt.Println("Comparing person schemas...")
+	sourceSchema, err := describeTable(ctx, source, "person")
+	if err != nil {
+		log.Fatal("Failed to read source schema:", err)
+	}
+	targetSchema, err := describeTable(ctx, targetRead, "person")
+	if err != nil {
+		log.Fatal("Failed to read target schema:", err)
+	}
+	var ignore []string
+	if cfg.Annotate {
+		ignore = append(ignore, annotationColumns...)
+	}
+	if cfg.SoftDelete != "" {
+		ignore = append(ignore, cfg.SoftDelete)
+	}
+	drift := diffSchemas(sourceSchema, targetSchema, ignore, cfg.TargetKey == "id")
+
+	for _, d := range drift {
+		switch d.Kind {
+		case "missing on target":
+			fmt.Printf("  [DRIFT] column %s missing on target: %s\n", d.Column, d.Source)
+		case "extra on target":
+			fmt.Printf("  [DRIFT] column %s extra on target: %s\n", d.Column, d.Target)
+		case "changed":
+			fmt.Printf("  [DRIFT] column %s is %s on source but %s on target\n", d.Column, d.Source, d.Target)
+		case "primary key":
+			fmt.Printf("  [DRIFT] primary key is (%s) on source but (%s) on target\n", d.Source, d.Target)
+		}
+	}
+	if len(drift) > 0 {
+		fmt.Printf("Schemas differ: %d differences\n", len(drift))
+		return false
+	}
+	fmt.Println("Schemas match")
+	return true
+}
+
+// diffSchemas returns the differences between source and target ordered by
+// column name, leaving out the ignore columns and, unless comparePK is set,
+// the primary key.
+func diffSchemas(source, target tableSchema, ignore []string, comparePK bool) []schemaDrift {
+	var drift []schemaDrift
+	names := make([]string, 0, len(source.Columns)+len(target.Columns))
+	for name := range source.Columns {
+		names = append(names, name)
+	}
+	for name := range target.Columns {
+		if _, ok := source.Columns[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if slices.Contains(ignore, name) {
+			continue
+		}
+		s, inSource := source.Columns[name]
+		t, inTarget := target.Columns[name]
+		switch {
+		case !inTarget:
+			drift = append(drift, schemaDrift{Kind: "missing on target", Column: name, Source: s.String()})
+		case !inSource:
+			drift = append(drift, schemaDrift{Kind: "extra on target", Column: name, Target: t.String()})
+		case s != t:
+			drift = append(drift, schemaDrift{Kind: "changed", Column: name, Source: s.String(), Target: t.String()})
+		}
+	}
+	if comparePK && !slices.Equal(source.PrimaryKey, target.PrimaryKey) {
+		drift = append(drift, schemaDrift{Kind: "primary key", Source: strings.Join(source.PrimaryKey, ", "), Target: strings.Join(target.PrimaryKey, ", ")})
+	}
+	return drift
+}
+
+// describeTable reads the columns and primary key of table in the public
+// schema. A table that does not exist has no columns.
+func describeTable(ctx context.Context, pool *pgxpool.Pool, table string) (tableSchema, error) {
+	schema := tableSchema{Columns: make(map[string]columnSchema)}
+	rows, err := pool.Query(ctx, `
+		SELECT a.attname, format_type(a.atttypid, a.atttypmod), NOT a.attnotnull,
+		       COALESCE(pg_get_expr(d.adbin, d.adrelid), '')
+		FROM pg_attribute a
+		JOIN pg_class c ON c.oid = a.attrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE n.nspname = 'public' AND c.relname = $1 AND a.attnum > 0 AND NOT a.attisdropped`, table)
+	if err != nil {
+		return schema, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var col columnSchema
+		if err := rows.Scan(&name, &col.Type, &col.Nullable, &col.Default); err != nil {
+			return schema, err
+		}
+		schema.Columns[name] = col
+	}
+	if err := rows.Err(); err != nil {
+		return schema, err
+	}
+
+	rows, err = pool.Query(ctx, `
+		SELECT a.attname
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		CROSS JOIN LATERAL unnest(i.indkey) WITH ORDINALITY AS k(attnum, ord)
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+		WHERE n.nspname = 'public' AND c.relname = $1 AND i.indisprimary
+		ORDER BY k.ord`, table)
+	if err != nil {
+		return schema, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return schema, err
+		}
+		schema.PrimaryKey = append(schema.PrimaryKey, name)
+	}
+	return schema, rows.Err()
+}
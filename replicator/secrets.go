@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/juliaogris/postgres-cdc-example/internal/pgutil"
+)
+
+// secretsCheckInterval is how often the -secrets-file is checked for changes.
+const secretsCheckInterval = 5 * time.Second
+
+// secrets are the connection strings read from -secrets-file, one name=value
+// per line named like the flags they replace. Blank lines and lines starting
+// with # are ignored; source-dsn may be repeated.
+type secrets struct {
+	sourceDSNs    []string
+	targetDSN     string
+	targetReadDSN string
+}
+
+func readSecrets(path string) (secrets, error) {
+	var s secrets
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || value == "" {
+			return s, fmt.Errorf("%s:%d: want name=value", path, n)
+		}
+		switch name {
+		case "source-dsn":
+			s.sourceDSNs = append(s.sourceDSNs, value)
+		case "target-dsn":
+			s.targetDSN = value
+		case "target-read-dsn":
+			s.targetReadDSN = value
+		default:
+			return s, fmt.Errorf("%s:%d: unknown name %q, want source-dsn, target-dsn or target-read-dsn", path, n, name)
+		}
+	}
+	return s, scanner.Err()
+}
+
+// without returns s without the connection strings of flags, which take
+// precedence over the file.
+func (s secrets) without(flags []string) secrets {
+	for _, name := range flags {
+		switch name {
+		case "source-dsn":
+			s.sourceDSNs = nil
+		case "target-dsn", "target-write-dsn":
+			s.targetDSN = ""
+		case "target-read-dsn":
+			s.targetReadDSN = ""
+		}
+	}
+	return s
+}
+
+// apply overrides the connection strings in cfg with those set in s.
+func (s secrets) apply(cfg *config) {
+	if len(s.sourceDSNs) > 0 {
+		cfg.SourceDSNs = s.sourceDSNs
+	}
+	if s.targetDSN != "" {
+		cfg.TargetDSN = s.targetDSN
+	}
+	if s.targetReadDSN != "" {
+		cfg.TargetReadDSN = s.targetReadDSN
+	}
+}
+
+// secretsWatcher follows -secrets-file while the replicator runs. Only the
+// target connection strings are reloaded: the pools created with newPool
+// connect with the current value, and a change resets them, so connections
+// in use finish their work and are replaced once released. A changed
+// source-dsn is only logged, as the slot lives on the source and switching
+// servers under it would lose its position; it takes a restart. Connection
+// strings given as flags or in the environment are kept whatever the file
+// says. A nil secretsWatcher creates plain pools and watches nothing.
+type secretsWatcher struct {
+	path        string
+	flags       []string               // given as flags or in the environment
+	checkTarget func(dsn string) error // -allowed-target-hosts and -production-target-pattern
+	mu          sync.Mutex
+	current     secrets
+	modTime     time.Time
+	pools       map[string][]*pgxpool.Pool // by name in the file
+}
+
+func newSecretsWatcher(path string, flags []string, checkTarget func(dsn string) error) (*secretsWatcher, error) {
+	if path == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	current, err := readSecrets(path)
+	if err != nil {
+		return nil, err
+	}
+	return &secretsWatcher{path: path, flags: flags, checkTarget: checkTarget, current: current.without(flags), modTime: info.ModTime(), pools: make(map[string][]*pgxpool.Pool)}, nil
+}
+
+// dsn returns the current value of name, or "" if the file does not set it.
+func (w *secretsWatcher) dsn(name string) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch name {
+	case "target-dsn":
+		return w.current.targetDSN
+	case "target-read-dsn":
+		return w.current.targetReadDSN
+	}
+	return ""
+}
+
+// newPool is like the package-level newPool, but every new connection is made
+// with the current value of name in the file, if it sets one.
+func (w *secretsWatcher) newPool(ctx context.Context, name, connStr string, cfg config, settings ...string) (*pgxpool.Pool, error) {
+	if w == nil {
+		return newPool(ctx, connStr, cfg, settings...)
+	}
+	pool, err := pgutil.ConnectWithRetry(ctx, connStr, pgutil.Options{
+		Timeout:         cfg.ConnectTimeout,
+		ApplicationName: cfg.ApplicationName,
+		Configure: func(poolConfig *pgxpool.Config) {
+			configurePool(poolConfig, cfg, settings)
+			next := poolConfig.BeforeConnect
+			poolConfig.BeforeConnect = func(ctx context.Context, connConfig *pgx.ConnConfig) error {
+				if dsn := w.dsn(name); dsn != "" {
+					current, err := pgx.ParseConfig(dsn)
+					if err != nil {
+						return err
+					}
+					connConfig.Host, connConfig.Port = current.Host, current.Port
+					connConfig.Database, connConfig.User, connConfig.Password = current.Database, current.User, current.Password
+					connConfig.TLSConfig, connConfig.Fallbacks = current.TLSConfig, current.Fallbacks
+				}
+				if next != nil {
+					return next(ctx, connConfig)
+				}
+				return nil
+			}
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	w.pools[name] = append(w.pools[name], pool)
+	w.mu.Unlock()
+	return pool, nil
+}
+
+// watch checks the file every secretsCheckInterval until ctx is done.
+func (w *secretsWatcher) watch(ctx context.Context) {
+	ticker := time.NewTicker(secretsCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check reloads the file if it was modified. A file that does not parse, or
+// sets a connection string that does not or that points at a target host the
+// flags refuse, is ignored until it changes again.
+func (w *secretsWatcher) check() {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		log.Printf("Warning: Could not check -secrets-file: %v", err)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if info.ModTime().Equal(w.modTime) {
+		return
+	}
+	w.modTime = info.ModTime()
+	next, err := readSecrets(w.path)
+	if err != nil {
+		log.Printf("Warning: Ignoring changed -secrets-file: %v", err)
+		return
+	}
+	next = next.without(w.flags)
+	for _, dsn := range []string{next.targetDSN, next.targetReadDSN} {
+		if dsn == "" {
+			continue // the flag's value is kept, and was checked at start
+		}
+		if _, err := pgx.ParseConfig(dsn); err != nil {
+			log.Printf("Warning: Ignoring changed -secrets-file: %v", redactDSN(err.Error()))
+			return
+		}
+		if err := w.checkTarget(dsn); err != nil {
+			log.Printf("Warning: Ignoring changed -secrets-file: %v", err)
+			return
+		}
+	}
+	if strings.Join(next.sourceDSNs, "\n") != strings.Join(w.current.sourceDSNs, "\n") {
+		log.Printf("Warning: source-dsn changed in %s; it is not reloaded while running, restart to apply it", w.path)
+		next.sourceDSNs = w.current.sourceDSNs
+	}
+	changed := map[string]bool{
+		"target-dsn":      next.targetDSN != w.current.targetDSN,
+		"target-read-dsn": next.targetReadDSN != w.current.targetReadDSN,
+	}
+	w.current = next
+	for name, ok := range changed {
+		if !ok {
+			continue
+		}
+		if len(w.pools[name]) == 0 {
+			log.Printf("Warning: %s changed in %s, but no pool follows it; restart to apply it", name, w.path)
+			continue
+		}
+		log.Printf("%s changed in %s, reconnecting", name, w.path)
+		for _, pool := range w.pools[name] {
+			pool.Reset()
+		}
+	}
+}
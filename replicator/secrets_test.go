@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cdc")
+	content := `# connection strings
+source-dsn = 1=host=db1 dbname=testdb
+source-dsn=2=host=db2 dbname=testdb
+
+target-dsn=host=target password=a=b
+target-read-dsn=host=replica
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := readSecrets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(s.sourceDSNs, "|"); got != "1=host=db1 dbname=testdb|2=host=db2 dbname=testdb" {
+		t.Errorf("source-dsn %q", got)
+	}
+	if s.targetDSN != "host=target password=a=b" {
+		t.Errorf("target-dsn %q", s.targetDSN)
+	}
+	if s.targetReadDSN != "host=replica" {
+		t.Errorf("target-read-dsn %q", s.targetReadDSN)
+	}
+
+	cfg := config{SourceDSNs: []string{"host=flag"}, TargetDSN: "host=flag"}
+	secrets{targetReadDSN: "host=replica"}.apply(&cfg)
+	if cfg.SourceDSNs[0] != "host=flag" || cfg.TargetDSN != "host=flag" || cfg.TargetReadDSN != "host=replica" {
+		t.Errorf("apply overrode flags the file does not set: %+v", cfg)
+	}
+}
+
+func TestSecretsFileChecked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cdc")
+	if err := os.WriteFile(path, []byte("source-dsn=1=host=db1\nsource-dsn=2=host=db2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := testParseConfig("-secrets-file", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.SourceDSNs) != 2 || cfg.SourceIDs[1] != 2 {
+		t.Errorf("sources %q with ids %v, want the file's fan-in", cfg.SourceDSNs, cfg.SourceIDs)
+	}
+	_, err = testParseConfig("-secrets-file", path, "-row-as-jsonb")
+	if err == nil || !strings.Contains(err.Error(), "fan-in") {
+		t.Errorf("fan-in from the file with -row-as-jsonb: error %v, want it refused", err)
+	}
+}
+
+func TestReadSecretsErrors(t *testing.T) {
+	for _, content := range []string{
+		"target-dsn\n",
+		"target-dsn=\n",
+		"password=secret\n",
+	} {
+		path := filepath.Join(t.TempDir(), "cdc")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readSecrets(path); err == nil {
+			t.Errorf("%q: no error", content)
+		}
+	}
+	if _, err := readSecrets(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing file: no error")
+	}
+}
+
+func TestCheckTargetDSNEmpty(t *testing.T) {
+	t.Setenv("PGHOST", "prod-db")
+	cfg := config{AllowedTargetHosts: []string{"staging-db"}}
+	if err := cfg.checkTargetDSN(""); err == nil {
+		t.Error("empty dsn resolving to PGHOST prod-db: no error")
+	}
+	t.Setenv("PGHOST", "staging-db")
+	if err := cfg.checkTargetDSN(""); err != nil {
+		t.Errorf("empty dsn resolving to PGHOST staging-db: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// seenChanges remembers the most recently read changes by source, LSN and
+// xid, so that a change read twice, e.g. when replaying after a crash, is
+// applied only once; plain UPDATEs and append-only inserts are not
+// idempotent. Interleaved transactions are returned in commit order, so
+// change LSNs are not monotonic and a set is needed rather than a watermark.
+// It is shared by all sources and a nil seenChanges remembers nothing.
+type seenChanges struct {
+	mu    sync.Mutex
+	size  int
+	keys  map[string]bool
+	order []string // oldest first
+	path  string   // -seen-changes-file; empty to keep the set in memory only
+}
+
+// newSeenChanges returns a set of the last size changes, loading it from path
+// if that file exists.
+func newSeenChanges(size int, path string) (*seenChanges, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+	s := &seenChanges{size: size, keys: make(map[string]bool), path: path}
+	if path == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, key := range keys {
+		s.add(key)
+	}
+	return s, nil
+}
+
+func seenKey(sourceID int, lsn string, xid uint32) string {
+	return fmt.Sprintf("%d/%s/%d", sourceID, lsn, xid)
+}
+
+// check reports whether the change was seen before, and remembers it if not.
+func (s *seenChanges) check(sourceID int, lsn string, xid uint32) bool {
+	if s == nil {
+		return false
+	}
+	key := seenKey(sourceID, lsn, xid)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys[key] {
+		return true
+	}
+	s.add(key)
+	return false
+}
+
+// has reports whether key was seen, without remembering it.
+func (s *seenChanges) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[key]
+}
+
+// remember adds key to the set.
+func (s *seenChanges) remember(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.keys[key] {
+		s.add(key)
+	}
+}
+
+func (s *seenChanges) add(key string) {
+	s.keys[key] = true
+	s.order = append(s.order, key)
+	if len(s.order) > s.size {
+		delete(s.keys, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// save writes the set to its file, replacing it atomically.
+func (s *seenChanges) save() error {
+	if s == nil || s.path == "" {
+		return nil
+	}
+	s.mu.Lock()
+	b, err := json.Marshal(s.order)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeenChanges(t *testing.T) {
+	s, err := newSeenChanges(2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.check(1, "0/10", 5) {
+		t.Error("first change reported as seen")
+	}
+	if !s.check(1, "0/10", 5) {
+		t.Error("change read twice not reported as seen")
+	}
+	if s.check(2, "0/10", 5) {
+		t.Error("same LSN and xid from another source reported as seen")
+	}
+	// Interleaved transactions commit out of LSN order.
+	if s.check(1, "0/8", 4) {
+		t.Error("earlier LSN reported as seen")
+	}
+	if s.check(1, "0/10", 5) {
+		t.Error("change beyond the window of 2 still reported as seen")
+	}
+}
+
+func TestSeenChangesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seen.json")
+	s, err := newSeenChanges(10, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.check(1, "0/10", 5)
+	s.remember(dedupeKey(Event{Database: "testdb", Schema: "public", Table: "person", LSN: "0/10", XID: 5}))
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = newSeenChanges(10, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.check(1, "0/10", 5) {
+		t.Error("change saved before a restart not reported as seen")
+	}
+	if !s.has(dedupeKey(Event{Database: "testdb", Schema: "public", Table: "person", LSN: "0/10", XID: 5})) {
+		t.Error("emitted event saved before a restart not remembered")
+	}
+
+	if err := os.WriteFile(path, []byte("not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newSeenChanges(10, path); err == nil {
+		t.Error("corrupt file: no error")
+	}
+}
+
+func TestNilSeenChanges(t *testing.T) {
+	s, err := newSeenChanges(0, "")
+	if err != nil || s != nil {
+		t.Fatalf("size 0: %v, %v, want nil", s, err)
+	}
+	if s.check(1, "0/10", 5) || s.check(1, "0/10", 5) {
+		t.Error("nil set reports changes as seen")
+	}
+	if err := s.save(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// selfTest checks the whole pipeline end to end against the configured
+// databases: it creates a slot of its own, inserts -self-test-rows rows into
+// the first source, updates and deletes one of them, applies the changes to
+// the target through the normal CDC path and compares the rows on both sides.
+// The test rows and slot are removed afterwards. It prints a report and
+// reports whether the target matched.
+func selfTest(ctx context.Context, cfg config) bool {
+	source, err := newPool(ctx, cfg.SourceDSNs[0], cfg)
+	if err != nil {
+		log.Fatal("Failed to connect to source database:", err)
+	}
+	defer source.Close()
+	target, err := newPool(ctx, cfg.TargetDSN, cfg, cfg.TargetSettings...)
+	if err != nil {
+		log.Fatal("Failed to connect to target database:", err)
+	}
+	defer target.Close()
+
+	stmts := statementsFor(cfg, false)
+	if _, err := source.Exec(ctx, singleSourceStatements.createTable); err != nil {
+		log.Fatal("Failed to create source table:", err)
+	}
+	if _, err := target.Exec(ctx, stmts.createTable); err != nil {
+		log.Fatal("Failed to create target table:", err)
+	}
+	if _, err := target.Exec(ctx, createProgressTableSQL(cfg.progressTable())); err != nil {
+		log.Fatal("Failed to create progress table:", err)
+	}
+
+	// A slot of its own leaves the real slot's position alone
+	r := &replicator{cfg: cfg, slotName: cfg.SlotName + "_selftest", source: source, target: target, targetRead: target, stmts: stmts}
+	r.createSlot(ctx)
+	defer r.releaseSlotConn()
+	if !cfg.TemporarySlot {
+		defer func() {
+			if _, err := source.Exec(ctx, `SELECT pg_drop_replication_slot($1)`, r.slotName); err != nil {
+				log.Printf("Warning: Could not drop slot %s: %v", r.slotName, err)
+			}
+		}()
+	}
+
+	tag := fmt.Sprintf("selftest_%d_", time.Now().Unix())
+	defer func() {
+		for _, pool := range []*pgxpool.Pool{source, target} {
+			if _, err := pool.Exec(ctx, `DELETE FROM person WHERE name LIKE $1 || '%'`, tag); err != nil {
+				log.Printf("Warning: Could not remove self-test rows: %v", err)
+			}
+		}
+		if _, err := target.Exec(ctx, `DELETE FROM `+cfg.progressTable()+` WHERE slot_name = $1`, r.slotName); err != nil {
+			log.Printf("Warning: Could not remove self-test progress: %v", err)
+		}
+	}()
+
+	// Write to the source: inserts, then an update and a delete
+	fmt.Printf("Self-test: writing %d rows to the source\n", cfg.SelfTestRows)
+	var ids []int
+	for i := 0; i < cfg.SelfTestRows; i++ {
+		var id int
+		err := source.QueryRow(ctx, `INSERT INTO person (name, uid, score) VALUES ($1, $2, $3) RETURNING id`,
+			fmt.Sprintf("%s%d", tag, i), uuid.New(), i+1).Scan(&id)
+		if err != nil {
+			log.Fatal("Failed to insert self-test row:", err)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) >= 2 {
+		if _, err := source.Exec(ctx, `UPDATE person SET score = score + 1000 WHERE id = $1`, ids[0]); err != nil {
+			log.Fatal("Failed to update self-test row:", err)
+		}
+		if _, err := source.Exec(ctx, `DELETE FROM person WHERE id = $1`, ids[len(ids)-1]); err != nil {
+			log.Fatal("Failed to delete self-test row:", err)
+		}
+	}
+
+	// Replicate until the slot is drained
+	fmt.Println("Self-test: replicating")
+	deadline := time.Now().Add(time.Minute)
+	for {
+		fetched, err := r.poll(ctx)
+		if err != nil {
+			log.Fatal("Failed to poll changes:", err)
+		}
+		if fetched == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Fatal("Self-test: slot still not drained after a minute")
+		}
+	}
+
+	// Compare each test row on both sides
+	ok := true
+	for _, id := range ids {
+		want, err := selfTestRow(ctx, source, id, "")
+		if err == nil {
+			var got string
+			got, err = selfTestRow(ctx, target, id, cfg.SoftDelete)
+			if err == nil && got != want {
+				err = fmt.Errorf("target has %s, source has %s", got, want)
+			}
+		}
+		if err != nil {
+			fmt.Printf("  [FAIL] row %d: %v\n", id, err)
+			ok = false
+		}
+	}
+	if ok {
+		fmt.Printf("Self-test passed: %d rows inserted, updated and deleted on the source match the target\n", len(ids))
+	} else {
+		fmt.Println("Self-test failed")
+	}
+	return ok
+}
+
+// selfTestRow returns a comparable rendering of the person row with id, or
+// "absent" if there is none or it is soft-deleted by the tombstone column.
+func selfTestRow(ctx context.Context, pool *pgxpool.Pool, id int, tombstone string) (string, error) {
+	sql := `SELECT format('%s %s %s', name, uid, score) FROM person WHERE id = $1`
+	if tombstone != "" {
+		sql += ` AND ` + tombstone + ` IS NULL`
+	}
+	var row string
+	err := pool.QueryRow(ctx, sql, id).Scan(&row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "absent", nil
+	}
+	return row, err
+}
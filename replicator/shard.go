@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// sharded reports whether the replicator fans its source out to several
+// targets, one per -target-dsn.
+func (r *replicator) sharded() bool {
+	return len(r.shards) > 0
+}
+
+// targets returns the replicators writing to each target: the shards when
+// sharded, or r itself.
+func (r *replicator) targets() []*replicator {
+	if r.sharded() {
+		return r.shards
+	}
+	return []*replicator{r}
+}
+
+// newShards returns a replicator per target pool, sharing r's state but
+// writing to its own target, for fan-out. Each shard has its own progress
+// row for the single source slot, all recorded by the same poll.
+func (r *replicator) newShards(pools []*pgxpool.Pool) []*replicator {
+	shards := make([]*replicator, len(pools))
+	for i, pool := range pools {
+		shard := *r
+		shard.target, shard.targetRead = pool, pool
+		shard.prefix = fmt.Sprintf("%s[shard %d] ", r.prefix, i)
+		shards[i] = &shard
+	}
+	return shards
+}
+
+// shardOf returns the index of the target a row with values belongs to, by
+// -shard-by-column: its value modulo the number of targets, or hashed first
+// if it is not a number, with -shard-mapping modulo; the first of
+// -shard-ranges it is below, or the last target, with range.
+func (cfg config) shardOf(values map[string]any) (int, error) {
+	v, ok := values[cfg.ShardByColumn]
+	if !ok || v == nil {
+		return 0, fmt.Errorf("no value of -shard-by-column %s", cfg.ShardByColumn)
+	}
+	n, isInt := shardInt(v)
+	if cfg.ShardMapping == "range" {
+		if !isInt {
+			return 0, fmt.Errorf("-shard-by-column %s value %v is not an integer", cfg.ShardByColumn, v)
+		}
+		return sort.Search(len(cfg.ShardRanges), func(i int) bool { return n < cfg.ShardRanges[i] }), nil
+	}
+	shards := int64(len(cfg.ShardDSNs) + 1)
+	if !isInt {
+		h := fnv.New64a()
+		fmt.Fprint(h, v)
+		return int(h.Sum64() % uint64(shards)), nil
+	}
+	return int((n%shards + shards) % shards), nil
+}
+
+// shardInt returns v as an integer if it is one: an int of a snapshot row, or
+// a whole JSON number of a change.
+func shardInt(v any) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		if v == math.Trunc(v) {
+			return int64(v), true
+		}
+	}
+	return 0, false
+}
+
+// applySharded applies a change on the shard its row belongs to. The shard
+// of an update or delete is that of its old row, from the identity, which
+// checkShards makes sure holds -shard-by-column. wal2json leaves the
+// identity out of an update that keeps the key, which with the default
+// replica identity means the id, and so the shard, is unchanged. An update
+// moving a row to another shard is refused, as it would need to be deleted
+// from one target and inserted into another.
+func (r *replicator) applySharded(ctx context.Context, change WAL2JSONChange) (bool, error) {
+	var shard int
+	var err error
+	switch change.Action {
+	case "I":
+		shard, err = r.cfg.shardOf(r.values(change.Columns))
+	case "U":
+		shard, err = r.cfg.shardOf(r.values(change.Columns))
+		if err == nil && len(change.Identity) > 0 {
+			old, oldErr := r.cfg.shardOf(r.values(change.Identity))
+			switch {
+			case oldErr != nil:
+				err = fmt.Errorf("update: old row: %w; shard by id or use REPLICA IDENTITY FULL on the source", oldErr)
+			case old != shard:
+				err = fmt.Errorf("update moves the row from shard %d to shard %d; shard by a column that never changes, such as id", old, shard)
+			}
+		}
+	case "D":
+		shard, err = r.cfg.shardOf(r.values(change.Identity))
+		if err != nil {
+			err = fmt.Errorf("delete: %w; shard by id or use REPLICA IDENTITY FULL on the source", err)
+		}
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return r.shards[shard].apply(ctx, change)
+}
+
+// checkShards reports where the targets' rows are mapped. Sharding by a
+// column other than id needs REPLICA IDENTITY FULL on the source, as
+// otherwise the old row of an update or delete does not carry the column
+// and the shard it was on is unknown.
+func (r *replicator) checkShards(ctx context.Context) {
+	if !r.sharded() {
+		return
+	}
+	if r.cfg.ShardByColumn != "id" {
+		full, err := replicaIdentityFull(ctx, r.source)
+		if err != nil {
+			log.Fatalf("%sCould not read the source's replica identity: %v", r.prefix, err)
+		}
+		if !full {
+			log.Fatalf("%s-shard-by-column %s needs REPLICA IDENTITY FULL on the source person table, or shard by id", r.prefix, r.cfg.ShardByColumn)
+		}
+	}
+	if r.cfg.ShardMapping == "range" {
+		r.printf("Sharding person by %s ranges %v over %d targets\n", r.cfg.ShardByColumn, r.cfg.ShardRanges, len(r.shards))
+		return
+	}
+	r.printf("Sharding person by %s modulo %d\n", r.cfg.ShardByColumn, len(r.shards))
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestShardOf(t *testing.T) {
+	modulo := config{ShardByColumn: "id", ShardMapping: "modulo", ShardDSNs: []string{"dbname=shard1"}}
+	ranges := config{ShardByColumn: "score", ShardMapping: "range", ShardRanges: []int64{10, 20}, ShardDSNs: []string{"dbname=shard1", "dbname=shard2"}}
+	tests := []struct {
+		name   string
+		cfg    config
+		values map[string]any
+		want   int
+	}{
+		{"even snapshot id", modulo, map[string]any{"id": 4}, 0},
+		{"odd snapshot id", modulo, map[string]any{"id": 7}, 1},
+		{"odd change id", modulo, map[string]any{"id": float64(3)}, 1},
+		{"negative id", modulo, map[string]any{"id": -3}, 1},
+		{"below first bound", ranges, map[string]any{"score": 9}, 0},
+		{"at first bound", ranges, map[string]any{"score": float64(10)}, 1},
+		{"past last bound", ranges, map[string]any{"score": 1000}, 2},
+	}
+	for _, tt := range tests {
+		got, err := tt.cfg.shardOf(tt.values)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: shard %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShardOfHashesText(t *testing.T) {
+	cfg := config{ShardByColumn: "name", ShardMapping: "modulo", ShardDSNs: []string{"dbname=shard1"}}
+	first, err := cfg.shardOf(map[string]any{"name": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if got, _ := cfg.shardOf(map[string]any{"name": "alice"}); got != first {
+			t.Fatalf("alice mapped to shard %d, then %d", first, got)
+		}
+	}
+}
+
+func TestShardOfErrors(t *testing.T) {
+	modulo := config{ShardByColumn: "id", ShardMapping: "modulo", ShardDSNs: []string{"dbname=shard1"}}
+	if _, err := modulo.shardOf(map[string]any{"name": "alice"}); err == nil {
+		t.Error("row without id: no error")
+	}
+	if _, err := modulo.shardOf(map[string]any{"id": nil}); err == nil {
+		t.Error("null id: no error")
+	}
+	ranges := config{ShardByColumn: "score", ShardMapping: "range", ShardRanges: []int64{10}, ShardDSNs: []string{"dbname=shard1"}}
+	if _, err := ranges.shardOf(map[string]any{"score": 1.5}); err == nil {
+		t.Error("fractional score in range mapping: no error")
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is a single row change handed to a Sink. Ops follow Debezium:
+// "r" for rows read by the snapshot, "c", "u" and "d" for CDC changes.
+type Event struct {
+	Op        string         `json:"op"`
+	Database  string         `json:"database"`
+	Schema    string         `json:"schema"`
+	Table     string         `json:"table"`
+	Before    map[string]any `json:"before"` // identity columns for updates and deletes
+	After     map[string]any `json:"after"`  // all columns for reads, inserts and updates
+	LSN       string         `json:"lsn,omitempty"`
+	XID       uint32         `json:"xid,omitempty"`
+	Timestamp string         `json:"timestamp,omitempty"` // source commit time, empty for snapshot reads
+}
+
+// Sink receives every change the replicator copies, in addition to the
+// target database.
+type Sink interface {
+	Emit(ev Event) error
+	Close() error
+}
+
+// Flusher is implemented by sinks that buffer events. The replicator only
+// records progress past a batch of changes once Flush has succeeded.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// flushSink flushes s if it buffers events.
+func flushSink(ctx context.Context, s Sink) error {
+	if f, ok := s.(Flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+// Txn identifies a source transaction to the hooks of a TxnSink. LSN is that
+// of the transaction's begin or commit record.
+type Txn struct {
+	Database string `json:"database"`
+	XID      uint32 `json:"xid"`
+	LSN      string `json:"lsn"`
+}
+
+// TxnSink is implemented by sinks that mark transaction boundaries. With
+// -sink-txn-markers, the events of each source transaction are emitted
+// between a Begin and a Commit. A Begin without its Commit means the
+// replicator stopped within the transaction, which is emitted again in full.
+type TxnSink interface {
+	Begin(txn Txn) error
+	Commit(txn Txn) error
+}
+
+// markTxn hands s the begin or commit of txn if it marks transactions.
+func markTxn(s Sink, txn Txn, commit bool) error {
+	t, ok := s.(TxnSink)
+	if !ok {
+		return nil
+	}
+	if commit {
+		return t.Commit(txn)
+	}
+	return t.Begin(txn)
+}
+
+// openSink opens the sink named by -sink: "stdout", "file:PATH" or "nats".
+// -envelope selects the document shape, "plain" or "debezium".
+func openSink(cfg config) (Sink, error) {
+	spec, envelope := cfg.Sink, cfg.Envelope
+	if envelope != "plain" && envelope != "debezium" {
+		return nil, fmt.Errorf("unknown envelope %q", envelope)
+	}
+	switch {
+	case spec == "nats":
+		return openNATSSink(cfg.NATSURL, cfg.NATSSubject, envelope)
+	case spec == "stdout":
+		return &jsonSink{w: bufio.NewWriter(os.Stdout), envelope: envelope}, nil
+	case strings.HasPrefix(spec, "file:"):
+		f, err := os.OpenFile(strings.TrimPrefix(spec, "file:"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonSink{w: bufio.NewWriter(f), file: f, envelope: envelope}, nil
+	}
+	return nil, fmt.Errorf("unknown sink %q", spec)
+}
+
+// jsonSink writes one JSON document per line. Output is buffered until
+// Flush, which also syncs a file sink to disk. It is shared by all sources in
+// fan-in mode, so writes are serialised.
+type jsonSink struct {
+	mu       sync.Mutex
+	w        *bufio.Writer
+	file     *os.File // nil for stdout
+	envelope string
+}
+
+// encodeEvent renders ev as a JSON document in the shape envelope selects.
+func encodeEvent(ev Event, envelope string) ([]byte, error) {
+	if envelope == "debezium" {
+		return json.Marshal(debeziumEnvelopeFor(ev))
+	}
+	return json.Marshal(ev)
+}
+
+// encodeTxn renders the begin or commit of txn as a JSON document: with the
+// debezium envelope, in the shape of Debezium's transaction metadata.
+func encodeTxn(txn Txn, commit bool, envelope string) ([]byte, error) {
+	if envelope == "debezium" {
+		status := "BEGIN"
+		if commit {
+			status = "END"
+		}
+		return json.Marshal(struct {
+			Status string `json:"status"`
+			ID     string `json:"id"`
+			TsMs   int64  `json:"ts_ms"`
+		}{status, fmt.Sprintf("%d:%d", txn.XID, parseLSN(txn.LSN)), time.Now().UnixMilli()})
+	}
+	op := "begin"
+	if commit {
+		op = "commit"
+	}
+	return json.Marshal(struct {
+		Op string `json:"op"`
+		Txn
+	}{op, txn})
+}
+
+func (s *jsonSink) Emit(ev Event) error {
+	b, err := encodeEvent(ev, s.envelope)
+	if err != nil {
+		return err
+	}
+	return s.write(b)
+}
+
+func (s *jsonSink) Begin(txn Txn) error {
+	b, err := encodeTxn(txn, false, s.envelope)
+	if err != nil {
+		return err
+	}
+	return s.write(b)
+}
+
+func (s *jsonSink) Commit(txn Txn) error {
+	b, err := encodeTxn(txn, true, s.envelope)
+	if err != nil {
+		return err
+	}
+	return s.write(b)
+}
+
+// write writes the document b as a line.
+func (s *jsonSink) write(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(append(b, '\n'))
+	return err
+}
+
+func (s *jsonSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if s.file != nil {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+func (s *jsonSink) Close() error {
+	err := s.Flush(context.Background())
+	if s.file == nil {
+		return err
+	}
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// batchSink holds events back and hands them to the wrapped sink in batches
+// of size events, every interval, or when flushed, whichever comes first. A
+// zero size or interval disables that trigger.
+type batchSink struct {
+	mu      sync.Mutex
+	inner   Sink
+	size    int
+	pending []batchItem
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// batchItem is a held back event, or the begin or commit of a transaction,
+// which are held back in order with the events.
+type batchItem struct {
+	ev     Event
+	txn    *Txn
+	commit bool
+}
+
+func newBatchSink(inner Sink, size int, interval time.Duration) *batchSink {
+	s := &batchSink{inner: inner, size: size, stop: make(chan struct{}), done: make(chan struct{})}
+	go s.flushEvery(interval)
+	return s
+}
+
+func (s *batchSink) flushEvery(interval time.Duration) {
+	defer close(s.done)
+	if interval <= 0 {
+		<-s.stop
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.Flush(context.Background()); err != nil {
+				log.Printf("Failed to flush sink: %v", err)
+			}
+		}
+	}
+}
+
+func (s *batchSink) Emit(ev Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, batchItem{ev: ev})
+	if s.size > 0 && len(s.pending) >= s.size {
+		return s.flushLocked(context.Background())
+	}
+	return nil
+}
+
+func (s *batchSink) Begin(txn Txn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, batchItem{txn: &txn})
+	return nil
+}
+
+func (s *batchSink) Commit(txn Txn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, batchItem{txn: &txn, commit: true})
+	if s.size > 0 && len(s.pending) >= s.size {
+		return s.flushLocked(context.Background())
+	}
+	return nil
+}
+
+func (s *batchSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushLocked(ctx)
+}
+
+// flushLocked emits the pending events in order. Events the inner sink
+// rejects stay pending and are retried on the next flush.
+func (s *batchSink) flushLocked(ctx context.Context) error {
+	for i, item := range s.pending {
+		var err error
+		if item.txn != nil {
+			err = markTxn(s.inner, *item.txn, item.commit)
+		} else {
+			err = s.inner.Emit(item.ev)
+		}
+		if err != nil {
+			s.pending = s.pending[i:]
+			return err
+		}
+	}
+	s.pending = s.pending[:0]
+	return flushSink(ctx, s.inner)
+}
+
+func (s *batchSink) Close() error {
+	close(s.stop)
+	<-s.done
+	err := s.Flush(context.Background())
+	if cerr := s.inner.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type debeziumEnvelope struct {
+	Op     string         `json:"op"`
+	Before map[string]any `json:"before"`
+	After  map[string]any `json:"after"`
+	Source debeziumSource `json:"source"`
+	TsMs   int64          `json:"ts_ms"`
+}
+
+type debeziumSource struct {
+	Connector string `json:"connector"`
+	DB        string `json:"db"`
+	Schema    string `json:"schema"`
+	Table     string `json:"table"`
+	LSN       uint64 `json:"lsn,omitempty"`
+	TxID      uint32 `json:"txId,omitempty"`
+	TsMs      int64  `json:"ts_ms"`
+	Snapshot  string `json:"snapshot"`
+}
+
+func debeziumEnvelopeFor(ev Event) debeziumEnvelope {
+	now := time.Now()
+	src := debeziumSource{
+		Connector: "postgresql",
+		DB:        ev.Database,
+		Schema:    ev.Schema,
+		Table:     ev.Table,
+		LSN:       parseLSN(ev.LSN),
+		TxID:      ev.XID,
+		TsMs:      now.UnixMilli(),
+		Snapshot:  strconv.FormatBool(ev.Op == "r"),
+	}
+	if ts, err := parseTimestamp(ev.Timestamp); err == nil {
+		src.TsMs = ts.UnixMilli()
+	}
+	return debeziumEnvelope{
+		Op:     ev.Op,
+		Before: ev.Before,
+		After:  ev.After,
+		Source: src,
+		TsMs:   now.UnixMilli(),
+	}
+}
+
+// parseLSN converts a textual LSN such as "0/16B3748" to its numeric form,
+// returning 0 if lsn is empty or malformed.
+func parseLSN(lsn string) uint64 {
+	hi, lo, ok := strings.Cut(lsn, "/")
+	if !ok {
+		return 0
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0
+	}
+	return h<<32 | l
+}
+
+// dedupeSink drops events it has already emitted, for consumers of
+// at-least-once sinks: a crash before progress is recorded makes the
+// replicator read and emit the last changes again. Events are keyed by
+// database, table, LSN and xid, which are also in every document for
+// consumer-side deduplication; snapshot reads have no LSN and always pass.
+// The window of remembered keys is saved after every successful flush if it
+// has a file.
+type dedupeSink struct {
+	inner Sink
+	seen  *seenChanges
+}
+
+func dedupeKey(ev Event) string {
+	return fmt.Sprintf("%s/%s.%s/%s/%d", ev.Database, ev.Schema, ev.Table, ev.LSN, ev.XID)
+}
+
+// txnKey is the dedupeKey of the begin or commit of txn.
+func txnKey(txn Txn, commit bool) string {
+	return fmt.Sprintf("%s/txn/%s/%d/%t", txn.Database, txn.LSN, txn.XID, commit)
+}
+
+func (s *dedupeSink) Emit(ev Event) error {
+	if ev.LSN == "" {
+		return s.inner.Emit(ev)
+	}
+	key := dedupeKey(ev)
+	if s.seen.has(key) {
+		return nil
+	}
+	if err := s.inner.Emit(ev); err != nil {
+		return err
+	}
+	s.seen.remember(key)
+	return nil
+}
+
+func (s *dedupeSink) Begin(txn Txn) error {
+	return s.markTxn(txn, false)
+}
+
+func (s *dedupeSink) Commit(txn Txn) error {
+	return s.markTxn(txn, true)
+}
+
+// markTxn passes on the begin or commit of txn unless it was passed on
+// before, so that a transaction emitted again is not marked twice.
+func (s *dedupeSink) markTxn(txn Txn, commit bool) error {
+	key := txnKey(txn, commit)
+	if s.seen.has(key) {
+		return nil
+	}
+	if err := markTxn(s.inner, txn, commit); err != nil {
+		return err
+	}
+	s.seen.remember(key)
+	return nil
+}
+
+func (s *dedupeSink) Flush(ctx context.Context) error {
+	if err := flushSink(ctx, s.inner); err != nil {
+		return err
+	}
+	return s.seen.save()
+}
+
+func (s *dedupeSink) Close() error {
+	err := s.inner.Close()
+	if serr := s.seen.save(); err == nil {
+		err = serr
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseLSN(t *testing.T) {
+	tests := []struct {
+		lsn  string
+		want uint64
+	}{
+		{"0/16B3748", 0x16B3748},
+		{"1/0", 1 << 32},
+		{"FFFFFFFF/FFFFFFFF", 1<<64 - 1},
+		{"a/b", 0xa<<32 | 0xb},
+		{"", 0},
+		{"16B3748", 0},
+		{"0/xyz", 0},
+		{"100000000/0", 0},
+		{"0/-1", 0},
+	}
+	for _, tt := range tests {
+		if got := parseLSN(tt.lsn); got != tt.want {
+			t.Errorf("parseLSN(%q) = %#x, want %#x", tt.lsn, got, tt.want)
+		}
+	}
+	if parseLSN("0/16B3748") >= parseLSN("1/0") {
+		t.Error("LSNs do not order by their high half first")
+	}
+}
+
+func TestEncodeEventDebezium(t *testing.T) {
+	committed := time.Date(2024, 1, 2, 3, 4, 5, 678e6, time.UTC)
+	row, old := map[string]any{"id": 1.0, "name": "Ada"}, map[string]any{"id": 1.0}
+	tests := []struct {
+		ev                    Event
+		wantBefore, wantAfter map[string]any
+	}{
+		{Event{Op: "c", After: row, LSN: "0/16B3748", XID: 7, Timestamp: "2024-01-02 03:04:05.678+00"}, nil, row},
+		{Event{Op: "u", Before: old, After: row, LSN: "0/16B3748", XID: 7, Timestamp: "2024-01-02 03:04:05.678+00"}, old, row},
+		{Event{Op: "d", Before: old, LSN: "0/16B3748", XID: 7, Timestamp: "2024-01-02 03:04:05.678+00"}, old, nil},
+		{Event{Op: "r", After: row}, nil, row},
+	}
+	for _, tt := range tests {
+		tt.ev.Database, tt.ev.Schema, tt.ev.Table = "testdb", "public", "person"
+		start := time.Now().UnixMilli()
+		b, err := encodeEvent(tt.ev, "debezium")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc map[string]any
+		if err := json.Unmarshal(b, &doc); err != nil {
+			t.Fatal(err)
+		}
+		var keys []string
+		for key := range doc {
+			keys = append(keys, key)
+		}
+		if slices.Sort(keys); !slices.Equal(keys, []string{"after", "before", "op", "source", "ts_ms"}) {
+			t.Errorf("%s: keys %q, want after, before, op, source and ts_ms", tt.ev.Op, keys)
+		}
+		if doc["op"] != tt.ev.Op {
+			t.Errorf("%s: op %v", tt.ev.Op, doc["op"])
+		}
+		if before, _ := json.Marshal(doc["before"]); string(before) != mustJSON(t, tt.wantBefore) {
+			t.Errorf("%s: before %s, want %s", tt.ev.Op, before, mustJSON(t, tt.wantBefore))
+		}
+		if after, _ := json.Marshal(doc["after"]); string(after) != mustJSON(t, tt.wantAfter) {
+			t.Errorf("%s: after %s, want %s", tt.ev.Op, after, mustJSON(t, tt.wantAfter))
+		}
+		if ts, _ := doc["ts_ms"].(float64); int64(ts) < start || int64(ts) > time.Now().UnixMilli() {
+			t.Errorf("%s: ts_ms %v, want the time of encoding", tt.ev.Op, doc["ts_ms"])
+		}
+
+		source, _ := doc["source"].(map[string]any)
+		want := map[string]any{"connector": "postgresql", "db": "testdb", "schema": "public", "table": "person", "snapshot": "false", "lsn": float64(0x16B3748), "txId": 7.0, "ts_ms": float64(committed.UnixMilli())}
+		if tt.ev.Op == "r" {
+			// A snapshot read has no position or commit time
+			want["snapshot"] = "true"
+			delete(want, "lsn")
+			delete(want, "txId")
+			want["ts_ms"] = source["ts_ms"]
+			if ts, _ := source["ts_ms"].(float64); int64(ts) < start {
+				t.Errorf("r: source ts_ms %v, want the time of encoding", source["ts_ms"])
+			}
+		}
+		if got, want := mustJSON(t, source), mustJSON(t, want); got != want {
+			t.Errorf("%s: source %s, want %s", tt.ev.Op, got, want)
+		}
+	}
+}
+
+func TestEncodeTxnDebezium(t *testing.T) {
+	for _, commit := range []bool{false, true} {
+		b, err := encodeTxn(Txn{XID: 7, LSN: "0/10"}, commit, "debezium")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc struct {
+			Status string `json:"status"`
+			ID     string `json:"id"`
+			TsMs   int64  `json:"ts_ms"`
+		}
+		if err := json.Unmarshal(b, &doc); err != nil {
+			t.Fatal(err)
+		}
+		want := map[bool]string{false: "BEGIN", true: "END"}[commit]
+		if doc.Status != want || doc.ID != "7:16" || doc.TsMs == 0 {
+			t.Errorf("commit %v: %s, want status %s and id 7:16", commit, b, want)
+		}
+	}
+}
+
+// mustJSON returns v as JSON, whose objects have sorted keys.
+func mustJSON(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// createSlot sets up the replication slot using the wal2json plugin,
+// replacing any existing slot of the same name.
+func (r *replicator) createSlot(ctx context.Context) {
+	if r.cfg.TemporarySlot {
+		r.createTemporarySlot(ctx)
+		return
+	}
+	var slotExists bool
+	checkSlotSQL := `SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)`
+	err := r.source.QueryRow(ctx, checkSlotSQL, r.slotName).Scan(&slotExists)
+	if err != nil {
+		log.Fatalf("%sWarning: Could not check if slot exists: %v", r.prefix, err)
+	}
+
+	if slotExists {
+		dropSlotSQL := `SELECT pg_drop_replication_slot($1)`
+		_, err = r.source.Exec(ctx, dropSlotSQL, r.slotName)
+		if err != nil {
+			log.Fatalf("%sWarning: Could not drop existing slot: %v", r.prefix, err)
+		}
+	}
+
+	createSlotSQL := `SELECT pg_create_logical_replication_slot($1, 'wal2json')`
+	_, err = r.source.Exec(ctx, createSlotSQL, r.slotName)
+	if err != nil {
+		log.Fatalf("%sWarning: Could not create replication slot (might already exist): %v", r.prefix, err)
+	} else {
+		r.printf("Created replication slot: %s\n", r.slotName)
+	}
+}
+
+// logConsistentPoint reports the LSN from which the slot returns changes.
+func (r *replicator) logConsistentPoint(ctx context.Context) {
+	var lsn string
+	err := r.source.QueryRow(ctx, `SELECT confirmed_flush_lsn::text FROM pg_replication_slots WHERE slot_name = $1`, r.slotName).Scan(&lsn)
+	if err != nil {
+		log.Printf("%sWarning: Could not read slot position: %v", r.prefix, err)
+		return
+	}
+	r.printf("Streaming changes from LSN %s\n", lsn)
+}
+
+// ensureSlot creates the replication slot unless it already exists, keeping
+// an existing slot and its position.
+func (r *replicator) ensureSlot(ctx context.Context) {
+	if r.cfg.TemporarySlot {
+		r.createTemporarySlot(ctx)
+		return
+	}
+	var slotExists bool
+	err := r.source.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)`, r.slotName).Scan(&slotExists)
+	if err != nil {
+		log.Fatalf("%sCould not check if slot exists: %v", r.prefix, err)
+	}
+	if slotExists {
+		r.printf("Using existing replication slot: %s\n", r.slotName)
+		return
+	}
+	_, err = r.source.Exec(ctx, `SELECT pg_create_logical_replication_slot($1, 'wal2json')`, r.slotName)
+	if err != nil {
+		log.Fatalf("%sCould not create replication slot: %v", r.prefix, err)
+	}
+	r.printf("Created replication slot: %s\n", r.slotName)
+}
+
+// attachSlot checks that the replication slot already exists and uses
+// wal2json, for -cdc-only runs that continue from a -snapshot-only run and
+// for slots provisioned elsewhere given by -attach-slot.
+func (r *replicator) attachSlot(ctx context.Context) {
+	var plugin string
+	err := r.source.QueryRow(ctx, `SELECT plugin FROM pg_replication_slots WHERE slot_name = $1`, r.slotName).Scan(&plugin)
+	if errors.Is(err, pgx.ErrNoRows) && r.cfg.CDCOnly {
+		log.Fatalf("%sReplication slot %s does not exist; create it with -snapshot-only first", r.prefix, r.slotName)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		log.Fatalf("%sReplication slot %s does not exist on this source", r.prefix, r.slotName)
+	}
+	if err != nil {
+		log.Fatalf("%sCould not look up replication slot: %v", r.prefix, err)
+	}
+	if plugin != "wal2json" {
+		log.Fatalf("%sReplication slot %s uses %s, not wal2json", r.prefix, r.slotName, plugin)
+	}
+	r.printf("Attached to existing replication slot: %s\n", r.slotName)
+}
+
+// attachedSlotNeedsSnapshot decides whether an -attach-slot slot needs a
+// snapshot first. With no progress recorded on the target for the slot, the
+// target was never seeded from it. Progress is the position poll advanced
+// the slot to, so after a clean stop it equals the slot's
+// confirmed_flush_lsn. If that is past the recorded progress, something else
+// consumed changes from it that the target never saw, or the replicator died
+// between advancing the slot and recording it; either way a snapshot is
+// safe. Otherwise the replicator resumes where it left off. When sharded, the
+// target furthest behind decides.
+func (r *replicator) attachedSlotNeedsSnapshot(ctx context.Context) bool {
+	var confirmed string
+	err := r.source.QueryRow(ctx, `SELECT COALESCE(confirmed_flush_lsn, '0/0')::text FROM pg_replication_slots WHERE slot_name = $1`, r.slotName).Scan(&confirmed)
+	if err != nil {
+		log.Fatalf("%sCould not read slot position: %v", r.prefix, err)
+	}
+	for _, shard := range r.targets() {
+		var progress string
+		err = shard.target.QueryRow(ctx, `SELECT lsn::text FROM `+r.cfg.progressTable()+` WHERE slot_name = $1 AND source_id = $2`, r.slotName, r.sourceID).Scan(&progress)
+		switch {
+		case errors.Is(err, pgx.ErrNoRows):
+			shard.printf("No progress recorded for slot %s, snapshotting before streaming from %s\n", r.slotName, confirmed)
+			return true
+		case err != nil:
+			log.Fatalf("%sCould not read progress: %v", shard.prefix, err)
+		case parseLSN(confirmed) > parseLSN(progress):
+			log.Printf("%sWarning: slot %s was consumed up to %s, past the recorded progress %s; snapshotting to cover the changes read elsewhere", shard.prefix, r.slotName, confirmed, progress)
+			return true
+		}
+	}
+	r.printf("Resuming slot %s from %s\n", r.slotName, confirmed)
+	return false
+}
+
+// createTemporarySlot creates a temporary slot on a source connection that is
+// held for the rest of the run. Postgres drops the slot when that connection
+// closes, including when the process dies, and only that connection may read
+// from it, so poll uses it.
+func (r *replicator) createTemporarySlot(ctx context.Context) {
+	conn, err := r.source.Acquire(ctx)
+	if err != nil {
+		log.Fatalf("%sCould not acquire a connection for the temporary slot: %v", r.prefix, err)
+	}
+	_, err = conn.Exec(ctx, `SELECT pg_create_logical_replication_slot($1, 'wal2json', true)`, r.slotName)
+	if err != nil {
+		conn.Release()
+		log.Fatalf("%sCould not create temporary replication slot: %v", r.prefix, err)
+	}
+	r.slotConn = conn
+	r.printf("Created temporary replication slot: %s\n", r.slotName)
+}
+
+// releaseSlotConn returns the connection holding a temporary slot to the
+// pool, so that closing the pool closes it and drops the slot.
+func (r *replicator) releaseSlotConn() {
+	if r.slotConn != nil {
+		r.slotConn.Release()
+		r.slotConn = nil
+	}
+}
+
+// pingSlotConn keeps the connection holding a -temporary-slot in use while
+// nothing is polled on it, so that intermediaries do not drop it as idle. A
+// dropped connection takes its temporary slot with it.
+func (r *replicator) pingSlotConn(ctx context.Context) {
+	if r.slotConn == nil {
+		return
+	}
+	if err := r.slotConn.Ping(ctx); err != nil {
+		log.Printf("%sWarning: Connection holding temporary slot %s failed: %v", r.prefix, r.slotName, err)
+	}
+}
+
+// advanceSlot consumes the changes in the slot up to lsn, on the connection
+// holding a -temporary-slot if there is one, and returns the position the
+// slot is at now.
+func (r *replicator) advanceSlot(ctx context.Context, lsn string) (string, error) {
+	const sql = `SELECT end_lsn::text FROM pg_replication_slot_advance($1, $2::pg_lsn)`
+	queryRow := r.source.QueryRow
+	if r.slotConn != nil {
+		queryRow = r.slotConn.QueryRow
+	}
+	var advanced string
+	err := queryRow(ctx, sql, r.slotName, lsn).Scan(&advanced)
+	return advanced, err
+}
+
+// dropSlotOnExit drops the slot once streaming has stopped, for
+// -drop-slot-on-clean-exit, so that a finished migration stops retaining WAL
+// on the source. It only does so after a clean stop, when streamErr is nil
+// and every change consumed has been applied and checkpointed. After a failed
+// poll or a drain cut short by -drain-timeout the slot may still hold changes
+// and is kept to resume from, as it is when the replicator dies on an error.
+func (r *replicator) dropSlotOnExit(ctx context.Context, streamErr error) {
+	if streamErr != nil {
+		log.Printf("%sKeeping slot %s to resume from, streaming stopped on an error: %v", r.prefix, r.slotName, streamErr)
+		return
+	}
+	if _, err := r.source.Exec(ctx, `SELECT pg_drop_replication_slot($1)`, r.slotName); err != nil {
+		log.Printf("%sWarning: Could not drop slot %s on exit: %v", r.prefix, r.slotName, err)
+		return
+	}
+	r.printf("Dropped replication slot %s on clean exit\n", r.slotName)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// snapshot bulk copies the rows already in the source into the target.
+func (r *replicator) snapshot(ctx context.Context) {
+	if r.cfg.MaxSnapshotRows > 0 {
+		estimate, err := r.estimateRows(ctx)
+		if err != nil {
+			log.Fatalf("%sFailed to estimate source rows: %v", r.prefix, err)
+		}
+		if estimate > r.cfg.MaxSnapshotRows {
+			if r.cfg.SnapshotOverLimit != "cdc-only" {
+				log.Fatalf("%sSource has about %d rows, more than -max-snapshot-rows %d; aborting", r.prefix, estimate, r.cfg.MaxSnapshotRows)
+			}
+			log.Printf("%sWarning: Source has about %d rows, more than -max-snapshot-rows %d; skipping snapshot, existing rows will not be copied", r.prefix, estimate, r.cfg.MaxSnapshotRows)
+			return
+		}
+	}
+
+	// Bulk copy existing data
+	r.printf("\nStarting bulk copy of existing data...\n")
+	if r.cfg.SnapshotSamplePercent > 0 {
+		r.printf("Sampling %g%% of rows\n", r.cfg.SnapshotSamplePercent)
+	}
+	if r.cfg.SnapshotWhere != "" {
+		// Fail on a bad predicate before copying anything. Query, unlike
+		// Exec without arguments, allows only a single statement.
+		rows, err := r.source.Query(ctx, `EXPLAIN `+snapshotQuery("person", r.cfg.SnapshotSamplePercent, r.cfg.SnapshotWhere))
+		if err == nil {
+			rows.Close()
+			err = rows.Err()
+		}
+		if err != nil {
+			log.Fatalf("%sInvalid -snapshot-where %q: %v", r.prefix, r.cfg.SnapshotWhere, err)
+		}
+		r.printf("Copying only rows where %s\n", r.cfg.SnapshotWhere)
+	}
+
+	var total snapshotCount
+	if r.cfg.SnapshotWorkers > 1 {
+		total = r.parallelSnapshot(ctx)
+	} else {
+		total = r.copyTable(ctx, "person")
+	}
+	r.snapshotMaxID = max(r.snapshotMaxID, total.maxID)
+	if r.sink != nil {
+		if err := flushSink(ctx, r.sink); err != nil {
+			log.Printf("%sFailed to flush sink: %v", r.prefix, err)
+		}
+	}
+	r.metrics.addSnapshotRows(r.sourceIndex, total.rows-total.skipped, total.skipped)
+	if total.skipped > 0 {
+		r.printf("Bulk copied %d records, of which %d were already on the target and skipped\n", total.rows, total.skipped)
+		return
+	}
+	r.printf("Bulk copied %d records\n", total.rows)
+}
+
+// snapshotCount counts the rows a snapshot copied.
+type snapshotCount struct {
+	rows    int // read from the source
+	skipped int // already on the target and left alone by the insert's ON CONFLICT
+	maxID   int
+}
+
+func (c *snapshotCount) add(other snapshotCount) {
+	c.rows += other.rows
+	c.skipped += other.skipped
+	c.maxID = max(c.maxID, other.maxID)
+}
+
+// copyTable copies the rows of the source table into the target person
+// table.
+func (r *replicator) copyTable(ctx context.Context, table string) snapshotCount {
+	sql := snapshotQuery(table, r.cfg.SnapshotSamplePercent, r.cfg.SnapshotWhere)
+	if r.cfg.CursorFetchSize > 0 {
+		tx, err := r.source.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+		if err != nil {
+			log.Fatalf("%sFailed to start snapshot transaction: %v", r.prefix, err)
+		}
+		defer tx.Rollback(ctx)
+		return r.copyCursor(ctx, tx, sql)
+	}
+	rows, err := r.source.Query(ctx, sql)
+	if err != nil {
+		log.Fatalf("%sFailed to query source data: %v", r.prefix, err)
+	}
+	return r.copyRows(ctx, rows)
+}
+
+// copyRows inserts the source rows read by rows, ordered by id, into the
+// target in batches, a batch per target when sharded.
+func (r *replicator) copyRows(ctx context.Context, rows pgx.Rows) snapshotCount {
+	defer rows.Close()
+	stmts := r.stmts
+
+	var count snapshotCount
+	targets := r.targets()
+	batches := make([]*pgx.Batch, len(targets))
+	for i := range batches {
+		batches[i] = &pgx.Batch{}
+	}
+
+	for rows.Next() {
+		var p Person
+		err := rows.Scan(&p.ID, &p.Name, &p.UID, &p.Score, &p.CreatedAt)
+		if err != nil {
+			log.Printf("%sFailed to scan row: %v", r.prefix, err)
+			continue
+		}
+		shard := 0
+		if r.sharded() {
+			if shard, err = r.cfg.shardOf(p.values()); err != nil {
+				log.Printf("%sSkipping row %d: %v", r.prefix, p.ID, err)
+				continue
+			}
+		}
+
+		batch := batches[shard]
+		batch.Queue(stmts.snapshotInsert, r.snapshotArgs(p)...)
+		count.rows++
+		count.maxID = p.ID
+		r.emit(Event{Op: "r", Schema: "public", Table: "person", After: p.values()})
+
+		// Execute batch every 100 rows
+		if batch.Len() >= 100 {
+			skipped, err := targets[shard].sendSnapshotBatch(ctx, batch)
+			if err != nil {
+				log.Printf("%sFailed to execute batch: %v", targets[shard].prefix, err)
+			}
+			count.skipped += skipped
+			batches[shard] = &pgx.Batch{}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("%sFailed to read source data: %v", r.prefix, err)
+	}
+	for shard, batch := range batches {
+		if batch.Len() == 0 {
+			continue
+		}
+		skipped, err := targets[shard].sendSnapshotBatch(ctx, batch)
+		if err != nil {
+			log.Printf("%sFailed to execute final batch: %v", targets[shard].prefix, err)
+		}
+		count.skipped += skipped
+	}
+	return count
+}
+
+// sendSnapshotBatch executes batch on the target, returning how many of its
+// inserts affected no row: by default and with -insert-conflict do-nothing,
+// those of rows already on the target. With do-update such rows are
+// overwritten, and count as copied.
+func (r *replicator) sendSnapshotBatch(ctx context.Context, batch *pgx.Batch) (int, error) {
+	br := r.target.SendBatch(ctx, batch)
+	skipped := 0
+	for i := 0; i < batch.Len(); i++ {
+		tag, err := br.Exec()
+		if err != nil {
+			br.Close()
+			return skipped, err
+		}
+		if tag.RowsAffected() == 0 {
+			skipped++
+		}
+	}
+	return skipped, br.Close()
+}
+
+// copyCursor copies the rows read by sql through a server-side cursor in tx,
+// fetching -cursor-fetch-size rows at a time, so that only that many source
+// rows are held in memory however wide they are. The cursor is closed with
+// tx.
+func (r *replicator) copyCursor(ctx context.Context, tx pgx.Tx, sql string, args ...any) snapshotCount {
+	if _, err := tx.Exec(ctx, `DECLARE snapshot_rows NO SCROLL CURSOR FOR `+sql, args...); err != nil {
+		log.Fatalf("%sFailed to declare snapshot cursor: %v", r.prefix, err)
+	}
+	fetch := fmt.Sprintf(`FETCH FORWARD %d FROM snapshot_rows`, r.cfg.CursorFetchSize)
+	var count snapshotCount
+	for {
+		rows, err := tx.Query(ctx, fetch)
+		if err != nil {
+			log.Fatalf("%sFailed to fetch source data: %v", r.prefix, err)
+		}
+		count.add(r.copyRows(ctx, rows))
+		if rows.CommandTag().RowsAffected() < int64(r.cfg.CursorFetchSize) {
+			return count
+		}
+	}
+}
+
+// parallelSnapshot copies the source rows with -snapshot-workers workers,
+// each reading an even share of the id range on its own connection. The
+// workers all import a snapshot exported by a coordinating transaction, so
+// together they read the table exactly as of one point in time.
+func (r *replicator) parallelSnapshot(ctx context.Context) snapshotCount {
+	coordinator, err := r.source.Begin(ctx)
+	if err != nil {
+		log.Fatalf("%sFailed to start snapshot transaction: %v", r.prefix, err)
+	}
+	defer coordinator.Rollback(ctx)
+	var snapshotID string
+	var minID, maxID int
+	_, err = coordinator.Exec(ctx, `SET TRANSACTION ISOLATION LEVEL REPEATABLE READ`)
+	if err == nil {
+		err = coordinator.QueryRow(ctx, `SELECT pg_export_snapshot()`).Scan(&snapshotID)
+	}
+	if err == nil {
+		err = coordinator.QueryRow(ctx, `SELECT COALESCE(MIN(id), 0), COALESCE(MAX(id), -1) FROM person`+snapshotWhere(r.cfg.SnapshotWhere, "WHERE")).Scan(&minID, &maxID)
+	}
+	if err != nil {
+		log.Fatalf("%sFailed to export snapshot: %v", r.prefix, err)
+	}
+
+	workers := r.cfg.SnapshotWorkers
+	step := (maxID - minID + workers) / workers // ceiling of the range size over workers
+	r.printf("Copying ids %d to %d with %d workers\n", minID, maxID, workers)
+
+	var mu sync.Mutex
+	var total snapshotCount
+	var wg sync.WaitGroup
+	for lo := minID; lo <= maxID; lo += step {
+		hi := min(lo+step-1, maxID)
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer wg.Done()
+			count := r.copyRange(ctx, snapshotID, lo, hi)
+			mu.Lock()
+			defer mu.Unlock()
+			total.add(count)
+		}(lo, hi)
+	}
+	wg.Wait()
+	return total
+}
+
+// copyRange copies the source rows with ids in [lo, hi] as of the exported
+// snapshot snapshotID.
+func (r *replicator) copyRange(ctx context.Context, snapshotID string, lo, hi int) snapshotCount {
+	tx, err := r.source.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		log.Fatalf("%sFailed to start snapshot worker: %v", r.prefix, err)
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `SET TRANSACTION SNAPSHOT '`+snapshotID+`'`); err != nil {
+		log.Fatalf("%sFailed to import snapshot %s: %v", r.prefix, snapshotID, err)
+	}
+	sql := `
+		SELECT id, name, uid, score, created_at
+		FROM person
+		WHERE id BETWEEN $1 AND $2` + snapshotWhere(r.cfg.SnapshotWhere, "AND") + `
+		ORDER BY id`
+	if r.cfg.CursorFetchSize > 0 {
+		return r.copyCursor(ctx, tx, sql, lo, hi)
+	}
+	rows, err := tx.Query(ctx, sql, lo, hi)
+	if err != nil {
+		log.Fatalf("%sFailed to query source data: %v", r.prefix, err)
+	}
+	return r.copyRows(ctx, rows)
+}
+
+// snapshotArgs returns the arguments of the snapshot insert for p.
+func (r *replicator) snapshotArgs(p Person) []any {
+	if r.cfg.RowAsJSONB {
+		return []any{p.ID, p.values()}
+	}
+	return r.args(p.ID, p.Name, p.UID, p.Score, r.createdAt(p.CreatedAt))
+}
+
+// values maps p's columns by name, like the decoded values of a CDC change.
+func (p Person) values() map[string]any {
+	return map[string]any{
+		"id": p.ID, "name": p.Name, "uid": p.UID, "score": p.Score, "created_at": p.CreatedAt,
+	}
+}
+
+// snapshotQuery returns the query reading the rows of the source table. A
+// positive samplePercent reads a random subset using TABLESAMPLE; a where
+// predicate, from -snapshot-where, only the rows matching it.
+func snapshotQuery(table string, samplePercent float64, where string) string {
+	sample := ""
+	if samplePercent > 0 {
+		sample = fmt.Sprintf(" TABLESAMPLE BERNOULLI (%g)", samplePercent)
+	}
+	return `
+		SELECT id, name, uid, score, created_at
+		FROM ` + table + sample + snapshotWhere(where, "WHERE") + `
+		ORDER BY id`
+}
+
+// snapshotWhere returns the -snapshot-where predicate as a condition joined
+// by keyword, WHERE or AND, or "" if there is none.
+func snapshotWhere(where, keyword string) string {
+	if where == "" {
+		return ""
+	}
+	return " " + keyword + " (" + where + ")"
+}
+
+// estimateRows returns the planner's row estimate for the source table,
+// falling back to an exact count if the table has never been analyzed.
+func (r *replicator) estimateRows(ctx context.Context) (int64, error) {
+	var estimate int64
+	err := r.source.QueryRow(ctx, `SELECT reltuples::bigint FROM pg_class WHERE oid = 'person'::regclass`).Scan(&estimate)
+	if err != nil {
+		return 0, err
+	}
+	if estimate < 0 {
+		err = r.source.QueryRow(ctx, `SELECT COUNT(*) FROM person`).Scan(&estimate)
+	}
+	return estimate, err
+}
+
+// syncSequence moves the target's id sequence past the copied rows to avoid
+// conflicts. pg_get_serial_sequence finds the sequence of both serial and
+// identity columns, whatever it is named. In fan-in, jsonb, append-only and
+// -target-key modes the target has no id sequence: ids are always copied
+// from the source.
+func (r *replicator) syncSequence(ctx context.Context) {
+	if r.fanIn() || r.cfg.RowAsJSONB || r.cfg.AppendOnly || r.cfg.TargetKey != "id" {
+		return
+	}
+	if r.sharded() {
+		for _, shard := range r.shards {
+			shard.syncSequence(ctx)
+		}
+		return
+	}
+	var sequence *string
+	err := r.target.QueryRow(ctx, "SELECT pg_get_serial_sequence('person', 'id')").Scan(&sequence)
+	if err != nil {
+		log.Printf("Warning: Could not look up id sequence: %v", err)
+		return
+	}
+	if sequence == nil {
+		return
+	}
+	// Read from the primary: a lagging replica could return a stale maximum
+	var maxID int
+	err = r.target.QueryRow(ctx, "SELECT COALESCE(MAX(id), 0) FROM person").Scan(&maxID)
+	if err == nil && maxID > 0 {
+		_, err = r.target.Exec(ctx, "SELECT setval($1, $2)", *sequence, maxID)
+		if err != nil {
+			log.Printf("Warning: Could not update sequence: %v", err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// analyze runs the -target-none analysis mode: changes are decoded from each
+// source's slot and summarised in a periodic report, and nothing is written
+// anywhere apart from the -capture file.
+func analyze(ctx context.Context, cfg config) {
+	capturer, err := openCapture(cfg.Capture)
+	if err != nil {
+		log.Fatal("Failed to open capture file:", err)
+	}
+	defer capturer.Close()
+
+	var wg sync.WaitGroup
+	for i, dsn := range cfg.SourceDSNs {
+		sourcePool, err := newPool(ctx, dsn, cfg)
+		if err != nil {
+			log.Fatalf("Failed to connect to source database %d: %v", i+1, err)
+		}
+		defer sourcePool.Close()
+
+		r := &replicator{cfg: cfg, slotName: cfg.SlotName, source: sourcePool, stats: newChangeStats(), capture: capturer}
+		if len(cfg.SourceDSNs) > 1 {
+			r.sourceID = cfg.SourceIDs[i]
+			r.prefix = fmt.Sprintf("[source %d] ", r.sourceID)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer r.releaseSlotConn()
+			r.ensureSlot(ctx)
+			go r.reportStats(ctx)
+			r.stream(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// reportStats prints and resets the change statistics every
+// -report-interval.
+func (r *replicator) reportStats(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.ReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report := r.stats.report(r.cfg.ReportInterval, r.cfg.OutputFormat, r.sourceID)
+			if r.cfg.OutputFormat == "table" {
+				r.printf("%s", report)
+			} else if r.cfg.Verbosity >= normal {
+				fmt.Print(report) // unprefixed, so that it stays parseable
+			}
+		}
+	}
+}
+
+type tableAction struct {
+	table  string
+	action string
+}
+
+// changeStats accumulates statistics about the decoded changes of one report
+// interval.
+type changeStats struct {
+	mu         sync.Mutex
+	changes    int
+	bytes      int
+	byAction   map[tableAction]int
+	keys       map[string]int // "table id" to number of changes
+	colChanges map[int]int    // number of changed columns to number of updates
+	noBefore   int            // updates without a full before image
+
+	csvHeader bool // whether the -output-format csv header was printed
+}
+
+func newChangeStats() *changeStats {
+	s := &changeStats{}
+	s.reset()
+	return s
+}
+
+func (s *changeStats) reset() {
+	s.changes, s.bytes, s.noBefore = 0, 0, 0
+	s.byAction = make(map[tableAction]int)
+	s.keys = make(map[string]int)
+	s.colChanges = make(map[int]int)
+}
+
+// observe records a decoded change whose wal2json payload was size bytes.
+func (s *changeStats) observe(change WAL2JSONChange, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.changes++
+	s.bytes += size
+	table := change.Schema + "." + change.Table
+	s.byAction[tableAction{table, change.Action}]++
+
+	keyCols := change.Identity
+	if change.Action == "I" {
+		keyCols = change.Columns
+	}
+	if id, ok := columnValues(keyCols)["id"]; ok {
+		s.keys[fmt.Sprintf("%s id=%v", table, id)]++
+	}
+
+	if change.Action == "U" {
+		if changed, ok := changedColumns(change); ok {
+			s.colChanges[changed]++
+		} else {
+			s.noBefore++
+		}
+	}
+}
+
+// changedColumns counts the columns an update changed. This needs the full
+// old row, i.e. REPLICA IDENTITY FULL; with only the key in the identity it
+// reports false.
+func changedColumns(change WAL2JSONChange) (int, bool) {
+	if len(change.Identity) < len(change.Columns) {
+		return 0, false
+	}
+	before := columnValues(change.Identity)
+	changed := 0
+	for _, col := range change.Columns {
+		if !reflect.DeepEqual(before[col.Name], decodeValue(col)) {
+			changed++
+		}
+	}
+	return changed, true
+}
+
+// statsReport is the statistics of one report interval, for rendering in
+// the -output-format.
+type statsReport struct {
+	Source               int           `json:"source,omitempty"` // in fan-in mode
+	IntervalSeconds      float64       `json:"interval_seconds"`
+	Changes              int           `json:"changes"`
+	AverageRowBytes      int           `json:"average_row_bytes"`
+	Actions              []actionCount `json:"actions"`
+	HotKeys              []keyCount    `json:"hot_keys"`
+	ColumnsChanged       map[int]int   `json:"columns_changed_per_update,omitempty"`
+	UpdatesWithoutBefore int           `json:"updates_without_before_image"`
+}
+
+type actionCount struct {
+	Table   string `json:"table"`
+	Action  string `json:"action"`
+	Changes int    `json:"changes"`
+}
+
+type keyCount struct {
+	Key     string `json:"key"`
+	Changes int    `json:"changes"`
+}
+
+// report renders the statistics collected over interval from source (0
+// unless in fan-in mode) in format and resets them.
+func (s *changeStats) report(interval time.Duration, format string, source int) string {
+	rep := s.collect(interval)
+	rep.Source = source
+	switch format {
+	case "json":
+		b, _ := json.Marshal(rep)
+		return string(b) + "\n"
+	case "csv":
+		var b strings.Builder
+		w := csv.NewWriter(&b)
+		if !s.csvHeader {
+			w.Write([]string{"time", "source", "table", "action", "changes"})
+			s.csvHeader = true
+		}
+		now := time.Now().UTC().Format(time.RFC3339)
+		for _, a := range rep.Actions {
+			w.Write([]string{now, strconv.Itoa(source), a.Table, a.Action, strconv.Itoa(a.Changes)})
+		}
+		w.Flush()
+		return b.String()
+	}
+	return rep.table(interval)
+}
+
+// collect returns the statistics collected over interval and resets them.
+func (s *changeStats) collect(interval time.Duration) statsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.reset()
+
+	rep := statsReport{IntervalSeconds: interval.Seconds(), Changes: s.changes, UpdatesWithoutBefore: s.noBefore}
+	if s.changes == 0 {
+		return rep
+	}
+	rep.AverageRowBytes = s.bytes / s.changes
+
+	for ta, n := range s.byAction {
+		rep.Actions = append(rep.Actions, actionCount{ta.table, ta.action, n})
+	}
+	sort.Slice(rep.Actions, func(i, j int) bool {
+		if rep.Actions[i].Table != rep.Actions[j].Table {
+			return rep.Actions[i].Table < rep.Actions[j].Table
+		}
+		return rep.Actions[i].Action < rep.Actions[j].Action
+	})
+
+	for k, n := range s.keys {
+		rep.HotKeys = append(rep.HotKeys, keyCount{k, n})
+	}
+	sort.Slice(rep.HotKeys, func(i, j int) bool { return rep.HotKeys[i].Changes > rep.HotKeys[j].Changes })
+	rep.HotKeys = rep.HotKeys[:min(5, len(rep.HotKeys))]
+
+	if len(s.colChanges) > 0 {
+		rep.ColumnsChanged = make(map[int]int, len(s.colChanges))
+		for n, updates := range s.colChanges {
+			rep.ColumnsChanged[n] = updates
+		}
+	}
+	return rep
+}
+
+// table renders the report as aligned text.
+func (rep statsReport) table(interval time.Duration) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Change statistics for the last %v:\n", interval)
+	fmt.Fprintf(&b, "  Changes: %d (%.1f/s)\n", rep.Changes, float64(rep.Changes)/interval.Seconds())
+	if rep.Changes == 0 {
+		return b.String()
+	}
+	fmt.Fprintf(&b, "  Average row size: %d bytes\n", rep.AverageRowBytes)
+
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  TABLE\tACTION\tCHANGES")
+	for _, a := range rep.Actions {
+		fmt.Fprintf(w, "  %s\t%s\t%d\n", a.Table, a.Action, a.Changes)
+	}
+	w.Flush()
+
+	fmt.Fprintln(&b, "  Hot keys:")
+	for _, k := range rep.HotKeys {
+		fmt.Fprintf(&b, "    %s: %d\n", k.Key, k.Changes)
+	}
+
+	if len(rep.ColumnsChanged) > 0 {
+		fmt.Fprintln(&b, "  Columns changed per update:")
+		counts := make([]int, 0, len(rep.ColumnsChanged))
+		for n := range rep.ColumnsChanged {
+			counts = append(counts, n)
+		}
+		sort.Ints(counts)
+		for _, n := range counts {
+			fmt.Fprintf(&b, "    %d: %d\n", n, rep.ColumnsChanged[n])
+		}
+	}
+	if rep.UpdatesWithoutBefore > 0 {
+		fmt.Fprintf(&b, "  %d updates had no full before image (needs REPLICA IDENTITY FULL)\n", rep.UpdatesWithoutBefore)
+	}
+	return b.String()
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// stream polls the slot for changes using pg_logical_slot_peek_changes and
+// applies them to the target until r.stop is closed. A poll in progress is
+// finished first, so every change already read from the slot is applied and
+// checkpointed. It returns nil on such a clean stop, or the error of the
+// last poll, or of a drain cut short, if changes may be left in the slot.
+func (r *replicator) stream(ctx context.Context) error {
+	r.printf("\nStarting CDC (Change Data Capture)...\n")
+	interval := min(max(2*time.Second, r.cfg.MinPoll), r.cfg.MaxPoll)
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	reconciled := false
+	lastActive, lastIdleLog := time.Now(), time.Now()
+	var pollErr error // of the last poll
+	for {
+		select {
+		case <-r.stop:
+			r.printf("Stopped streaming\n")
+			if pollErr != nil {
+				return pollErr
+			}
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if !r.breaker.allow(time.Now()) {
+			r.debugf("circuit breaker open, not polling\n")
+			r.pingSlotConn(ctx)
+			timer.Reset(interval)
+			continue
+		}
+
+		// With -poll-limit, keep polling until a poll returns less than the
+		// limit, i.e. until caught up, or until asked to stop.
+		idle, busy := true, false
+		for {
+			fetched, err := r.poll(ctx)
+			pollErr = err
+			if err != nil {
+				log.Printf("%sFailed to poll changes: %v", r.prefix, err)
+				idle = false
+				break
+			}
+			if fetched > 0 {
+				idle, busy = false, true
+				lastActive = time.Now()
+			}
+			if r.cfg.PollLimit == 0 || fetched < r.cfg.PollLimit || r.stopping() {
+				break
+			}
+		}
+		r.updateHealth(ctx, busy)
+		interval = nextPollInterval(interval, busy, r.cfg.MinPoll, r.cfg.MaxPoll)
+		r.metrics.setPollInterval(r.sourceIndex, interval)
+		timer.Reset(interval)
+
+		// Heartbeat so that an idle replicator can be told apart from a hung
+		// one
+		if idle && r.cfg.IdleLogInterval > 0 && time.Since(lastActive) >= r.cfg.IdleLogInterval && time.Since(lastIdleLog) >= r.cfg.IdleLogInterval {
+			r.logIdle(ctx, time.Since(lastActive))
+			lastIdleLog = time.Now()
+		}
+
+		if r.cfg.Reconcile && !reconciled && r.target != nil {
+			r.reconcile(ctx)
+			reconciled = true
+		}
+	}
+}
+
+// nextPollInterval adapts the poll interval using AIMD: it halves after a
+// poll that returned changes and grows by a tenth of the range
+// after an empty one, staying within [minPoll, maxPoll].
+func nextPollInterval(interval time.Duration, busy bool, minPoll, maxPoll time.Duration) time.Duration {
+	if busy {
+		return max(interval/2, minPoll)
+	}
+	return min(interval+max((maxPoll-minPoll)/10, time.Millisecond), maxPoll)
+}
+
+// logIdle reports that the replicator is alive and caught up at the slot's
+// confirmed LSN, having seen no changes for idleFor.
+func (r *replicator) logIdle(ctx context.Context, idleFor time.Duration) {
+	var lsn string
+	err := r.source.QueryRow(ctx, `SELECT confirmed_flush_lsn::text FROM pg_replication_slots WHERE slot_name = $1`, r.slotName).Scan(&lsn)
+	if err != nil {
+		log.Printf("%sFailed to read confirmed LSN: %v", r.prefix, err)
+		return
+	}
+	r.printf("Alive and caught up at LSN %s, no changes for %v\n", lsn, idleFor.Round(time.Second))
+}
+
+// countTxnChange counts a change of source transaction xid and warns once
+// the transaction grows past -max-txn-changes. Changes are applied one by one
+// as they are read, never buffered per transaction, so such a transaction is
+// not applied atomically: the target shows it partly applied meanwhile.
+func (r *replicator) countTxnChange(xid uint32, lsn string) {
+	if r.cfg.MaxTxnChanges <= 0 {
+		return
+	}
+	if xid != r.txnXID {
+		r.txnXID, r.txnChanges = xid, 0
+	}
+	r.txnChanges++
+	if r.txnChanges == r.cfg.MaxTxnChanges+1 {
+		log.Printf("%sWarning: transaction %d has more than -max-txn-changes %d changes (at %s); it is applied in parts, not atomically", r.prefix, xid, r.cfg.MaxTxnChanges, lsn)
+	}
+}
+
+// logSlowApply warns about a change that took longer than
+// -slow-apply-threshold to apply, retries included, to point at lock
+// contention and pathological rows without -verbose.
+func (r *replicator) logSlowApply(change WAL2JSONChange, took time.Duration) {
+	if r.cfg.SlowApply <= 0 || took <= r.cfg.SlowApply {
+		return
+	}
+	key := r.values(change.Identity)["id"]
+	if change.Action == "I" {
+		key = r.values(change.Columns)["id"]
+	}
+	log.Printf("%sWarning: Slow apply: %s on %s id %v at %s took %v", r.prefix, change.Action, change.Table, key, change.LSN, took.Round(time.Millisecond))
+}
+
+// poll consumes one batch of changes from the slot and applies them,
+// returning the number of changes fetched. -poll-limit bounds the batch;
+// Postgres only stops at transaction boundaries, so a single large
+// transaction may still exceed it.
+func (r *replicator) poll(ctx context.Context) (int, error) {
+	var limit any // NULL means no limit
+	if r.cfg.PollLimit > 0 {
+		limit = r.cfg.PollLimit
+	}
+
+	// Changes are peeked, and the slot is only advanced past them once they
+	// are applied and the sink has them, so a poll that fails part way
+	// leaves them for the next. The SQL interface only decodes committed
+	// transactions, never streamed in-progress ones, so aborted transactions
+	// are never seen. With format version 2 the slot advances to the commit
+	// rows of the transactions read in full, and with version 1, which
+	// writes a whole transaction per row, to the last row. With -strict and
+	// no dead letter file a failed change stops the poll, as the breaker
+	// opening does with -breaker-failures, leaving its transaction and the
+	// rest in the slot. -peek never advances the slot.
+	strict := r.cfg.Strict && r.deadLetter == nil
+	options := `'format-version', '` + strconv.Itoa(r.cfg.FormatVersion) + `', 'include-timestamp', 'true'`
+	if r.cfg.FormatVersion == 2 {
+		options += `, 'include-transaction', 'true'`
+	}
+	changesSQL := `
+		SELECT lsn::text, xid, data::text
+		FROM pg_logical_slot_peek_changes($1, NULL, $2, ` + options + `)`
+
+	query, queryRow := r.source.Query, r.source.QueryRow
+	if r.slotConn != nil {
+		query, queryRow = r.slotConn.Query, r.slotConn.QueryRow
+	}
+	// WAL decoding into nothing, such as other databases' transactions, has
+	// no commit row to advance to. A poll reading the slot to its end
+	// advances it to the WAL flushed before it started instead, so that the
+	// slot does not retain it. A standby has no flush position to read; its slot only follows
+	// commit rows.
+	var flushed string
+	if !r.cfg.Peek {
+		if err := queryRow(ctx, `SELECT pg_current_wal_flush_lsn()::text`).Scan(&flushed); err != nil {
+			r.debugf("no WAL flush position: %v\n", err)
+			flushed = ""
+		}
+	}
+	changeRows, err := query(ctx, changesSQL, r.slotName, limit)
+	if err != nil {
+		return 0, err
+	}
+	defer changeRows.Close()
+
+	r.debugf("ticker %s\n", time.Now().Format("15:04:05"))
+
+	fetched := 0
+	processedChanges := 0
+	lastLSN := ""
+	relaxed := newRelaxedApply(ctx, r)
+	var failed error // with strict, the change that stopped the poll
+	stopped := false // before the end of the changes read
+	skipping := r.cfg.Peek && r.peekedCommit != 0
+rows:
+	for changeRows.Next() {
+		var lsn, changeData string
+		var xid uint32
+		if err := changeRows.Scan(&lsn, &xid, &changeData); err != nil {
+			log.Printf("%sFailed to scan change: %v", r.prefix, err)
+			continue
+		}
+		if r.cfg.Peek {
+			// Peeking returns the transactions seen before again on every
+			// poll, in commit order, so skip up to the last commit seen.
+			// Change LSNs are no help: those of transactions committed
+			// later can be lower.
+			commit := r.isCommitRow(changeData)
+			if skipping {
+				if commit && parseLSN(lsn) >= r.peekedCommit {
+					skipping = false
+				}
+				continue
+			}
+			if commit {
+				r.peekedCommit = parseLSN(lsn)
+			}
+		}
+		fetched++
+		if r.cfg.FormatVersion == 1 {
+			lastLSN = lsn
+		}
+		err := r.capture.record(capturedChange{
+			Slot: r.slotName, SourceID: r.sourceID, LSN: lsn, XID: xid, CapturedAt: time.Now(), Data: changeData,
+		})
+		if err != nil {
+			log.Printf("%sFailed to capture change: %v", r.prefix, err)
+		}
+		r.debugf("processing change %d\n", processedChanges)
+
+		// Parse wal2json output: a single change per row with format
+		// version 2, a whole transaction with version 1
+		changes, err := r.decodeChanges(changeData, lsn, xid)
+		if err != nil {
+			log.Printf("%sFailed to parse change JSON: %v", r.prefix, err)
+			continue
+		}
+		size := len(changeData) / max(len(changes), 1) // a share of a version 1 transaction
+		for i, change := range changes {
+			switch {
+			case change.Action == "B":
+				r.txnBegin, r.txnMarked = lsn, false
+				continue
+			case change.Action == "C":
+				if r.txnMarked {
+					r.markTxn(Txn{XID: xid, LSN: lsn}, true)
+					r.txnMarked = false
+				}
+				lastLSN = lsn
+				continue
+			}
+			if !r.breaker.allow(time.Now()) {
+				r.printf("Circuit breaker open, leaving the changes from %s in the slot\n", lsn)
+				stopped = true
+				break rows
+			}
+			r.countTxnChange(xid, lsn)
+			if i == 0 && r.seen.check(r.sourceID, lsn, xid) {
+				r.debugf("skipping change at %s, already seen\n", lsn)
+				continue rows
+			}
+			r.metrics.observeDecoded(change, size)
+
+			if r.stats != nil {
+				r.stats.observe(change, size)
+				continue
+			}
+
+			r.debugf("CDC change: action=%s, table=%s\n", change.Action, change.Table)
+			change.Table = r.route(ctx, change.Table)
+			if change.Table != "person" {
+				continue
+			}
+			change, err = r.handleUnsupportedTypes(ctx, change)
+			if err == nil {
+				err = r.checkColumnTypes(ctx, change)
+			}
+			if err != nil {
+				log.Printf("%sSkipping change at %s: %v", r.prefix, lsn, err)
+				err = r.deadLetter.record(capturedChange{
+					Slot: r.slotName, SourceID: r.sourceID, LSN: lsn, XID: xid, CapturedAt: time.Now(), Data: changeData, Reason: err.Error(),
+				})
+				if err != nil {
+					log.Printf("%sFailed to dead-letter change: %v", r.prefix, err)
+				}
+				continue
+			}
+
+			if relaxed != nil {
+				relaxed.apply(ctx, change)
+				continue
+			}
+			started := time.Now()
+			applied, err := r.apply(ctx, change)
+			r.logSlowApply(change, time.Since(started))
+			if err != nil {
+				log.Printf("%sFailed to apply change at %s: %v", r.prefix, lsn, err)
+				if strict {
+					// Nothing past a failed change may be consumed, even on shutdown
+					failed = fmt.Errorf("change at %s: %w", lsn, err)
+					stopped = true
+					break rows
+				}
+				if r.cfg.Strict && ctx.Err() == nil {
+					err = r.deadLetter.record(capturedChange{
+						Slot: r.slotName, SourceID: r.sourceID, LSN: lsn, XID: xid, CapturedAt: time.Now(), Data: changeData, Reason: err.Error(),
+					})
+					if err != nil {
+						log.Printf("%sFailed to dead-letter change: %v", r.prefix, err)
+					}
+				}
+			}
+			if applied {
+				processedChanges++
+				r.metrics.observeApplied(change, time.Now())
+				if committed, err := parseTimestamp(change.Timestamp); err == nil {
+					r.lastCommit = committed
+				}
+			}
+		}
+	}
+	processedChanges += relaxed.wait()
+	changeRows.Close()
+	if err := changeRows.Err(); err != nil {
+		return fetched, err
+	}
+
+	// If the drain deadline cancelled ctx, some changes may not have been
+	// applied; leave the checkpoint where it was rather than skip them.
+	if err := ctx.Err(); err != nil {
+		return fetched, err
+	}
+
+	if err := r.capture.flush(); err != nil {
+		log.Printf("%sFailed to flush capture file: %v", r.prefix, err)
+	}
+	if err := r.deadLetter.flush(); err != nil {
+		log.Printf("%sFailed to flush dead letter file: %v", r.prefix, err)
+	}
+	// A failed transaction is applied again in full after a restart, so its
+	// changes must not be remembered as seen
+	if fetched > 0 && failed == nil {
+		if err := r.seen.save(); err != nil {
+			log.Printf("%sFailed to save seen changes: %v", r.prefix, err)
+		}
+	}
+
+	// Progress must not move past changes the sink has not durably received
+	if r.sink != nil {
+		if err := flushSink(ctx, r.sink); err != nil {
+			return fetched, fmt.Errorf("failed to flush sink, slot not advanced: %w", err)
+		}
+	}
+	upTo := lastLSN
+	if flushed != "" && !stopped && (limit == nil || fetched < r.cfg.PollLimit) && parseLSN(flushed) > parseLSN(upTo) {
+		upTo = flushed
+	}
+	if !r.cfg.Peek && upTo != "" && parseLSN(upTo) > parseLSN(r.advancedTo) {
+		advanced, err := r.advanceSlot(ctx, upTo)
+		if err != nil {
+			return fetched, fmt.Errorf("failed to advance slot past applied changes: %w", err)
+		}
+		r.advancedTo = advanced
+		if r.target != nil {
+			r.recordProgress(ctx, advanced)
+		}
+	}
+	if failed != nil {
+		log.Fatalf("%s-strict: stopping at %v; progress is recorded up to %s and the slot still holds the failed transaction", r.prefix, failed, r.advancedTo)
+	}
+
+	if processedChanges > 0 {
+		r.printf("Processed %d CDC changes\n", processedChanges)
+	}
+	return fetched, nil
+}
+
+// isCommitRow reports whether data, a row of wal2json output, ends a
+// transaction: a commit row with format version 2, any row with version 1,
+// which writes a whole transaction per row.
+func (r *replicator) isCommitRow(data string) bool {
+	if r.cfg.FormatVersion == 1 {
+		return true
+	}
+	var row struct {
+		Action string `json:"action"`
+	}
+	return json.Unmarshal([]byte(data), &row) == nil && row.Action == "C"
+}
+
+// apply writes a single change to the target and the sink, reporting whether
+// it was applied, or why applying it failed.
+func (r *replicator) apply(ctx context.Context, change WAL2JSONChange) (bool, error) {
+	if r.sharded() {
+		return r.applySharded(ctx, change)
+	}
+	if change.Action == "U" && r.cfg.UnwatchedUpdates == "skip" && !r.watchedChanged(change.LSN, columnValues(change.Identity), columnValues(change.Columns)) {
+		r.debugf("skipping update at %s, no -watch-columns changed\n", change.LSN)
+		return false, nil
+	}
+	stmts := r.stmts
+	if r.merge && !r.keyChanged(change) {
+		return r.applyMerge(ctx, change, stmts)
+	}
+	if r.cfg.RowAsJSONB {
+		return r.applyJSONB(ctx, change, stmts)
+	}
+	if r.cfg.AppendOnly {
+		return r.applyAppend(ctx, change, stmts)
+	}
+
+	switch change.Action {
+	case "I": // Insert
+		values := r.values(change.Columns)
+
+		// Insert into target
+		err := r.exec(ctx, stmts.insert, r.annotate(change, r.args(
+			values["id"],
+			values["name"],
+			values["uid"],
+			values["score"],
+			r.createdAt(values["created_at"])))...)
+
+		if err != nil {
+			return false, fmt.Errorf("could not insert CDC record: %w", err)
+		}
+		r.debugf("CDC Insert: ID=%v, Name=%v\n", values["id"], values["name"])
+		r.emit(changeEvent("c", change, nil, values))
+
+	case "U": // Update
+		values := r.values(change.Columns)
+
+		// Update target
+		args, err := r.updateArgs(change, values)
+		if err == nil {
+			err = r.exec(ctx, stmts.update, args...)
+		}
+		if err != nil {
+			return false, fmt.Errorf("could not update CDC record: %w", err)
+		}
+		r.debugf("CDC Update: ID=%v, Name=%v\n", values["id"], values["name"])
+		r.emit(changeEvent("u", change, r.values(change.Identity), values))
+
+	case "D": // Delete
+		// Identity values (primary key)
+		values := r.values(change.Identity)
+
+		// Delete from target
+		err := r.exec(ctx, stmts.delete, r.deleteArgs(change, values["id"])...)
+
+		if err != nil {
+			return false, fmt.Errorf("could not delete CDC record: %w", err)
+		}
+		r.debugf("CDC Delete: ID=%v\n", values["id"])
+		r.emit(changeEvent("d", change, values, nil))
+
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// applyMerge applies a change with MERGE: inserts and updates share one
+// statement, so an update for a missing row inserts it.
+func (r *replicator) applyMerge(ctx context.Context, change WAL2JSONChange, stmts statements) (bool, error) {
+	switch change.Action {
+	case "I", "U":
+		values := r.values(change.Columns)
+		err := r.exec(ctx, stmts.merge, r.annotate(change, r.args(
+			values["id"],
+			values["name"],
+			values["uid"],
+			values["score"],
+			r.createdAt(values["created_at"])))...)
+		if err != nil {
+			return false, fmt.Errorf("could not merge CDC record: %w", err)
+		}
+		r.debugf("CDC Merge: ID=%v, Name=%v\n", values["id"], values["name"])
+		if change.Action == "I" {
+			r.emit(changeEvent("c", change, nil, values))
+		} else {
+			r.emit(changeEvent("u", change, r.values(change.Identity), values))
+		}
+
+	case "D":
+		values := r.values(change.Identity)
+		err := r.exec(ctx, stmts.mergeDelete, r.deleteArgs(change, values["id"])...)
+		if err != nil {
+			return false, fmt.Errorf("could not merge CDC delete: %w", err)
+		}
+		r.debugf("CDC Delete: ID=%v\n", values["id"])
+		r.emit(changeEvent("d", change, values, nil))
+
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// applyJSONB applies a change in -row-as-jsonb mode, where inserts and
+// updates upsert the whole column map as the row's document.
+func (r *replicator) applyJSONB(ctx context.Context, change WAL2JSONChange, stmts statements) (bool, error) {
+	switch change.Action {
+	case "I", "U":
+		values := r.values(change.Columns)
+		err := r.exec(ctx, stmts.insert, values["id"], values)
+		if err != nil {
+			return false, fmt.Errorf("could not upsert CDC document: %w", err)
+		}
+		r.debugf("CDC Upsert: ID=%v\n", values["id"])
+		if change.Action == "I" {
+			r.emit(changeEvent("c", change, nil, values))
+		} else {
+			r.emit(changeEvent("u", change, r.values(change.Identity), values))
+		}
+
+	case "D":
+		values := r.values(change.Identity)
+		err := r.exec(ctx, stmts.delete, values["id"])
+		if err != nil {
+			return false, fmt.Errorf("could not delete CDC document: %w", err)
+		}
+		r.debugf("CDC Delete: ID=%v\n", values["id"])
+		r.emit(changeEvent("d", change, values, nil))
+
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// applyAppend applies a change in -append-only mode. Inserts are appended;
+// updates and deletes are ignored, stop the replicator, or are appended as
+// tombstone rows, depending on -append-updates.
+func (r *replicator) applyAppend(ctx context.Context, change WAL2JSONChange, stmts statements) (bool, error) {
+	if change.Action == "U" || change.Action == "D" {
+		switch r.cfg.AppendUpdates {
+		case "ignore":
+			return false, nil
+		case "error":
+			log.Fatalf("%sGot %s for id %v at %s in -append-only mode", r.prefix, change.Action, r.values(change.Identity)["id"], change.LSN)
+		}
+	}
+
+	switch change.Action {
+	case "I", "U":
+		sql, op := stmts.insert, "c"
+		if change.Action == "U" {
+			sql, op = stmts.update, "u"
+		}
+		values := r.values(change.Columns)
+		err := r.exec(ctx, sql,
+			values["id"],
+			values["name"],
+			values["uid"],
+			values["score"],
+			values["created_at"],
+			change.LSN)
+		if err != nil {
+			return false, fmt.Errorf("could not append CDC record: %w", err)
+		}
+		r.debugf("CDC Append: op=%s, ID=%v, Name=%v\n", op, values["id"], values["name"])
+		if op == "c" {
+			r.emit(changeEvent(op, change, nil, values))
+		} else {
+			r.emit(changeEvent(op, change, r.values(change.Identity), values))
+		}
+
+	case "D":
+		values := r.values(change.Identity)
+		err := r.exec(ctx, stmts.delete, values["id"], change.LSN)
+		if err != nil {
+			return false, fmt.Errorf("could not append CDC tombstone: %w", err)
+		}
+		r.debugf("CDC Append: op=d, ID=%v\n", values["id"])
+		r.emit(changeEvent("d", change, values, nil))
+
+	default:
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIsCommitRow(t *testing.T) {
+	v2 := &replicator{cfg: config{FormatVersion: 2}}
+	tests := []struct {
+		data string
+		want bool
+	}{
+		{`{"action":"B","xid":1}`, false},
+		{`{"action":"I","schema":"public","table":"person","columns":[]}`, false},
+		{`{"action":"C","xid":1}`, true},
+		{`not json`, false},
+	}
+	for _, tt := range tests {
+		if got := v2.isCommitRow(tt.data); got != tt.want {
+			t.Errorf("isCommitRow(%s) = %t, want %t", tt.data, got, tt.want)
+		}
+	}
+	v1 := &replicator{cfg: config{FormatVersion: 1}}
+	if !v1.isCommitRow(`{"xid":1,"change":[]}`) {
+		t.Error("format version 1 row is not a commit")
+	}
+}
+
+func TestNextPollInterval(t *testing.T) {
+	const minPoll, maxPoll = 250 * time.Millisecond, 5 * time.Second
+	tests := []struct {
+		interval time.Duration
+		busy     bool
+		want     time.Duration
+	}{
+		{maxPoll, true, 2500 * time.Millisecond}, // halves
+		{2500 * time.Millisecond, true, 1250 * time.Millisecond},
+		{400 * time.Millisecond, true, minPoll}, // not below the minimum
+		{minPoll, true, minPoll},
+		{minPoll, false, minPoll + 475*time.Millisecond}, // grows by a tenth of the range
+		{4800 * time.Millisecond, false, maxPoll},        // not above the maximum
+		{maxPoll, false, maxPoll},
+	}
+	for _, tt := range tests {
+		if got := nextPollInterval(tt.interval, tt.busy, minPoll, maxPoll); got != tt.want {
+			t.Errorf("nextPollInterval(%v, busy %v) = %v, want %v", tt.interval, tt.busy, got, tt.want)
+		}
+	}
+
+	// Idle polls back off to the maximum in ten steps, and a busy one cuts
+	// the interval at once
+	interval := minPoll
+	for i := 0; i < 10; i++ {
+		interval = nextPollInterval(interval, false, minPoll, maxPoll)
+	}
+	if interval != maxPoll {
+		t.Errorf("after ten idle polls interval %v, want %v", interval, maxPoll)
+	}
+	if interval = nextPollInterval(interval, true, minPoll, maxPoll); interval != maxPoll/2 {
+		t.Errorf("after a busy poll interval %v, want %v", interval, maxPoll/2)
+	}
+
+	// With equal bounds the interval stays fixed
+	if got := nextPollInterval(time.Second, false, time.Second, time.Second); got != time.Second {
+		t.Errorf("fixed interval became %v", got)
+	}
+}
+
+func TestCancelAfterDrain(t *testing.T) {
+	stop, stopNow := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cancelAfterDrain(stop, 50*time.Millisecond, cancel)
+
+	time.Sleep(100 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Fatal("cancelled before being stopped")
+	}
+	stopped := time.Now()
+	stopNow()
+	select {
+	case <-ctx.Done():
+		if drained := time.Since(stopped); drained < 50*time.Millisecond {
+			t.Errorf("cancelled %v after the stop, before the drain timeout", drained)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not cancelled after the drain timeout")
+	}
+}
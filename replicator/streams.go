@@ -0,0 +1,27 @@
+package main
+
+import "fmt"
+
+// streams returns how many replicators run, one per source. Health, metrics
+// and the manifest track each by its index.
+func (cfg config) streams() int {
+	return len(cfg.SourceDSNs)
+}
+
+// streamNames returns how logs and /readyz name each replicator.
+func streamNames(cfg config) []string {
+	names := make([]string, cfg.streams())
+	for i := range names {
+		names[i] = fmt.Sprintf("source %d", i+1)
+	}
+	return names
+}
+
+// streamLabels returns the Prometheus labels identifying each replicator.
+func streamLabels(cfg config) []string {
+	labels := make([]string, cfg.streams())
+	for i := range labels {
+		labels[i] = fmt.Sprintf(`source="%d"`, i+1)
+	}
+	return labels
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// keyColumns are the person columns that can serve as -target-key, in the
+// order the insert and update statements take them as parameters.
+var keyColumns = []string{"id", "name", "uid", "score"}
+
+// keyedStatements returns single-source statements that upsert and update
+// by -target-key instead of id, and never overwrite the -no-update-columns of
+// an existing row. Deletes still match on id, the only column in the source's
+// default replica identity. Unless the key is id, a created target table is
+// unique on the key and has no id sequence, and updates set the key too and
+// match on its old value, from a last parameter after the others. With
+// -annotate, inserts and updates also set the annotation columns from two
+// extra parameters. With -soft-delete, deletes set the tombstone column to
+// their second parameter instead, and inserts and updates clear it.
+func keyedStatements(cfg config) statements {
+	key, noUpdate, annotate, tombstone := cfg.TargetKey, cfg.NoUpdateColumns, cfg.Annotate, cfg.SoftDelete
+	var sets, excluded, merged []string
+	for i, col := range keyColumns {
+		if col == key {
+			if key != "id" {
+				sets = append(sets, fmt.Sprintf("%s = $%d", col, i+1))
+			}
+			continue
+		}
+		if slices.Contains(noUpdate, col) {
+			continue
+		}
+		sets = append(sets, fmt.Sprintf("%s = $%d", col, i+1))
+		excluded = append(excluded, fmt.Sprintf("%s = EXCLUDED.%s", col, col))
+		merged = append(merged, fmt.Sprintf("%s = s.%s", col, col))
+	}
+	cols := "id, name, uid, score, created_at"
+	params := "$1, $2, $3, $4, $5"
+	typedParams := "$1::integer, $2::varchar, $3::uuid, $4::integer, $5::timestamp"
+	keyParam := 1 // the new id of single-source updates
+	if key != "id" {
+		keyParam = len(keyColumns) + 1
+		if annotate {
+			keyParam += len(annotationColumns)
+		}
+	}
+	if annotate {
+		cols += ", " + strings.Join(annotationColumns, ", ")
+		params += ", $6, $7"
+		typedParams += ", $6::pg_lsn, $7::timestamptz"
+		for i, col := range annotationColumns {
+			sets = append(sets, fmt.Sprintf("%s = $%d", col, len(keyColumns)+i+1))
+			excluded = append(excluded, fmt.Sprintf("%s = EXCLUDED.%s", col, col))
+			merged = append(merged, fmt.Sprintf("%s = s.%s", col, col))
+		}
+	}
+	if tombstone != "" {
+		sets = append(sets, tombstone+" = NULL")
+		excluded = append(excluded, tombstone+" = NULL")
+		merged = append(merged, tombstone+" = NULL")
+	}
+
+	stmts := singleSourceStatements
+	if key != "id" {
+		stmts.createTable = `
+		CREATE TABLE IF NOT EXISTS person (
+			id INTEGER NOT NULL,
+			name VARCHAR(100) NOT NULL,
+			uid UUID NOT NULL,
+			score INTEGER NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (` + key + `)
+		);`
+		stmts.snapshotInsert = `
+		INSERT INTO person (id, name, uid, score, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (` + key + `) DO NOTHING`
+	}
+	if annotate {
+		stmts.createTable += annotateTableSQL
+	}
+	if tombstone != "" {
+		stmts.createTable += `
+	ALTER TABLE person ADD COLUMN IF NOT EXISTS ` + tombstone + ` TIMESTAMPTZ;`
+		stmts.delete = `UPDATE person SET ` + tombstone + ` = COALESCE($2::timestamptz, now()) WHERE id = $1`
+		stmts.mergeDelete = stmts.delete
+	}
+	stmts.insert = `
+		INSERT INTO person (` + cols + `)
+		VALUES (` + params + `)
+		ON CONFLICT (` + key + `) DO UPDATE SET ` + strings.Join(excluded, ", ")
+	stmts.update = fmt.Sprintf(`
+		UPDATE person
+		SET %s
+		WHERE %s = $%d`, strings.Join(sets, ", "), key, keyParam)
+	stmts.merge = `
+		MERGE INTO person t
+		USING (VALUES (` + typedParams + `))
+			AS s (` + cols + `)
+		ON t.` + key + ` = s.` + key + `
+		WHEN MATCHED THEN UPDATE SET ` + strings.Join(merged, ", ") + `
+		WHEN NOT MATCHED THEN
+			INSERT (` + cols + `)
+			VALUES (s.` + strings.ReplaceAll(cols, ", ", ", s.") + `)`
+	return stmts
+}
+
+// checkUniqueKey checks that the target person table has a unique index on
+// exactly key, which ON CONFLICT (key) needs as its conflict target.
+func checkUniqueKey(ctx context.Context, pool *pgxpool.Pool, key string) error {
+	var ok bool
+	err := pool.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1
+			FROM pg_index i
+			JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = i.indkey[0]
+			WHERE i.indrelid = 'person'::regclass
+			  AND i.indisunique
+			  AND i.indnkeyatts = 1
+			  AND i.indpred IS NULL
+			  AND a.attname = $1)`, key).Scan(&ok)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no unique constraint on person (%s)", key)
+	}
+	return nil
+}
+
+// checkTargetKey makes sure updates can be matched on a -target-key other
+// than id by its old value, which wal2json only reports for every update with
+// REPLICA IDENTITY FULL on the source. Otherwise an update changing the key
+// would match no target row and be lost.
+func (r *replicator) checkTargetKey(ctx context.Context) {
+	if r.cfg.TargetKey == "id" {
+		return
+	}
+	full, err := replicaIdentityFull(ctx, r.source)
+	if err != nil {
+		log.Fatalf("%sCould not read the source's replica identity: %v", r.prefix, err)
+	}
+	if !full {
+		log.Fatalf("%s-target-key %s needs REPLICA IDENTITY FULL on the source person table", r.prefix, r.cfg.TargetKey)
+	}
+}
+
+// updateArgs returns the parameters of the update statement for change:
+// those of values, then the old -target-key if it is not id.
+func (r *replicator) updateArgs(change WAL2JSONChange, values map[string]any) ([]any, error) {
+	args := r.annotate(change, r.args(
+		values["id"],
+		values["name"],
+		values["uid"],
+		values["score"]))
+	if r.cfg.TargetKey == "id" {
+		return args, nil
+	}
+	old, ok := r.values(change.Identity)[r.cfg.TargetKey]
+	if !ok {
+		return nil, fmt.Errorf("update at %s has no old %s; set REPLICA IDENTITY FULL on the source", change.LSN, r.cfg.TargetKey)
+	}
+	return append(args, old), nil
+}
+
+// keyChanged reports whether change is an update of a -target-key other than
+// id, which MERGE, matching on the new key, would insert as another row.
+func (r *replicator) keyChanged(change WAL2JSONChange) bool {
+	if r.cfg.TargetKey == "id" || change.Action != "U" {
+		return false
+	}
+	old, ok := r.values(change.Identity)[r.cfg.TargetKey]
+	return ok && fmt.Sprint(old) != fmt.Sprint(r.values(change.Columns)[r.cfg.TargetKey])
+}
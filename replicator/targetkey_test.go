@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestKeyedUpdateMatchesOldKey(t *testing.T) {
+	tests := []struct {
+		cfg   config
+		set   string
+		where string
+	}{
+		{config{TargetKey: "uid"}, "uid = $3", "WHERE uid = $5"},
+		{config{TargetKey: "uid", Annotate: true}, "uid = $3", "WHERE uid = $7"},
+		{config{TargetKey: "name", NoUpdateColumns: []string{"score"}}, "name = $2", "WHERE name = $5"},
+	}
+	for _, tt := range tests {
+		update := keyedStatements(tt.cfg).update
+		if !strings.Contains(update, tt.set) || !strings.HasSuffix(update, tt.where) {
+			t.Errorf("-target-key %s: update %q, want it to set %s and end %s", tt.cfg.TargetKey, update, tt.set, tt.where)
+		}
+	}
+	if update := keyedStatements(config{TargetKey: "id", Annotate: true}).update; !strings.HasSuffix(update, "WHERE id = $1") || strings.Contains(update, "id = $1,") {
+		t.Errorf("-target-key id: update %q, want it to match on $1 without setting id", update)
+	}
+}
+
+func TestUpdateArgs(t *testing.T) {
+	r := &replicator{cfg: config{TargetKey: "uid"}}
+	change := WAL2JSONChange{
+		Action: "U",
+		Columns: []WAL2JSONColumn{
+			{Name: "id", Value: float64(1)}, {Name: "name", Value: "a"},
+			{Name: "uid", Value: "new"}, {Name: "score", Value: float64(2)},
+		},
+		Identity: []WAL2JSONColumn{
+			{Name: "id", Value: float64(1)}, {Name: "name", Value: "a"},
+			{Name: "uid", Value: "old"}, {Name: "score", Value: float64(2)},
+		},
+	}
+	args, err := r.updateArgs(change, r.values(change.Columns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(args); got != "[1 a new 2 old]" {
+		t.Errorf("args %s, want [1 a new 2 old]", got)
+	}
+	if !r.keyChanged(change) {
+		t.Error("uid changed from old to new: keyChanged false")
+	}
+
+	change.Identity = []WAL2JSONColumn{{Name: "id", Value: float64(1)}}
+	if _, err := r.updateArgs(change, r.values(change.Columns)); err == nil {
+		t.Error("identity without uid: no error")
+	}
+	if r.keyChanged(change) {
+		t.Error("identity without uid: keyChanged true")
+	}
+}
+
+func TestNoUpdateColumnsStatements(t *testing.T) {
+	stmts := keyedStatements(config{TargetKey: "id", NoUpdateColumns: []string{"uid", "score"}})
+	for name, sql := range map[string]string{"insert": stmts.insert, "update": stmts.update, "merge": stmts.merge} {
+		for _, col := range []string{"uid", "score"} {
+			for _, set := range []string{col + " = EXCLUDED." + col, col + " = $", col + " = s." + col} {
+				if strings.Contains(sql, set) {
+					t.Errorf("%s %q overwrites %s", name, sql, col)
+				}
+			}
+		}
+		if !strings.Contains(sql, "name = ") {
+			t.Errorf("%s %q does not update name", name, sql)
+		}
+	}
+	// Inserts still set every column
+	if !strings.Contains(stmts.insert, "(id, name, uid, score, created_at)") || !strings.Contains(stmts.merge, "INSERT (id, name, uid, score, created_at)") {
+		t.Errorf("insert %q or merge %q does not insert every column", stmts.insert, stmts.merge)
+	}
+}
+
+func TestSoftDeleteStatements(t *testing.T) {
+	stmts := keyedStatements(config{TargetKey: "id", SoftDelete: "deleted_at"})
+	if !strings.HasPrefix(stmts.delete, "UPDATE person SET deleted_at = ") || stmts.mergeDelete != stmts.delete {
+		t.Errorf("delete %q, merge delete %q, want both to set the tombstone", stmts.delete, stmts.mergeDelete)
+	}
+	for name, sql := range map[string]string{"insert": stmts.insert, "update": stmts.update, "merge": stmts.merge} {
+		if !strings.Contains(sql, "deleted_at = NULL") {
+			t.Errorf("%s %q does not clear the tombstone", name, sql)
+		}
+	}
+	if !strings.Contains(stmts.createTable, "ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ") {
+		t.Errorf("create table %q does not add the tombstone column", stmts.createTable)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// checkTargetDSN refuses a target connection string whose hosts, as pgx
+// resolves them (including PGHOST and any fallback hosts), are not in
+// -allowed-target-hosts, or match -production-target-pattern without
+// -i-know-this-is-production. This guards shared environments against a
+// target accidentally pointed at production. An empty dsn is checked like
+// any other, as pgx resolves it to PGHOST or the default host.
+func (cfg config) checkTargetDSN(dsn string) error {
+	if len(cfg.AllowedTargetHosts) == 0 && cfg.ProductionTarget == "" {
+		return nil
+	}
+	connConfig, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return errors.New(redactDSN(err.Error()))
+	}
+	hosts := []string{connConfig.Host}
+	for _, fallback := range connConfig.Fallbacks {
+		hosts = append(hosts, fallback.Host)
+	}
+	for _, host := range hosts {
+		if len(cfg.AllowedTargetHosts) > 0 && !slices.ContainsFunc(cfg.AllowedTargetHosts, func(allowed string) bool {
+			return strings.EqualFold(strings.TrimSpace(allowed), host)
+		}) {
+			return fmt.Errorf("target host %s is not in -allowed-target-hosts", host)
+		}
+		if cfg.ProductionTarget != "" && !cfg.IKnowProduction && regexp.MustCompile(cfg.ProductionTarget).MatchString(host) {
+			return fmt.Errorf("target host %s matches -production-target-pattern; pass -i-know-this-is-production to write to it", host)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// schemaCache holds the column types of the target person table for
+// -check-column-types, and whether the target has the hstore extension,
+// re-reading them once they are older than interval. It is shared by all
+// sources.
+type schemaCache struct {
+	mu       sync.Mutex
+	pool     *pgxpool.Pool
+	interval time.Duration
+	cols     map[string]string
+	hstore   bool
+	loaded   time.Time
+}
+
+func (c *schemaCache) columns(ctx context.Context) (map[string]string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cols == nil || time.Since(c.loaded) >= c.interval {
+		cols, err := formattedColumnTypes(ctx, c.pool)
+		if err != nil {
+			return nil, false, err
+		}
+		var hstore bool
+		if err := c.pool.QueryRow(ctx, `SELECT to_regtype('hstore') IS NOT NULL`).Scan(&hstore); err != nil {
+			return nil, false, err
+		}
+		c.cols, c.hstore, c.loaded = cols, hstore, time.Now()
+	}
+	return c.cols, c.hstore, nil
+}
+
+// checkColumnTypes compares the column types wal2json reports for change
+// against the target schema, so that a source schema change the target
+// cannot accept is reported clearly instead of failing at bind time.
+func (r *replicator) checkColumnTypes(ctx context.Context, change WAL2JSONChange) error {
+	if r.schema == nil {
+		return nil
+	}
+	target, hstore, err := r.schema.columns(ctx)
+	if err != nil {
+		return fmt.Errorf("could not read target schema: %w", err)
+	}
+	cols := change.Columns
+	if change.Action == "D" {
+		cols = change.Identity
+	}
+	for _, col := range cols {
+		if col.Type == "hstore" && !hstore {
+			return fmt.Errorf("column %s is hstore, but the hstore extension is not installed on the target", col.Name)
+		}
+		targetType, ok := target[col.Name]
+		if !ok {
+			return fmt.Errorf("column %s (%s) does not exist on the target", col.Name, col.Type)
+		}
+		if col.Type != targetType {
+			return fmt.Errorf("column %s is %s on the source but %s on the target", col.Name, col.Type, targetType)
+		}
+	}
+	return nil
+}
+
+// formattedColumnTypes returns the type of each column of the person table
+// as format_type prints it, including modifiers such as "(100)", which is how
+// wal2json reports column types.
+func formattedColumnTypes(ctx context.Context, pool *pgxpool.Pool) (map[string]string, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT attname, format_type(atttypid, atttypmod)
+		FROM pg_attribute
+		WHERE attrelid = 'person'::regclass AND attnum > 0 AND NOT attisdropped`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		cols[name] = typ
+	}
+	return cols, rows.Err()
+}
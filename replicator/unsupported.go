@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+)
+
+// handleUnsupportedTypes applies -on-unsupported-type to the columns of
+// change whose types decodeValue has no decoder for: composite types, and
+// arrays of them. Bound as text, the target has to parse their literals,
+// which fails unless its type matches exactly. raw-text binds them anyway,
+// skip-column drops them from change, so that mirrored columns are written
+// as NULL and sink events and -row-as-jsonb rows leave them out, and fail
+// returns an error, for the change to be skipped like one failing
+// -check-column-types. Each affected type is logged once.
+func (r *replicator) handleUnsupportedTypes(ctx context.Context, change WAL2JSONChange) (WAL2JSONChange, error) {
+	unsupported := func(col WAL2JSONColumn) bool {
+		return r.isUnsupportedType(ctx, col)
+	}
+	if !slices.ContainsFunc(change.Columns, unsupported) && !slices.ContainsFunc(change.Identity, unsupported) {
+		return change, nil
+	}
+	switch r.cfg.OnUnsupportedType {
+	case "fail":
+		for _, cols := range [][]WAL2JSONColumn{change.Columns, change.Identity} {
+			if i := slices.IndexFunc(cols, unsupported); i >= 0 {
+				return change, fmt.Errorf("column %s has type %s, which has no decoder", cols[i].Name, cols[i].Type)
+			}
+		}
+	case "skip-column":
+		change.Columns = slices.DeleteFunc(slices.Clone(change.Columns), unsupported)
+		change.Identity = slices.DeleteFunc(slices.Clone(change.Identity), unsupported)
+	}
+	return change, nil
+}
+
+// isUnsupportedType reports whether the type of col has no decoder, looking
+// it up on the source the first time it is seen. A failed lookup is logged
+// and treated as supported, to be tried again with the next change.
+func (r *replicator) isUnsupportedType(ctx context.Context, col WAL2JSONColumn) bool {
+	if unsupported, ok := r.unsupportedTypes[col.Type]; ok {
+		return unsupported
+	}
+	var unsupported bool
+	err := r.source.QueryRow(ctx, `
+		SELECT COALESCE((
+			SELECT t.typtype = 'c' OR COALESCE(e.typtype = 'c', false)
+			FROM pg_type t
+			LEFT JOIN pg_type e ON e.oid = t.typelem AND t.typcategory = 'A'
+			WHERE t.oid = to_regtype($1)
+		), false)`, col.Type).Scan(&unsupported)
+	if err != nil {
+		log.Printf("%sWarning: Could not look up type %s of column %s: %v", r.prefix, col.Type, col.Name, err)
+		return false
+	}
+	if r.unsupportedTypes == nil {
+		r.unsupportedTypes = make(map[string]bool)
+	}
+	r.unsupportedTypes[col.Type] = unsupported
+	if unsupported {
+		log.Printf("%sWarning: column %s has type %s, which has no decoder; -on-unsupported-type %s", r.prefix, col.Name, col.Type, r.cfg.OnUnsupportedType)
+	}
+	return unsupported
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// validate runs the preflight checks against every configured database,
+// prints a pass/fail report and reports whether all checks passed. Nothing is
+// changed apart from a temporary slot that is dropped straight away.
+func validate(ctx context.Context, cfg config) bool {
+	ok := true
+	report := func(name string, err error) {
+		if err != nil {
+			fmt.Printf("  [FAIL] %s: %v\n", name, err)
+			ok = false
+			return
+		}
+		fmt.Printf("  [PASS] %s\n", name)
+	}
+
+	fmt.Println("Preflight checks:")
+	target, err := newPool(ctx, cfg.TargetDSN, cfg, cfg.TargetSettings...)
+	if err == nil {
+		defer target.Close()
+		err = target.Ping(ctx)
+	}
+	report("target: connect", err)
+	if err != nil {
+		target = nil
+	}
+
+	targetRead := target
+	if target != nil && cfg.TargetReadDSN != "" {
+		targetRead, err = newTargetReadPool(ctx, cfg, target, nil)
+		if err == nil {
+			defer targetRead.Close()
+		}
+		report("target (read): connect", err)
+		if err != nil {
+			targetRead = nil
+		}
+	}
+
+	var targetCols map[string]string
+	if target != nil && targetRead != nil {
+		targetCols, err = personColumns(ctx, targetRead)
+		report("target: read person schema", err)
+		report("target: can write person", checkTargetWritable(ctx, target, len(targetCols) > 0))
+		if cfg.TargetKey != "id" && len(targetCols) > 0 {
+			report("target: unique constraint on "+cfg.TargetKey, checkUniqueKey(ctx, targetRead, cfg.TargetKey))
+		}
+	}
+
+	for i, dsn := range cfg.SourceDSNs {
+		name := "source"
+		if len(cfg.SourceDSNs) > 1 {
+			name = fmt.Sprintf("source %d", i+1)
+		}
+		source, err := newPool(ctx, dsn, cfg)
+		if err == nil {
+			defer source.Close()
+			err = source.Ping(ctx)
+		}
+		report(name+": connect", err)
+		if err != nil {
+			continue
+		}
+		report(name+": wal_level is logical", checkWALLevel(ctx, source))
+		report(name+": free replication slot", checkSlotCapacity(ctx, source))
+		report(name+": can create wal2json slot", checkWal2JSONSlot(ctx, source))
+
+		sourceCols, err := personColumns(ctx, source)
+		if err == nil && len(sourceCols) == 0 {
+			err = fmt.Errorf("table person does not exist")
+		}
+		report(name+": person table exists", err)
+		if len(sourceCols) > 0 {
+			report(name+": replica identity carries id", checkReplicaIdentity(ctx, source))
+		}
+		if target != nil && len(sourceCols) > 0 && len(targetCols) > 0 && !cfg.RowAsJSONB {
+			report(name+": target schema compatible", compareColumns(sourceCols, targetCols))
+		}
+	}
+
+	if ok {
+		fmt.Println("All preflight checks passed")
+	} else {
+		fmt.Println("Some preflight checks failed")
+	}
+	return ok
+}
+
+func checkWALLevel(ctx context.Context, pool *pgxpool.Pool) error {
+	var level string
+	if err := pool.QueryRow(ctx, "SHOW wal_level").Scan(&level); err != nil {
+		return err
+	}
+	if level != "logical" {
+		return fmt.Errorf("wal_level is %q", level)
+	}
+	return nil
+}
+
+func checkSlotCapacity(ctx context.Context, pool *pgxpool.Pool) error {
+	var max, used int
+	err := pool.QueryRow(ctx, `
+		SELECT current_setting('max_replication_slots')::int,
+		       (SELECT COUNT(*) FROM pg_replication_slots)`).Scan(&max, &used)
+	if err != nil {
+		return err
+	}
+	if used >= max {
+		return fmt.Errorf("all %d replication slots are in use", max)
+	}
+	return nil
+}
+
+// checkWal2JSONSlot creates and drops a temporary wal2json slot, which proves
+// both that the plugin is installed and that we may create slots.
+func checkWal2JSONSlot(ctx context.Context, pool *pgxpool.Pool) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	slot := "cdc_preflight_check"
+	_, err = conn.Exec(ctx, `SELECT pg_create_logical_replication_slot($1, 'wal2json', true)`, slot)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(ctx, `SELECT pg_drop_replication_slot($1)`, slot)
+	return err
+}
+
+// checkTargetWritable checks that person can be written, or created if it
+// does not exist yet.
+func checkTargetWritable(ctx context.Context, pool *pgxpool.Pool, exists bool) error {
+	var ok bool
+	var err error
+	if exists {
+		err = pool.QueryRow(ctx, `SELECT has_table_privilege('person', 'INSERT, UPDATE, DELETE')`).Scan(&ok)
+	} else {
+		err = pool.QueryRow(ctx, `SELECT has_schema_privilege('public', 'CREATE')`).Scan(&ok)
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("missing privileges")
+	}
+	return nil
+}
+
+// personColumns returns the data type of each column of the person table,
+// or an empty map if it does not exist.
+func personColumns(ctx context.Context, pool *pgxpool.Pool) (map[string]string, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT column_name, data_type
+		FROM information_schema.columns
+		WHERE table_schema = 'public' AND table_name = 'person'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		cols[name] = typ
+	}
+	return cols, rows.Err()
+}
+
+// compareColumns checks that every source column exists on the target with
+// the same type. Extra target columns (such as source_id) are allowed.
+func compareColumns(source, target map[string]string) error {
+	for name, typ := range source {
+		targetType, ok := target[name]
+		if !ok {
+			return fmt.Errorf("column %s missing on target", name)
+		}
+		if targetType != typ {
+			return fmt.Errorf("column %s is %s on source but %s on target", name, typ, targetType)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"slices"
+	"testing"
+)
+
+// fetchFrom returns a fetcher of rows, which are in id order, counting the
+// chunks fetched in chunks.
+func fetchFrom(rows []rowHash, chunks *int) rowHashFetcher {
+	return func(_ context.Context, first bool, after, limit int) ([]rowHash, error) {
+		*chunks++
+		i := 0
+		if !first {
+			i = slices.IndexFunc(rows, func(row rowHash) bool { return row.id > after })
+			if i < 0 {
+				return nil, nil
+			}
+		}
+		return rows[i:min(i+limit, len(rows))], nil
+	}
+}
+
+func TestCompareRowHashes(t *testing.T) {
+	source := []rowHash{{1, "a"}, {2, "b"}, {3, "c"}, {5, "e"}, {6, "f"}, {8, "h"}}
+	target := []rowHash{{-1, "z"}, {1, "a"}, {3, "x"}, {4, "d"}, {5, "e"}, {6, "f"}, {9, "i"}}
+	for _, size := range []int{1, 2, 3, 100} {
+		var sourceChunks, targetChunks int
+		diff, err := compareRowHashes(context.Background(), fetchFrom(source, &sourceChunks), fetchFrom(target, &targetChunks), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff.sourceRows != 6 || diff.targetRows != 7 {
+			t.Errorf("size %d: %d source and %d target rows, want 6 and 7", size, diff.sourceRows, diff.targetRows)
+		}
+		for _, kind := range []struct {
+			name      string
+			got, want []int
+		}{
+			{"missing", diff.missing.ids, []int{2, 8}},
+			{"extra", diff.extra.ids, []int{-1, 4, 9}},
+			{"different", diff.different.ids, []int{3}},
+		} {
+			if !slices.Equal(kind.got, kind.want) {
+				t.Errorf("size %d: %s ids %v, want %v", size, kind.name, kind.got, kind.want)
+			}
+		}
+		if want := len(source)/size + 1; sourceChunks != want {
+			t.Errorf("size %d: fetched %d source chunks, want %d", size, sourceChunks, want)
+		}
+	}
+}
+
+func TestCompareRowHashesError(t *testing.T) {
+	var chunks int
+	failing := func(context.Context, bool, int, int) ([]rowHash, error) { return nil, errors.New("connection lost") }
+	if _, err := compareRowHashes(context.Background(), fetchFrom(nil, &chunks), failing, 10); err == nil {
+		t.Error("failing target: no error")
+	}
+}
+
+func TestIDSample(t *testing.T) {
+	var s idSample
+	for id := 1; id <= 3; id++ {
+		s.add(id)
+	}
+	if s.String() != "[1 2 3]" {
+		t.Errorf("three ids listed as %s", s.String())
+	}
+	for id := 4; id <= 25; id++ {
+		s.add(id)
+	}
+	if s.count != 25 || len(s.ids) != 20 || s.String() != "[1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20 ...]" {
+		t.Errorf("25 ids counted %d, listed as %s", s.count, s.String())
+	}
+}
+
+func TestHashColumnsNull(t *testing.T) {
+	str := func(s string) *string { return &s }
+	sum := func(cols ...column) string { return hashColumns(fnv.New64a(), nil, cols) }
+	if sum(column{"created_at", nil}) == sum(column{"created_at", str("")}) {
+		t.Error("NULL hashes like the empty string")
+	}
+	if sum(column{"name", str("ab")}, column{"uid", str("")}) == sum(column{"name", str("a")}, column{"uid", str("b")}) {
+		t.Error("values hash the same across column boundaries")
+	}
+	if sum(column{"name", nil}, column{"uid", str("x")}) == sum(column{"name", str("x")}, column{"uid", nil}) {
+		t.Error("NULLs hash the same in different columns")
+	}
+	skipped := hashColumns(fnv.New64a(), []string{"created_at"}, []column{{"name", str("a")}, {"created_at", nil}})
+	if skipped != sum(column{"name", str("a")}) {
+		t.Error("skipped column hashed")
+	}
+}
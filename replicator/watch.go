@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// watchedChanged reports whether the update at lsn changes any of
+// -watch-columns, comparing its new values with the old ones in its
+// identity. Without
+// -watch-columns every update counts as a change. The identity only holds
+// old values of every column with REPLICA IDENTITY FULL on the source; a
+// watched column missing from it may have changed, so the update counts as
+// a change too. A column missing from the new values is an unchanged TOASTed
+// value, which wal2json leaves out.
+func (r *replicator) watchedChanged(lsn string, before, after map[string]any) bool {
+	if len(r.cfg.WatchColumns) == 0 {
+		return true
+	}
+	for _, col := range r.cfg.WatchColumns {
+		newValue, ok := after[col]
+		if !ok {
+			continue
+		}
+		oldValue, ok := before[col]
+		if !ok {
+			if atomic.CompareAndSwapInt32(&r.warnedUnwatched, 0, 1) {
+				log.Printf("%sWarning: update at %s has no old value of %s, so every update is handled as a change; -watch-columns needs REPLICA IDENTITY FULL on the source", r.prefix, lsn, col)
+			}
+			return true
+		}
+		if fmt.Sprint(oldValue) != fmt.Sprint(newValue) {
+			return true
+		}
+	}
+	return false
+}
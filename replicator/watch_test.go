@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestEmitKeepsUnwatchedUpdatesFromSink(t *testing.T) {
+	source, err := pgxpool.New(context.Background(), "host=localhost dbname=source") // never connects
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	masker, err := newMasker(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &flakySink{}
+	r := &replicator{cfg: config{WatchColumns: []string{"score"}, UnwatchedUpdates: "apply"}, source: source, sink: sink, masker: masker}
+
+	unwatched := changeOf("U", 1, 1)
+	unwatched.Identity = append(unwatched.Identity, WAL2JSONColumn{Name: "score", Value: float64(5)}, WAL2JSONColumn{Name: "name", Value: "Ada"})
+	unwatched.Columns = append(unwatched.Columns, WAL2JSONColumn{Name: "score", Value: float64(5)}, WAL2JSONColumn{Name: "name", Value: "Grace"})
+	watched := changeOf("U", 1, 1)
+	watched.Identity = append(watched.Identity, WAL2JSONColumn{Name: "score", Value: float64(5)})
+	watched.Columns = append(watched.Columns, WAL2JSONColumn{Name: "score", Value: float64(6)})
+	for _, change := range []WAL2JSONChange{unwatched, watched} {
+		r.emit(changeEvent("u", change, r.values(change.Identity), r.values(change.Columns)))
+	}
+	r.emit(changeEvent("c", changeOf("I", 2, 2), nil, r.values(changeOf("I", 2, 2).Columns)))
+
+	if len(sink.events) != 2 || sink.events[0].After["score"] != float64(6) || sink.events[1].Op != "c" {
+		t.Errorf("sink got %+v, want the update of score and the insert", sink.events)
+	}
+}
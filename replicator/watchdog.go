@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// lagWatchdog turns lag the replicator cannot work off into a failure: with
+// -max-lag-exit, a source whose lag stays over the threshold for
+// -max-lag-duration makes the process exit non-zero, so that orchestration
+// running a migration can alert instead of waiting forever. The threshold is
+// either slot lag in bytes or the age of the last applied change while the
+// slot is not drained. It is shared by all sources and a nil lagWatchdog
+// never fires.
+type lagWatchdog struct {
+	mu        sync.Mutex
+	maxBytes  int64         // zero if the threshold is a duration
+	maxDelay  time.Duration // zero if the threshold is in bytes
+	sustain   time.Duration
+	overSince []time.Time // by source index; zero while under the threshold
+	names     []string    // of the sources, by index
+	now       time.Time   // time of the latest observation
+}
+
+// parseMaxLag parses -max-lag-exit: a number of bytes or a duration.
+func parseMaxLag(s string) (int64, time.Duration, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 {
+		return n, 0, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return 0, d, nil
+	}
+	return 0, 0, fmt.Errorf("invalid -max-lag-exit %q, want a positive number of bytes or a duration such as 5m", s)
+}
+
+func newLagWatchdog(cfg config) *lagWatchdog {
+	if cfg.MaxLagExit == "" {
+		return nil
+	}
+	maxBytes, maxDelay, _ := parseMaxLag(cfg.MaxLagExit) // checked in parseFlags
+	return &lagWatchdog{maxBytes: maxBytes, maxDelay: maxDelay, sustain: cfg.MaxLagDuration, overSince: make([]time.Time, cfg.streams()), names: streamNames(cfg)}
+}
+
+// observe records the lag of source i measured at now: lagBytes behind on
+// the slot, with the last applied change delay old. It exits the process if
+// the lag has been over the threshold for -max-lag-duration.
+func (w *lagWatchdog) observe(i int, lagBytes int64, delay time.Duration, now time.Time) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.now = now
+	over := w.maxBytes > 0 && lagBytes > w.maxBytes || w.maxDelay > 0 && delay > w.maxDelay
+	switch {
+	case !over:
+		w.overSince[i] = time.Time{}
+	case w.overSince[i].IsZero():
+		w.overSince[i] = now
+	case now.Sub(w.overSince[i]) >= w.sustain:
+		log.Fatalf("%s: lag (%d bytes, last change %v old) over -max-lag-exit %s for %v, giving up",
+			w.names[i], lagBytes, delay.Round(time.Second), w.threshold(), now.Sub(w.overSince[i]).Round(time.Second))
+	}
+}
+
+func (w *lagWatchdog) threshold() string {
+	if w.maxBytes > 0 {
+		return fmt.Sprintf("%d bytes", w.maxBytes)
+	}
+	return w.maxDelay.String()
+}
+
+// overFor returns how long each source has been over the threshold, as of
+// the latest observation.
+func (w *lagWatchdog) overFor() []time.Duration {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	over := make([]time.Duration, len(w.overSince))
+	for i, since := range w.overSince {
+		if !since.IsZero() {
+			over[i] = w.now.Sub(since)
+		}
+	}
+	return over
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestParseMaxLag(t *testing.T) {
+	tests := []struct {
+		s        string
+		maxBytes int64
+		maxDelay time.Duration
+		wantErr  bool
+	}{
+		{"104857600", 104857600, 0, false},
+		{"5m", 0, 5 * time.Minute, false},
+		{"0", 0, 0, true},
+		{"-5m", 0, 0, true},
+		{"100MB", 0, 0, true},
+		{"", 0, 0, true},
+	}
+	for _, tt := range tests {
+		maxBytes, maxDelay, err := parseMaxLag(tt.s)
+		if (err != nil) != tt.wantErr || maxBytes != tt.maxBytes || maxDelay != tt.maxDelay {
+			t.Errorf("parseMaxLag(%q) = %d, %v, %v", tt.s, maxBytes, maxDelay, err)
+		}
+	}
+}
+
+func TestLagWatchdogTracksOverThreshold(t *testing.T) {
+	w := newLagWatchdog(config{MaxLagExit: "1000", MaxLagDuration: time.Minute, SourceDSNs: []string{"a", "b"}})
+	start := time.Now()
+	w.observe(0, 2000, 0, start)
+	w.observe(1, 10, 0, start)
+	w.observe(0, 2000, 0, start.Add(30*time.Second))
+	w.observe(1, 10, 0, start.Add(30*time.Second))
+	if over := w.overFor(); over[0] != 30*time.Second || over[1] != 0 {
+		t.Errorf("over for %v, want [30s 0s]", over)
+	}
+	w.observe(0, 500, 0, start.Add(40*time.Second))
+	if over := w.overFor(); over[0] != 0 {
+		t.Errorf("over for %v after catching up, want 0", over[0])
+	}
+}
+
+func TestLagWatchdogDelayThreshold(t *testing.T) {
+	w := newLagWatchdog(config{MaxLagExit: "5m", MaxLagDuration: time.Hour, SourceDSNs: []string{"a"}})
+	start := time.Now()
+	w.observe(0, 1<<40, time.Minute, start)
+	if over := w.overFor(); over[0] != 0 {
+		t.Errorf("bytes lag counted against a duration threshold")
+	}
+	w.observe(0, 0, 10*time.Minute, start)
+	w.observe(0, 0, 10*time.Minute, start.Add(time.Second))
+	if over := w.overFor(); over[0] != time.Second {
+		t.Errorf("over for %v, want 1s", over[0])
+	}
+}
+
+func TestLagWatchdogExits(t *testing.T) {
+	if os.Getenv("CDC_WATCHDOG_EXIT") != "" {
+		w := newLagWatchdog(config{MaxLagExit: "1000", MaxLagDuration: time.Minute, SourceDSNs: []string{"a"}})
+		start := time.Now()
+		w.observe(0, 2000, 0, start)
+		w.observe(0, 2000, 0, start.Add(time.Minute))
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLagWatchdogExits$")
+	cmd.Env = append(os.Environ(), "CDC_WATCHDOG_EXIT=1")
+	if err := cmd.Run(); err == nil {
+		t.Error("lag over the threshold for -max-lag-duration did not exit non-zero")
+	}
+}
+
+func TestNilLagWatchdog(t *testing.T) {
+	w := newLagWatchdog(config{})
+	w.observe(0, 1<<40, time.Hour, time.Now())
+	if w.overFor() != nil {
+		t.Error("nil watchdog tracks lag")
+	}
+}
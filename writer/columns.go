@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/juliaogris/postgres-cdc-example/internal/pgutil"
+)
+
+// column is a column of the generated table. gen returns the value for the
+// nth inserted row; columns without gen are left to their default.
+type column struct {
+	name string
+	ddl  string // type and constraints
+	gen  func(n int) any
+}
+
+var names = []string{"Alice", "Bob", "Charlie", "Diana", "Eve", "Frank", "Grace", "Henry", "Iris", "Jack"}
+
+// personColumns is the default schema, matching the replicator's person table.
+var personColumns = []column{
+	{name: "name", ddl: "VARCHAR(100) NOT NULL", gen: func(n int) any { return names[rand.Intn(len(names))] + fmt.Sprintf("_%d", n) }},
+	{name: "uid", ddl: "UUID NOT NULL", gen: func(int) any { return uuid.New() }},
+	{name: "score", ddl: "INTEGER NOT NULL", gen: func(int) any { return rand.Intn(100) + 1 }},
+	{name: "created_at", ddl: "TIMESTAMP DEFAULT CURRENT_TIMESTAMP"},
+}
+
+// generators produce random values by base type name, i.e. without
+// modifiers such as "(100)".
+var generators = map[string]func(n int) any{
+	"smallint":                    func(int) any { return int16(rand.Intn(1000)) },
+	"integer":                     func(int) any { return rand.Int31() },
+	"int":                         func(int) any { return rand.Int31() },
+	"bigint":                      func(int) any { return rand.Int63() },
+	"numeric":                     func(int) any { return fmt.Sprintf("%.2f", rand.Float64()*1000) },
+	"real":                        func(int) any { return rand.Float32() * 1000 },
+	"double precision":            func(int) any { return rand.Float64() * 1000 },
+	"text":                        func(n int) any { return names[rand.Intn(len(names))] + fmt.Sprintf("_%d", n) },
+	"varchar":                     func(n int) any { return names[rand.Intn(len(names))] + fmt.Sprintf("_%d", n) },
+	"character varying":           func(n int) any { return names[rand.Intn(len(names))] + fmt.Sprintf("_%d", n) },
+	"uuid":                        func(int) any { return uuid.New() },
+	"boolean":                     func(int) any { return rand.Intn(2) == 1 },
+	"date":                        func(int) any { return time.Now().AddDate(0, 0, -rand.Intn(365)) },
+	"timestamp":                   func(int) any { return time.Now() },
+	"timestamp without time zone": func(int) any { return time.Now() },
+	"timestamptz":                 func(int) any { return time.Now() },
+	"timestamp with time zone":    func(int) any { return time.Now() },
+	"jsonb":                       func(n int) any { return map[string]any{"n": n, "value": rand.Intn(100)} },
+}
+
+// typeModifierRE matches the numeric modifier of a type, such as "(50)".
+// Anything else in the type is refused, as it goes into the DDL.
+var typeModifierRE = regexp.MustCompile(`\(\s*\d+\s*\)`)
+
+// parseColumns parses a -columns descriptor of the form
+// "name:type,name:type", e.g. "title:varchar(50),qty:integer,active:boolean".
+func parseColumns(spec string) ([]column, error) {
+	var cols []column
+	for _, field := range strings.Split(spec, ",") {
+		name, typ, ok := strings.Cut(strings.TrimSpace(field), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid column %q, want name:type", field)
+		}
+		if err := pgutil.CheckIdentifier("column name", name); err != nil {
+			return nil, err
+		}
+		if name == "id" {
+			return nil, fmt.Errorf("column id is always added as the primary key")
+		}
+		base := strings.ToLower(strings.TrimSpace(typeModifierRE.ReplaceAllString(typ, "")))
+		gen, ok := generators[base]
+		if !ok {
+			return nil, fmt.Errorf("column %s: cannot generate values of type %q", name, typ)
+		}
+		cols = append(cols, column{name: name, ddl: typ + " NOT NULL", gen: gen})
+	}
+	return cols, nil
+}
+
+// createTableSQL returns the DDL for table with a serial id primary key
+// followed by cols.
+func createTableSQL(table string, cols []column) string {
+	defs := []string{"id SERIAL PRIMARY KEY"}
+	for _, col := range cols {
+		defs = append(defs, col.name+" "+col.ddl)
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n)", table, strings.Join(defs, ",\n\t"))
+}
+
+// insertSQL returns the insert statement for the generated columns of cols,
+// and those columns.
+func insertSQL(table string, cols []column) (string, []column) {
+	var generated []column
+	var colNames, params []string
+	for _, col := range cols {
+		if col.gen == nil {
+			continue
+		}
+		generated = append(generated, col)
+		colNames = append(colNames, col.name)
+		params = append(params, fmt.Sprintf("$%d", len(params)+1))
+	}
+	sql := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(colNames, ", "), strings.Join(params, ", "))
+	return sql, generated
+}
+
+// updateSQL returns the statement overwriting the generated columns of the
+// row with id, the last parameter.
+func updateSQL(table string, generated []column) string {
+	sets := make([]string, len(generated))
+	for i, col := range generated {
+		sets[i] = fmt.Sprintf("%s = $%d", col.name, i+1)
+	}
+	return fmt.Sprintf("UPDATE %s SET %s WHERE id = $%d", table, strings.Join(sets, ", "), len(generated)+1)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseColumns(t *testing.T) {
+	cols, err := parseColumns("title:varchar(50), qty:INTEGER,price:numeric(10),active:boolean,at:timestamp with time zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names, ddls []string
+	for _, col := range cols {
+		names = append(names, col.name)
+		ddls = append(ddls, col.ddl)
+		if col.gen == nil {
+			t.Errorf("column %s has no generator", col.name)
+		}
+	}
+	if want := []string{"title", "qty", "price", "active", "at"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names %q, want %q", names, want)
+	}
+	want := []string{"varchar(50) NOT NULL", "INTEGER NOT NULL", "numeric(10) NOT NULL", "boolean NOT NULL", "timestamp with time zone NOT NULL"}
+	if !reflect.DeepEqual(ddls, want) {
+		t.Errorf("ddl %q, want %q", ddls, want)
+	}
+}
+
+func TestParseColumnsErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"title",
+		"title:varchar,",
+		"id:integer",
+		"bad name:text",
+		"title:blob",
+		"qty:integer(1); DROP TABLE person; --)",
+		"qty:integer(x)",
+	} {
+		if cols, err := parseColumns(spec); err == nil {
+			t.Errorf("parseColumns(%q) = %d columns, want an error", spec, len(cols))
+		}
+	}
+}
+
+func TestColumnSQL(t *testing.T) {
+	cols := []column{
+		{name: "name", ddl: "text NOT NULL", gen: func(int) any { return "x" }},
+		{name: "created_at", ddl: "TIMESTAMP DEFAULT CURRENT_TIMESTAMP"},
+		{name: "score", ddl: "integer NOT NULL", gen: func(int) any { return 1 }},
+	}
+	if got, want := createTableSQL("person", cols), "CREATE TABLE IF NOT EXISTS person (\n\tid SERIAL PRIMARY KEY,\n\tname text NOT NULL,\n\tcreated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,\n\tscore integer NOT NULL\n)"; got != want {
+		t.Errorf("createTableSQL = %q, want %q", got, want)
+	}
+	insert, generated := insertSQL("person", cols)
+	if want := "INSERT INTO person (name, score) VALUES ($1, $2)"; insert != want || len(generated) != 2 {
+		t.Errorf("insertSQL = %q with %d columns, want %q with 2", insert, len(generated), want)
+	}
+	if got, want := updateSQL("person", generated), "UPDATE person SET name = $1, score = $2 WHERE id = $3"; got != want {
+		t.Errorf("updateSQL = %q, want %q", got, want)
+	}
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/juliaogris/postgres-cdc-example/internal/pgutil"
 )
 
 const (
@@ -20,53 +25,175 @@ const (
 )
 
 func main() {
+	rate := flag.Float64("rate", 1, "rows to insert per second")
+	total := flag.Int("total", 0, "exit after inserting this many rows (0 means no limit)")
+	stopAfter := flag.Duration("stop-after", 0, "exit after running for this long (0 means no limit)")
+	connectTimeout := flag.Duration("connect-timeout", time.Minute, "keep retrying to connect to the database for this long")
+	appName := flag.String("application-name", pgutil.ApplicationName("cdc-writer"), "application_name reported to the server")
+	table := flag.String("table", "person", "table to create and insert into")
+	columnSpec := flag.String("columns", "", "columns of -table besides the id primary key, as name:type,... (default the person columns)")
+	concurrency := flag.Int("concurrency", 1, "write from this many goroutines, together at -rate, so that the source sees concurrent transactions")
+	hotspotKeys := flag.Int("hotspot-keys", 0, "insert this many rows, then keep updating them at random instead of inserting, to stress per-key ordering (0 disables)")
+	flag.Parse()
+	interval, err := tickInterval(*rate)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *concurrency < 1 {
+		log.Fatal("-concurrency must be at least 1")
+	}
+	if *hotspotKeys < 0 {
+		log.Fatal("-hotspot-keys must not be negative")
+	}
+	if err := pgutil.CheckIdentifier("table name", *table); err != nil {
+		log.Fatal(err)
+	}
+	cols := personColumns
+	if *columnSpec != "" {
+		var err error
+		cols, err = parseColumns(*columnSpec)
+		if err != nil {
+			log.Fatal("Invalid -columns: ", err)
+		}
+	}
+
 	ctx := context.Background()
 
 	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
 		host, port, user, password, dbname)
 
-	pool, err := pgxpool.New(ctx, connStr)
+	pool, err := pgutil.ConnectWithRetry(ctx, connStr, pgutil.Options{
+		Timeout:         *connectTimeout,
+		ApplicationName: *appName,
+		Configure: func(cfg *pgxpool.Config) {
+			cfg.MaxConns = max(cfg.MaxConns, int32(*concurrency))
+		},
+	})
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
 	defer pool.Close()
 
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS person (
-		id SERIAL PRIMARY KEY,
-		name VARCHAR(100) NOT NULL,
-		uid UUID NOT NULL,
-		score INTEGER NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
-	_, err = pool.Exec(ctx, createTableSQL)
+	_, err = pool.Exec(ctx, createTableSQL(*table, cols))
 	if err != nil {
 		log.Fatal("Failed to create table:", err)
 	}
-	fmt.Println("Table 'person' created or already exists")
+	fmt.Printf("Table '%s' created or already exists\n", *table)
+	insert, generated := insertSQL(*table, cols)
 
-	// Random data generation
-	names := []string{"Alice", "Bob", "Charlie", "Diana", "Eve", "Frank", "Grace", "Henry", "Iris", "Jack"}
+	// With -hotspot-keys, seed the hot rows; every write below updates one
+	var hot []int
+	for i := 0; i < *hotspotKeys; i++ {
+		var id int
+		if err := pool.QueryRow(ctx, insert+" RETURNING id", generate(generated, i+1)...).Scan(&id); err != nil {
+			log.Fatal("Failed to insert hot row:", err)
+		}
+		hot = append(hot, id)
+	}
+	if len(hot) > 0 {
+		fmt.Printf("Updating %d hot rows with ids %d to %d\n", len(hot), hot[0], hot[len(hot)-1])
+	}
+	update := updateSQL(*table, generated)
 
-	// Insert random data every second
-	ticker := time.NewTicker(1 * time.Second)
+	// Insert random data at the configured rate. All workers take their turn
+	// from the one ticker, so together they write at -rate.
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	counter := 0
-	for range ticker.C {
-		counter++
-
-		name := names[rand.Intn(len(names))] + fmt.Sprintf("_%d", counter)
-		uid := uuid.New()
-		score := rand.Intn(100) + 1
+	done, finish := context.WithCancel(ctx)
+	defer finish()
+	if *stopAfter > 0 {
+		time.AfterFunc(*stopAfter, finish)
+	}
 
-		insertSQL := `INSERT INTO person (name, uid, score) VALUES ($1, $2, $3)`
-		_, err := pool.Exec(ctx, insertSQL, name, uid, score)
-		if err != nil {
+	written := writeRows(done, finish, ticker.C, *concurrency, *total, func(n int) error {
+		args := generate(generated, n)
+		fields := make([]string, len(generated))
+		for i, col := range generated {
+			fields[i] = fmt.Sprintf("%s=%v", col.name, args[i])
+		}
+		if len(hot) > 0 {
+			id := hot[rand.Intn(len(hot))]
+			if _, err := pool.Exec(ctx, update, append(args, id)...); err != nil {
+				log.Printf("Failed to update record %d: %v", id, err)
+				return err
+			}
+			fmt.Printf("Updated %d: %s\n", id, strings.Join(fields, ", "))
+			return nil
+		}
+		if _, err := pool.Exec(ctx, insert, args...); err != nil {
 			log.Printf("Failed to insert record: %v", err)
-			continue
+			return err
 		}
+		fmt.Printf("Inserted: %s\n", strings.Join(fields, ", "))
+		return nil
+	})
+	if len(hot) > 0 {
+		fmt.Printf("Updated %d hot records in total\n", written)
+		return
+	}
+	fmt.Printf("Inserted %d records in total\n", written)
+}
+
+// writeRows calls write from workers goroutines, each taking its turn from
+// tick, until done is cancelled or, if total is positive, total calls have
+// succeeded, and then calls finish. It returns the number of calls that
+// succeeded. Rows are numbered from 1 in the order they are started; a failed
+// row's number is not reused, but its place in the total is given back, so
+// that exactly total rows are written. No more than total are ever being
+// written at once, and a worker finding them all claimed waits for the next
+// tick, in case one fails.
+func writeRows(done context.Context, finish func(), tick <-chan time.Time, workers, total int, write func(n int) error) int {
+	var counter, claimed, succeeded atomic.Int64
+	limit := int64(total)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done.Done():
+					return
+				case <-tick:
+				}
+				if limit > 0 && claimed.Add(1) > limit {
+					claimed.Add(-1)
+					continue
+				}
+				if err := write(int(counter.Add(1))); err != nil {
+					claimed.Add(-1)
+					continue
+				}
+				if succeeded.Add(1) == limit {
+					finish()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return int(succeeded.Load())
+}
+
+// tickInterval returns the time between rows at rate rows per second. The
+// ticker needs a positive interval, so rates above one row per nanosecond,
+// as well as non-positive ones, are refused.
+func tickInterval(rate float64) (time.Duration, error) {
+	if !(rate > 0) {
+		return 0, errors.New("-rate must be positive")
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	if interval <= 0 {
+		return 0, fmt.Errorf("-rate must be at most %d rows per second", time.Second)
+	}
+	return interval, nil
+}
 
-		fmt.Printf("Inserted: Name=%s, UID=%s, Score=%d\n", name, uid, score)
+// generate returns values for the generated columns of the nth row.
+func generate(generated []column, n int) []any {
+	args := make([]any, len(generated))
+	for i, col := range generated {
+		args[i] = col.gen(n)
 	}
+	return args
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTickInterval(t *testing.T) {
+	tests := []struct {
+		rate float64
+		want time.Duration
+	}{
+		{1, time.Second},
+		{0.5, 2 * time.Second},
+		{1000, time.Millisecond},
+		{1e9, time.Nanosecond},
+	}
+	for _, tt := range tests {
+		got, err := tickInterval(tt.rate)
+		if err != nil || got != tt.want {
+			t.Errorf("tickInterval(%v) = %v, %v, want %v", tt.rate, got, err, tt.want)
+		}
+	}
+	for _, rate := range []float64{0, -1, 2e9, math.Inf(1), math.NaN()} {
+		if got, err := tickInterval(rate); err == nil {
+			t.Errorf("tickInterval(%v) = %v, want an error", rate, got)
+		}
+	}
+}
+
+func TestWriteRowsConcurrent(t *testing.T) {
+	tick := make(chan time.Time)
+	close(tick) // a tick whenever a worker wants one
+	for _, workers := range []int{1, 2, 8, 32} {
+		done, finish := context.WithCancel(context.Background())
+		var mu sync.Mutex
+		rows := map[int]bool{}
+		var calls atomic.Int64
+		written := writeRows(done, finish, tick, workers, 100, func(n int) error {
+			calls.Add(1)
+			if n%3 == 0 {
+				return errors.New("write failed")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if rows[n] {
+				t.Errorf("row %d written twice", n)
+			}
+			rows[n] = true
+			return nil
+		})
+		finish()
+		if written != 100 || len(rows) != 100 {
+			t.Errorf("%d workers: %d rows written, %d reported, want 100", workers, len(rows), written)
+		}
+		if got := calls.Load(); got < 100 {
+			t.Errorf("%d workers: %d writes attempted", workers, got)
+		}
+	}
+}
+
+func TestWriteRowsUntilDone(t *testing.T) {
+	tick := make(chan time.Time)
+	done, finish := context.WithCancel(context.Background())
+	go func() {
+		for i := 0; i < 10; i++ {
+			tick <- time.Now()
+		}
+		finish()
+	}()
+	if written := writeRows(done, finish, tick, 4, 0, func(int) error { return nil }); written != 10 {
+		t.Errorf("%d rows written, want one per tick, 10", written)
+	}
+}